@@ -20,17 +20,25 @@ import (
 	controller "ServiceMonitorScale/internal/controller"
 	"crypto/tls"
 	"flag"
+	"net/http"
 	"os"
+	"sort"
+	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
 	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
@@ -51,11 +59,33 @@ func init() {
 }
 
 func main() {
+	// plan子命令不连接集群，只输出生成的ServiceMonitor
+	if len(os.Args) > 1 && os.Args[1] == "plan" {
+		os.Exit(runPlan(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+	}
+
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
 	var secureMetrics bool
 	var enableHTTP2 bool
+	var configFile string
+	var monitorNamespace string
+	var discoveryLabels string
+	var nameTemplate string
+	var nonInvasive bool
+	var syncPeriod time.Duration
+	var namespaceSelector string
+	var includeNamespaces string
+	var excludeNamespaces string
+	var optIn bool
+	var excludeServiceTypes string
+	var excludeSelector string
+	var excludeNames string
+	var dryRun bool
+	var podMonitors bool
+	var ignoreLegacyAnnotations bool
+	var generateAlerts bool
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
@@ -65,6 +95,47 @@ func main() {
 		"If set the metrics endpoint is served securely")
 	flag.BoolVar(&enableHTTP2, "enable-http2", false,
 		"If set, HTTP/2 will be enabled for the metrics and webhook servers")
+	flag.StringVar(&configFile, "config", "",
+		"Path to a YAML file configuring how ServiceMonitors are generated. Flags below override it.")
+	flag.StringVar(&monitorNamespace, "monitor-namespace", "",
+		"Namespace the generated ServiceMonitors are written to (default \"default\").")
+	flag.StringVar(&discoveryLabels, "discovery-labels", "",
+		"Comma-separated key=value labels matching the Prometheus serviceMonitorSelector "+
+			"(default \"release=kube-prometheus-stack\").")
+	flag.StringVar(&nameTemplate, "name-template", "",
+		"Go template for ServiceMonitor names, with .Namespace, .Name and .App (default \"{{ .Namespace }}-{{ .Name }}\").")
+	flag.BoolVar(&nonInvasive, "non-invasive", false,
+		"If set, Services are never modified; ServiceMonitors select Services by their existing labels "+
+			"and scrape unnamed ports by targetPort.")
+	flag.DurationVar(&syncPeriod, "sync-period", 10*time.Minute,
+		"Period at which all watched Services and ServiceMonitors are reconciled again, "+
+			"repairing generated ServiceMonitors that drifted.")
+	flag.StringVar(&namespaceSelector, "namespace-selector", "",
+		"Label selector of the Namespaces whose Services are monitored "+
+			"(default \"servicemonitorscale.tal.com/enabled=true\").")
+	flag.StringVar(&includeNamespaces, "include-namespaces", "",
+		"Comma-separated Namespaces whose Services are monitored regardless of their labels.")
+	flag.StringVar(&excludeNamespaces, "exclude-namespaces", "",
+		"Comma-separated Namespaces whose Services are never monitored (default \"kube-system\").")
+	flag.BoolVar(&optIn, "opt-in", false,
+		"If set, only Services annotated with servicemonitorscale.tal.com/scrape=true are monitored.")
+	flag.StringVar(&excludeServiceTypes, "exclude-service-types", "",
+		"Comma-separated Service types that are never monitored. ExternalName Services are always skipped.")
+	flag.StringVar(&excludeSelector, "exclude-selector", "",
+		"Label selector of Services that are never monitored.")
+	flag.StringVar(&excludeNames, "exclude-names", "",
+		"Comma-separated regular expressions of Service names that are never monitored.")
+	flag.BoolVar(&dryRun, "dry-run", false,
+		"If set, no Service, ServiceMonitor or Event is written. Planned changes are logged, "+
+			"served as JSON at /dry-run on the metrics endpoint and counted by servicemonitorscale_dry_run_planned_changes.")
+	flag.BoolVar(&podMonitors, "pod-monitors", false,
+		"If set, PodMonitors are generated for Deployments, StatefulSets, DaemonSets and standalone Pods "+
+			"annotated with servicemonitorscale.tal.com/scrape=true.")
+	flag.BoolVar(&ignoreLegacyAnnotations, "ignore-legacy-annotations", false,
+		"If set, the prometheus.io/scrape, port, path and scheme annotations on Services are ignored.")
+	flag.BoolVar(&generateAlerts, "generate-alerts", false,
+		"If set, a PrometheusRule with target down, scrape duration and sample limit alerts is generated "+
+			"alongside each ServiceMonitor.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -73,6 +144,68 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	controllerOpts := controller.DefaultOptions()
+	if configFile != "" {
+		var err error
+		controllerOpts, err = controller.LoadOptions(configFile)
+		if err != nil {
+			setupLog.Error(err, "unable to load config file")
+			os.Exit(1)
+		}
+	}
+	if monitorNamespace != "" {
+		controllerOpts.MonitorNamespace = monitorNamespace
+	}
+	if discoveryLabels != "" {
+		selectorLabels, err := labels.ConvertSelectorToLabelsMap(discoveryLabels)
+		if err != nil {
+			setupLog.Error(err, "invalid --discovery-labels")
+			os.Exit(1)
+		}
+		controllerOpts.DiscoveryLabels = selectorLabels
+	}
+	if nameTemplate != "" {
+		controllerOpts.NameTemplate = nameTemplate
+	}
+	if nonInvasive {
+		controllerOpts.NonInvasive = true
+	}
+	if namespaceSelector != "" {
+		controllerOpts.NamespaceSelector = namespaceSelector
+	}
+	if includeNamespaces != "" {
+		controllerOpts.IncludeNamespaces = strings.Split(includeNamespaces, ",")
+	}
+	if excludeNamespaces != "" {
+		controllerOpts.ExcludeNamespaces = strings.Split(excludeNamespaces, ",")
+	}
+	if optIn {
+		controllerOpts.OptIn = true
+	}
+	if excludeServiceTypes != "" {
+		controllerOpts.ExcludeServiceTypes = strings.Split(excludeServiceTypes, ",")
+	}
+	if excludeSelector != "" {
+		controllerOpts.ExcludeSelector = excludeSelector
+	}
+	if excludeNames != "" {
+		controllerOpts.ExcludeNames = strings.Split(excludeNames, ",")
+	}
+	if podMonitors {
+		controllerOpts.PodMonitors = true
+	}
+	if ignoreLegacyAnnotations {
+		controllerOpts.IgnoreLegacyAnnotations = true
+	}
+	if generateAlerts {
+		controllerOpts.Alerts.Enabled = true
+	}
+	// 兼容旧的ServiceNamespaces环境变量，其中的命名空间总是被处理
+	if serviceNamespaces := os.Getenv("ServiceNamespaces"); serviceNamespaces != "" {
+		setupLog.Info("ServiceNamespaces env is deprecated, use --namespace-selector or --include-namespaces")
+		controllerOpts.IncludeNamespaces = append(controllerOpts.IncludeNamespaces, strings.Split(serviceNamespaces, ",")...)
+	}
+
 	// if the enable-http2 flag is false (the default), http/2 should be disabled
 	// due to its vulnerabilities. More specifically, disabling http/2 will
 	// prevent from being vulnerable to the HTTP/2 Stream Cancellation and
@@ -93,12 +226,43 @@ func main() {
 		TLSOpts: tlsOpts,
 	})
 
+	// dry-run模式下计划执行的修改通过metrics server的/dry-run提供
+	var dryRunReport *controller.DryRunReport
+	extraHandlers := map[string]http.Handler{}
+	if dryRun {
+		setupLog.Info("dry-run mode enabled, no changes will be written")
+		dryRunReport = controller.NewDryRunReport()
+		extraHandlers["/dry-run"] = dryRunReport
+	}
+	// 没有被ServiceMonitor覆盖的Service通过metrics server的/coverage提供。
+	// controller-runtime的health probe server不支持注册其他handler，metrics server关闭时在启动日志中提示
+	coverage := controller.NewCoverageHandler()
+	extraHandlers["/coverage"] = coverage
+	if metricsAddr == "0" {
+		paths := make([]string, 0, len(extraHandlers))
+		for path := range extraHandlers {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		setupLog.Info("metrics server is disabled, its endpoints are not served", "paths", paths)
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme: scheme,
+		Cache: cache.Options{
+			SyncPeriod: &syncPeriod,
+			// 只缓存复制鉴权内容的Secret，Service引用的Secret和ConfigMap直接从API server读取
+			ByObject: map[client.Object]cache.ByObject{
+				&corev1.Secret{}: {
+					Namespaces: map[string]cache.Config{controllerOpts.MonitorNamespace: {}},
+				},
+			},
+		},
 		Metrics: metricsserver.Options{
 			BindAddress:   metricsAddr,
 			SecureServing: secureMetrics,
 			TLSOpts:       tlsOpts,
+			ExtraHandlers: extraHandlers,
 		},
 		WebhookServer:          webhookServer,
 		HealthProbeBindAddress: probeAddr,
@@ -120,13 +284,37 @@ func main() {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
+	// ServiceMonitor和PodMonitor共用同一组检查worker和检查结果
+	probes := controller.NewDefaultProbeWorkerPool()
+	if err := mgr.Add(probes); err != nil {
+		setupLog.Error(err, "unable to set up metrics endpoint probes")
+		os.Exit(1)
+	}
 	if err = (&controller.ServiceReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("servicemonitorscale"),
+		Probes:   probes,
+		Options:  controllerOpts,
+		DryRun:   dryRunReport,
+		Coverage: coverage,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "ServiceMonitorConfig")
 		os.Exit(1)
 	}
+	if controllerOpts.PodMonitors {
+		if err = (&controller.PodMonitorReconciler{
+			Client:   mgr.GetClient(),
+			Scheme:   mgr.GetScheme(),
+			Recorder: mgr.GetEventRecorderFor("servicemonitorscale"),
+			Probes:   probes,
+			Options:  controllerOpts,
+			DryRun:   dryRunReport,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "PodMonitor")
+			os.Exit(1)
+		}
+	}
 
 	//+kubebuilder:scaffold:builder
 
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	controller "ServiceMonitorScale/internal/controller"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+)
+
+// fileList 可以重复指定的-f参数
+type fileList []string
+
+func (f *fileList) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *fileList) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// runPlan 实现plan子命令：不连接集群，从文件或标准输入读取Service清单，
+// 按控制器的规则输出生成的ServiceMonitor。被跳过的Service以注释的形式输出，
+// 发生错误或ServiceMonitor名称冲突时返回非0
+func runPlan(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("plan", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var files fileList
+	var configFile string
+	var showServices bool
+	flags.Var(&files, "f", "Service manifest to read, may be repeated. \"-\" or no -f reads standard input.")
+	flags.StringVar(&configFile, "config", "", "Path to the controller's YAML config file.")
+	flags.BoolVar(&showServices, "services", false,
+		"Also print the Services with the discovery labels and port names the controller would write.")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s plan [-f FILE]... [--config FILE] [--services]\n\n"+
+			"Render the ServiceMonitors the controller would generate for the given Services, without a cluster.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	opts := controller.DefaultOptions()
+	if configFile != "" {
+		var err error
+		if opts, err = controller.LoadOptions(configFile); err != nil {
+			fmt.Fprintf(stderr, "unable to load config file: %v\n", err)
+			return 1
+		}
+	}
+
+	if len(files) == 0 {
+		files = fileList{"-"}
+	}
+	var services []*corev1.Service
+	for _, file := range files {
+		var r io.Reader = stdin
+		if file != "-" {
+			f, err := os.Open(file)
+			if err != nil {
+				fmt.Fprintf(stderr, "%v\n", err)
+				return 1
+			}
+			defer f.Close()
+			r = f
+		}
+		read, err := readServices(r)
+		if err != nil {
+			fmt.Fprintf(stderr, "failed to read %s: %v\n", file, err)
+			return 1
+		}
+		services = append(services, read...)
+	}
+
+	exitCode := 0
+	owners := make(map[string]string)
+	for _, service := range services {
+		key := service.Namespace + "/" + service.Name
+		plan, err := opts.PlanService(service)
+		if err != nil {
+			fmt.Fprintf(stderr, "Service %s: %v\n", key, err)
+			exitCode = 1
+			continue
+		}
+		for _, warning := range plan.Warnings {
+			fmt.Fprintf(stderr, "Service %s: warning: %v\n", key, warning)
+		}
+		if plan.SkipReason != "" {
+			fmt.Fprintf(stdout, "# Service %s skipped (%s): %s\n", key, plan.SkipReason, plan.SkipMessage)
+			continue
+		}
+
+		sm := plan.ServiceMonitor
+		smKey := sm.Namespace + "/" + sm.Name
+		// 与控制器一样，同名的ServiceMonitor只属于第一个生成它的Service
+		if owner, ok := owners[smKey]; ok {
+			fmt.Fprintf(stderr, "Service %s: ServiceMonitor %s is already generated for Service %s\n", key, smKey, owner)
+			exitCode = 1
+			continue
+		}
+		owners[smKey] = key
+
+		if showServices && plan.ServiceChanged {
+			if err := printObject(stdout, plan.Service); err != nil {
+				fmt.Fprintf(stderr, "Service %s: %v\n", key, err)
+				return 1
+			}
+		}
+		if err := printObject(stdout, sm); err != nil {
+			fmt.Fprintf(stderr, "Service %s: %v\n", key, err)
+			return 1
+		}
+		if plan.PrometheusRule != nil {
+			if err := printObject(stdout, plan.PrometheusRule); err != nil {
+				fmt.Fprintf(stderr, "Service %s: %v\n", key, err)
+				return 1
+			}
+		}
+	}
+	return exitCode
+}
+
+// readServices 读取多文档YAML或JSON中的Service，支持List和ServiceList，忽略其他类型的对象
+func readServices(r io.Reader) ([]*corev1.Service, error) {
+	var services []*corev1.Service
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(r))
+	for {
+		doc, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return services, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+		read, err := decodeServices(doc)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, read...)
+	}
+}
+
+func decodeServices(doc []byte) ([]*corev1.Service, error) {
+	var typeMeta metav1.TypeMeta
+	if err := yaml.Unmarshal(doc, &typeMeta); err != nil {
+		return nil, err
+	}
+	switch typeMeta.Kind {
+	case "Service":
+		service := &corev1.Service{}
+		if err := yaml.Unmarshal(doc, service); err != nil {
+			return nil, err
+		}
+		if service.Namespace == "" {
+			service.Namespace = metav1.NamespaceDefault
+		}
+		return []*corev1.Service{service}, nil
+	case "List", "ServiceList":
+		var list struct {
+			Items []json.RawMessage `json:"items"`
+		}
+		if err := yaml.Unmarshal(doc, &list); err != nil {
+			return nil, err
+		}
+		var services []*corev1.Service
+		for _, item := range list.Items {
+			read, err := decodeServices(item)
+			if err != nil {
+				return nil, err
+			}
+			services = append(services, read...)
+		}
+		return services, nil
+	default:
+		return nil, nil
+	}
+}
+
+// printObject 以YAML文档的形式输出对象，去掉空的creationTimestamp、status和未设置的targetPort
+func printObject(w io.Writer, obj interface{}) error {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return err
+	}
+	if metadata, ok := content["metadata"].(map[string]interface{}); ok {
+		delete(metadata, "creationTimestamp")
+	}
+	delete(content, "status")
+	if spec, ok := content["spec"].(map[string]interface{}); ok {
+		ports, _ := spec["ports"].([]interface{})
+		for _, port := range ports {
+			if port, ok := port.(map[string]interface{}); ok && port["targetPort"] == int64(0) {
+				delete(port, "targetPort")
+			}
+		}
+	}
+	data, err := yaml.Marshal(content)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "---\n%s", data)
+	return err
+}
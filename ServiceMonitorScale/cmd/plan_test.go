@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func TestReadServices(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{
+			name:  "empty input",
+			input: "",
+		},
+		{
+			name: "multiple documents",
+			input: `apiVersion: v1
+kind: Service
+metadata:
+  name: api
+  namespace: demo
+---
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  namespace: demo
+`,
+			want: []string{"demo/api", "demo/web"},
+		},
+		{
+			name: "default namespace",
+			input: `apiVersion: v1
+kind: Service
+metadata:
+  name: api
+`,
+			want: []string{"default/api"},
+		},
+		{
+			name: "List and ServiceList",
+			input: `apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Service
+  metadata:
+    name: api
+    namespace: demo
+- apiVersion: v1
+  kind: List
+  items:
+  - apiVersion: v1
+    kind: Service
+    metadata:
+      name: nested
+      namespace: demo
+---
+apiVersion: v1
+kind: ServiceList
+items:
+- apiVersion: v1
+  kind: Service
+  metadata:
+    name: web
+    namespace: demo
+`,
+			want: []string{"demo/api", "demo/nested", "demo/web"},
+		},
+		{
+			name: "JSON",
+			input: `{"apiVersion": "v1", "kind": "Service", "metadata": {"name": "api", "namespace": "demo"}}
+`,
+			want: []string{"demo/api"},
+		},
+		{
+			name: "other kinds are ignored",
+			input: `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: api
+  namespace: demo
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: api
+    namespace: demo
+- apiVersion: v1
+  kind: Service
+  metadata:
+    name: api
+    namespace: demo
+`,
+			want: []string{"demo/api"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			services, err := readServices(strings.NewReader(tt.input))
+			if err != nil {
+				t.Fatalf("readServices() error = %v", err)
+			}
+			var got []string
+			for _, service := range services {
+				got = append(got, service.Namespace+"/"+service.Name)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("readServices() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadServicesErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{name: "invalid YAML", input: "kind: Service\nmetadata: [\n"},
+		{name: "invalid Service", input: "kind: Service\nspec:\n  ports: 80\n"},
+		{name: "invalid List item", input: "kind: List\nitems:\n- kind: Service\n  metadata: name\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := readServices(strings.NewReader(tt.input)); err == nil {
+				t.Errorf("readServices() error = nil, want an error")
+			}
+		})
+	}
+}
+
+func TestRunPlan(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := runPlan([]string{"-f", filepath.Join("testdata", "services.yaml"), "--services"}, nil, &stdout, &stderr); code != 0 {
+		t.Fatalf("runPlan() = %d, stderr:\n%s", code, stderr.String())
+	}
+
+	golden := filepath.Join("testdata", "plan.golden")
+	if *update {
+		if err := os.WriteFile(golden, stdout.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != string(want) {
+		t.Errorf("runPlan() output differs from %s, rerun with -update to see the change:\n%s", golden, stdout.String())
+	}
+}
+
+func TestRunPlanErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		stdin  string
+		code   int
+		stderr string
+	}{
+		{
+			name:   "unknown flag",
+			args:   []string{"--unknown"},
+			code:   2,
+			stderr: "flag provided but not defined",
+		},
+		{
+			name:   "missing file",
+			args:   []string{"-f", filepath.Join("testdata", "missing.yaml")},
+			code:   1,
+			stderr: "missing.yaml",
+		},
+		{
+			name:   "invalid manifest",
+			stdin:  "kind: Service\nmetadata: [\n",
+			code:   1,
+			stderr: "failed to read -",
+		},
+		{
+			name: "ServiceMonitor name conflict",
+			args: []string{"-f", "-"},
+			stdin: `apiVersion: v1
+kind: Service
+metadata:
+  name: api
+  namespace: demo
+  labels:
+    app: api
+spec:
+  ports:
+  - name: http
+    port: 8080
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: api
+  namespace: demo
+  labels:
+    app: api
+spec:
+  ports:
+  - name: http
+    port: 8080
+`,
+			code:   1,
+			stderr: "is already generated for Service demo/api",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if code := runPlan(tt.args, strings.NewReader(tt.stdin), &stdout, &stderr); code != tt.code {
+				t.Errorf("runPlan() = %d, want %d, stderr:\n%s", code, tt.code, stderr.String())
+			}
+			if !strings.Contains(stderr.String(), tt.stderr) {
+				t.Errorf("stderr = %q, want it to contain %q", stderr.String(), tt.stderr)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// ServiceMonitor在manager缓存中的索引，用于找到可能选中某个Service的ServiceMonitor
+const (
+	// serviceMonitorNamespaceIndex ServiceMonitor选择的命名空间
+	serviceMonitorNamespaceIndex = "spec.namespaceSelector"
+	// serviceMonitorSelectorIndex ServiceMonitor标签选择器中的matchLabels，格式为key=value
+	serviceMonitorSelectorIndex = "spec.selector"
+	// indexAll 选择所有命名空间（namespaceSelector.any），或没有matchLabels的ServiceMonitor的索引值
+	indexAll = "*"
+)
+
+// serviceMonitorNamespaces 返回ServiceMonitor选择的命名空间。与Prometheus Operator一致，
+// namespaceSelector为空时只选择ServiceMonitor所在的命名空间
+func serviceMonitorNamespaces(obj client.Object) []string {
+	sm := obj.(*monitoringv1.ServiceMonitor)
+	switch {
+	case sm.Spec.NamespaceSelector.Any:
+		return []string{indexAll}
+	case len(sm.Spec.NamespaceSelector.MatchNames) > 0:
+		return sm.Spec.NamespaceSelector.MatchNames
+	}
+	return []string{sm.Namespace}
+}
+
+// serviceMonitorSelectorKeys 返回ServiceMonitor标签选择器中的matchLabels，
+// 只有matchExpressions或为空的选择器使用indexAll
+func serviceMonitorSelectorKeys(obj client.Object) []string {
+	sm := obj.(*monitoringv1.ServiceMonitor)
+	if len(sm.Spec.Selector.MatchLabels) == 0 {
+		return []string{indexAll}
+	}
+	keys := make([]string, 0, len(sm.Spec.Selector.MatchLabels))
+	for k, v := range sm.Spec.Selector.MatchLabels {
+		keys = append(keys, k+"="+v)
+	}
+	return keys
+}
+
+// indexServiceMonitors 在manager缓存中注册ServiceMonitor的索引，需要在manager启动前调用
+func indexServiceMonitors(ctx context.Context, indexer client.FieldIndexer) error {
+	if err := indexer.IndexField(ctx, &monitoringv1.ServiceMonitor{}, serviceMonitorNamespaceIndex, serviceMonitorNamespaces); err != nil {
+		return err
+	}
+	return indexer.IndexField(ctx, &monitoringv1.ServiceMonitor{}, serviceMonitorSelectorIndex, serviceMonitorSelectorKeys)
+}
+
+// externalServiceMonitors 通过索引找到选中该Service的、不是由控制器生成的ServiceMonitor。
+// 早期版本生成的、没有归属标签的ServiceMonitor会被迁移，不作为手动维护的ServiceMonitor
+func (r *ServiceReconciler) externalServiceMonitors(ctx context.Context, service *corev1.Service) ([]*monitoringv1.ServiceMonitor, error) {
+	selectorKeys := []string{indexAll}
+	for k, v := range service.Labels {
+		selectorKeys = append(selectorKeys, k+"="+v)
+	}
+
+	found := map[types.NamespacedName]*monitoringv1.ServiceMonitor{}
+	for _, namespace := range []string{service.Namespace, indexAll} {
+		for _, selectorKey := range selectorKeys {
+			smList := &monitoringv1.ServiceMonitorList{}
+			if err := r.List(ctx, smList, client.MatchingFieldsSelector{Selector: fields.SelectorFromSet(fields.Set{
+				serviceMonitorNamespaceIndex: namespace,
+				serviceMonitorSelectorIndex:  selectorKey,
+			})}); err != nil {
+				return nil, fmt.Errorf("failed to list ServiceMonitors: %v", err)
+			}
+			for _, sm := range smList.Items {
+				found[client.ObjectKeyFromObject(sm)] = sm
+			}
+		}
+	}
+
+	external := make([]*monitoringv1.ServiceMonitor, 0, len(found))
+	for _, sm := range found {
+		if _, ok := sm.Labels[managedByLabel]; ok || isLegacyServiceMonitor(sm, service) {
+			continue
+		}
+		// 索引只匹配了一个标签，需要完整地检查标签选择器
+		if !r.selectorMatchesService(&sm.Spec.Selector, service.Labels) {
+			continue
+		}
+		external = append(external, sm)
+	}
+	sort.Slice(external, func(i, j int) bool {
+		return client.ObjectKeyFromObject(external[i]).String() < client.ObjectKeyFromObject(external[j]).String()
+	})
+	return external, nil
+}
+
+// coveredPorts 返回ServiceMonitor的Endpoint拉取的Service端口名称，按端口名称或targetPort匹配
+func coveredPorts(sm *monitoringv1.ServiceMonitor, service *corev1.Service) []string {
+	var covered []string
+	for _, port := range service.Spec.Ports {
+		for _, ep := range sm.Spec.Endpoints {
+			byName := ep.Port != "" && ep.Port == port.Name
+			byTargetPort := ep.Port == "" && ep.TargetPort != nil && targetPortMatches(*ep.TargetPort, port)
+			if byName || byTargetPort {
+				covered = append(covered, port.Name)
+				break
+			}
+		}
+	}
+	return covered
+}
+
+// targetPortMatches 判断Endpoint的targetPort是否指向该Service端口
+func targetPortMatches(targetPort intstr.IntOrString, port corev1.ServicePort) bool {
+	if port.TargetPort.Type == intstr.Int && port.TargetPort.IntVal == 0 {
+		// 未设置targetPort时与port相同
+		return targetPort.Type == intstr.Int && targetPort.IntVal == port.Port
+	}
+	return targetPort == port.TargetPort
+}
+
+// withoutPorts 返回ports中名称不在names中的端口
+func withoutPorts(ports []corev1.ServicePort, names []string) []corev1.ServicePort {
+	var remaining []corev1.ServicePort
+	for _, port := range ports {
+		if !contains(names, port.Name) {
+			remaining = append(remaining, port)
+		}
+	}
+	return remaining
+}
+
+// serviceMonitorToServices 将ServiceMonitor的变化映射为reconcile请求：生成的ServiceMonitor映射到生成它的Service，
+// 使被手动修改或删除的ServiceMonitor可以自动恢复；手动维护的ServiceMonitor映射到它选中的Service，
+// 以便这些Service停止或恢复生成ServiceMonitor
+func (r *ServiceReconciler) serviceMonitorToServices(ctx context.Context, obj client.Object) []reconcile.Request {
+	sm, ok := obj.(*monitoringv1.ServiceMonitor)
+	if !ok {
+		return nil
+	}
+	if owner, ok := ownerOf(sm); ok {
+		return []reconcile.Request{{NamespacedName: owner}}
+	}
+	if _, ok := sm.Labels[managedByLabel]; ok {
+		return nil
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(&sm.Spec.Selector)
+	if err != nil {
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, namespace := range serviceMonitorNamespaces(sm) {
+		opts := []client.ListOption{client.MatchingLabelsSelector{Selector: selector}}
+		if namespace != indexAll {
+			opts = append(opts, client.InNamespace(namespace))
+		}
+		services := &corev1.ServiceList{}
+		if err := r.List(ctx, services, opts...); err != nil {
+			log.Log.Error(err, "failed to list Services selected by ServiceMonitor", "ServiceMonitor", sm.Namespace+"/"+sm.Name)
+			return nil
+		}
+		for i := range services.Items {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&services.Items[i])})
+		}
+	}
+	return requests
+}
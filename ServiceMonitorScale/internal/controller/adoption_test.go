@@ -0,0 +1,138 @@
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+var _ = Describe("hand-written ServiceMonitors", func() {
+	var service *corev1.Service
+
+	newServiceMonitor := func(namespace, name string, spec monitoringv1.ServiceMonitorSpec) *monitoringv1.ServiceMonitor {
+		return &monitoringv1.ServiceMonitor{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}, Spec: spec}
+	}
+
+	BeforeEach(func() {
+		service = &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "demo", Labels: map[string]string{"app": "api", "tier": "web"}},
+			Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{
+				{Name: "http", Port: 8080},
+				{Name: "metrics", Port: 9090, TargetPort: intstr.FromString("prom")},
+			}},
+		}
+	})
+
+	It("indexes the namespaces and labels a ServiceMonitor selects", func() {
+		sm := newServiceMonitor("monitoring", "custom", monitoringv1.ServiceMonitorSpec{})
+		Expect(serviceMonitorNamespaces(sm)).To(Equal([]string{"monitoring"}))
+		Expect(serviceMonitorSelectorKeys(sm)).To(Equal([]string{indexAll}))
+
+		sm.Spec.NamespaceSelector.MatchNames = []string{"demo", "prod"}
+		sm.Spec.Selector.MatchLabels = map[string]string{"app": "api"}
+		Expect(serviceMonitorNamespaces(sm)).To(Equal([]string{"demo", "prod"}))
+		Expect(serviceMonitorSelectorKeys(sm)).To(Equal([]string{"app=api"}))
+
+		sm.Spec.NamespaceSelector.Any = true
+		Expect(serviceMonitorNamespaces(sm)).To(Equal([]string{indexAll}))
+	})
+
+	It("matches endpoints by port name or targetPort", func() {
+		sm := newServiceMonitor("demo", "custom", monitoringv1.ServiceMonitorSpec{Endpoints: []monitoringv1.Endpoint{
+			{Port: "http"},
+		}})
+		Expect(coveredPorts(sm, service)).To(Equal([]string{"http"}))
+
+		prom := intstr.FromString("prom")
+		sm.Spec.Endpoints = []monitoringv1.Endpoint{{TargetPort: &prom}}
+		Expect(coveredPorts(sm, service)).To(Equal([]string{"metrics"}))
+
+		port := intstr.FromInt32(8080)
+		sm.Spec.Endpoints = []monitoringv1.Endpoint{{TargetPort: &port}}
+		Expect(coveredPorts(sm, service)).To(Equal([]string{"http"}))
+
+		remaining := withoutPorts(service.Spec.Ports, []string{"http"})
+		Expect(remaining).To(HaveLen(1))
+		Expect(remaining[0].Name).To(Equal("metrics"))
+	})
+
+	It("finds hand-written ServiceMonitors selecting the Service", func() {
+		scheme := runtime.NewScheme()
+		Expect(monitoringv1.AddToScheme(scheme)).To(Succeed())
+		selectsAPI := metav1.LabelSelector{MatchLabels: map[string]string{"app": "api"}}
+		c := fake.NewClientBuilder().WithScheme(scheme).
+			WithIndex(&monitoringv1.ServiceMonitor{}, serviceMonitorNamespaceIndex, serviceMonitorNamespaces).
+			WithIndex(&monitoringv1.ServiceMonitor{}, serviceMonitorSelectorIndex, serviceMonitorSelectorKeys).
+			WithObjects(
+				newServiceMonitor("demo", "same-namespace", monitoringv1.ServiceMonitorSpec{Selector: selectsAPI}),
+				newServiceMonitor("monitoring", "any-namespace", monitoringv1.ServiceMonitorSpec{
+					Selector:          metav1.LabelSelector{MatchLabels: map[string]string{"tier": "web"}},
+					NamespaceSelector: monitoringv1.NamespaceSelector{Any: true},
+				}),
+				newServiceMonitor("monitoring", "other-namespace", monitoringv1.ServiceMonitorSpec{Selector: selectsAPI}),
+				newServiceMonitor("demo", "partial-match", monitoringv1.ServiceMonitorSpec{
+					Selector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "api", "tier": "db"}},
+				}),
+				&monitoringv1.ServiceMonitor{
+					ObjectMeta: metav1.ObjectMeta{Name: "generated", Namespace: "demo", Labels: map[string]string{managedByLabel: managedByValue}},
+					Spec:       monitoringv1.ServiceMonitorSpec{Selector: selectsAPI},
+				},
+			).Build()
+		r := &ServiceReconciler{Client: c}
+
+		external, err := r.externalServiceMonitors(context.Background(), service)
+		Expect(err).NotTo(HaveOccurred())
+		names := make([]string, 0, len(external))
+		for _, sm := range external {
+			names = append(names, sm.Namespace+"/"+sm.Name)
+		}
+		Expect(names).To(Equal([]string{"demo/same-namespace", "monitoring/any-namespace"}))
+	})
+
+	It("maps ServiceMonitor changes to the Services to reconcile", func() {
+		scheme := runtime.NewScheme()
+		Expect(corev1.AddToScheme(scheme)).To(Succeed())
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			service,
+			&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "prod", Labels: map[string]string{"app": "api"}}},
+			&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "demo", Labels: map[string]string{"app": "web"}}},
+		).Build()
+		r := &ServiceReconciler{Client: c}
+		ctx := context.Background()
+
+		generated := newServiceMonitor("monitoring", "demo-api", monitoringv1.ServiceMonitorSpec{})
+		generated.Labels = ownerLabels(types.NamespacedName{Namespace: "demo", Name: "api"})
+		Expect(r.serviceMonitorToServices(ctx, generated)).To(Equal([]reconcile.Request{
+			{NamespacedName: types.NamespacedName{Namespace: "demo", Name: "api"}},
+		}))
+
+		// 标签不完整的生成的ServiceMonitor不对应任何Service
+		generated.Labels = map[string]string{managedByLabel: managedByValue}
+		Expect(r.serviceMonitorToServices(ctx, generated)).To(BeEmpty())
+
+		handWritten := newServiceMonitor("monitoring", "custom", monitoringv1.ServiceMonitorSpec{
+			Selector:          metav1.LabelSelector{MatchLabels: map[string]string{"app": "api"}},
+			NamespaceSelector: monitoringv1.NamespaceSelector{MatchNames: []string{"demo"}},
+		})
+		Expect(r.serviceMonitorToServices(ctx, handWritten)).To(Equal([]reconcile.Request{
+			{NamespacedName: types.NamespacedName{Namespace: "demo", Name: "api"}},
+		}))
+
+		handWritten.Spec.NamespaceSelector = monitoringv1.NamespaceSelector{Any: true}
+		Expect(r.serviceMonitorToServices(ctx, handWritten)).To(ConsistOf(
+			reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "demo", Name: "api"}},
+			reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "prod", Name: "api"}},
+		))
+	})
+})
@@ -0,0 +1,317 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// AlertOptions 为每个生成的ServiceMonitor生成PrometheusRule的配置
+//
+//	alerts:
+//	  enabled: true
+//	  severityLabel: alerting.tal.com/severity
+//	  routingLabels: [team]
+//	  rules:
+//	  - alert: TargetDown
+//	    expr: "up{{ .Selector }} == 0"
+//	    for: 5m
+//	    labels:
+//	      severity: critical
+type AlertOptions struct {
+	// Enabled 为true时生成PrometheusRule，集群中需要安装PrometheusRule CRD
+	Enabled bool `json:"enabled,omitempty"`
+	// SeverityLabel Service上该标签的值覆盖告警的severity标签
+	SeverityLabel string `json:"severityLabel,omitempty"`
+	// RoutingLabels 从Service标签复制到告警上的标签，用于Alertmanager路由
+	RoutingLabels []string `json:"routingLabels,omitempty"`
+	// Rules 告警规则模板，未设置时使用defaultAlertRules
+	Rules []AlertRuleTemplate `json:"rules,omitempty"`
+}
+
+// AlertRuleTemplate 告警规则模板。除alert外的字段都是Go模板，可以使用.Namespace、.Name、.App、.Labels，
+// 以及.Selector（选择该Service的target的PromQL标签匹配器，例如{namespace="demo",service="api"}）。
+// Prometheus自身的模板需要转义，例如 '{{ "{{ $labels.instance }}" }}'
+type AlertRuleTemplate struct {
+	Alert       string            `json:"alert"`
+	Expr        string            `json:"expr"`
+	For         string            `json:"for,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// defaultAlertRules 默认的告警规则。拉取耗时和sample limit的告警依赖Prometheus的
+// --enable-feature=extra-scrape-metrics，没有开启时不会触发
+var defaultAlertRules = []AlertRuleTemplate{
+	{
+		Alert:  "TargetDown",
+		Expr:   "up{{ .Selector }} == 0",
+		For:    "5m",
+		Labels: map[string]string{"severity": "critical"},
+		Annotations: map[string]string{
+			"summary": "Metrics target of Service {{ .Namespace }}/{{ .Name }} is down.",
+		},
+	},
+	{
+		Alert:  "ScrapeDurationHigh",
+		Expr:   "avg_over_time(scrape_duration_seconds{{ .Selector }}[5m]) > 0.8 * scrape_timeout_seconds{{ .Selector }}",
+		For:    "15m",
+		Labels: map[string]string{"severity": "warning"},
+		Annotations: map[string]string{
+			"summary": "Scraping Service {{ .Namespace }}/{{ .Name }} takes more than 80% of the scrape timeout.",
+		},
+	},
+	{
+		Alert:  "SampleLimitExceeded",
+		Expr:   "scrape_samples_post_metric_relabeling{{ .Selector }} / (scrape_sample_limit{{ .Selector }} > 0) >= 1",
+		For:    "5m",
+		Labels: map[string]string{"severity": "warning"},
+		Annotations: map[string]string{
+			"summary": "Service {{ .Namespace }}/{{ .Name }} exposes more samples than the sample limit, scrapes fail.",
+		},
+	},
+}
+
+// alertRules 返回配置的告警规则模板，未配置时为默认规则
+func (a AlertOptions) alertRules() []AlertRuleTemplate {
+	if len(a.Rules) == 0 {
+		return defaultAlertRules
+	}
+	return a.Rules
+}
+
+// validateAlerts 校验告警规则模板
+func (o Options) validateAlerts() error {
+	if !o.Alerts.Enabled {
+		return nil
+	}
+	for i, rule := range o.Alerts.alertRules() {
+		if rule.Alert == "" || rule.Expr == "" {
+			return fmt.Errorf("invalid alerts.rules[%d]: alert and expr must not be empty", i)
+		}
+		texts := []string{rule.Expr, rule.For}
+		for _, m := range []map[string]string{rule.Labels, rule.Annotations} {
+			for _, v := range m {
+				texts = append(texts, v)
+			}
+		}
+		for _, text := range texts {
+			if _, err := template.New("alert").Parse(text); err != nil {
+				return fmt.Errorf("invalid alerts.rules[%d] %s: %v", i, rule.Alert, err)
+			}
+		}
+	}
+	return nil
+}
+
+// alertData 告警规则模板可以使用的数据
+type alertData struct {
+	Namespace string
+	Name      string
+	App       string
+	Labels    map[string]string
+	Selector  string
+}
+
+// desiredPrometheusRule 构建与ServiceMonitor同名、同标签的PrometheusRule，只包含控制器负责的字段
+func (o Options) desiredPrometheusRule(service *corev1.Service, sm *monitoringv1.ServiceMonitor) (*monitoringv1.PrometheusRule, error) {
+	data := alertData{
+		Namespace: service.Namespace,
+		Name:      service.Name,
+		App:       service.Labels["app"],
+		Labels:    service.Labels,
+		Selector:  fmt.Sprintf("{namespace=%q,service=%q}", service.Namespace, service.Name),
+	}
+
+	// 告警上的路由标签和severity来自Service的标签
+	serviceLabels := map[string]string{}
+	for _, label := range o.Alerts.RoutingLabels {
+		if v := service.Labels[label]; v != "" {
+			serviceLabels[label] = v
+		}
+	}
+	if v := service.Labels[o.Alerts.SeverityLabel]; o.Alerts.SeverityLabel != "" && v != "" {
+		serviceLabels["severity"] = v
+	}
+
+	rules := make([]monitoringv1.Rule, 0, len(o.Alerts.alertRules()))
+	for _, t := range o.Alerts.alertRules() {
+		rule := monitoringv1.Rule{Alert: t.Alert}
+		expr, err := renderTemplate(t.Expr, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render alert %s: %v", t.Alert, err)
+		}
+		rule.Expr = intstr.FromString(expr)
+		if t.For != "" {
+			forDuration, err := renderTemplate(t.For, data)
+			if err != nil {
+				return nil, fmt.Errorf("failed to render alert %s: %v", t.Alert, err)
+			}
+			rule.For = (*monitoringv1.Duration)(&forDuration)
+		}
+		if rule.Labels, err = renderAlertMap(t.Labels, data); err != nil {
+			return nil, fmt.Errorf("failed to render alert %s: %v", t.Alert, err)
+		}
+		for k, v := range serviceLabels {
+			if rule.Labels == nil {
+				rule.Labels = map[string]string{}
+			}
+			rule.Labels[k] = v
+		}
+		if rule.Annotations, err = renderAlertMap(t.Annotations, data); err != nil {
+			return nil, fmt.Errorf("failed to render alert %s: %v", t.Alert, err)
+		}
+		rules = append(rules, rule)
+	}
+
+	ruleLabels := make(map[string]string, len(sm.Labels))
+	for k, v := range sm.Labels {
+		ruleLabels[k] = v
+	}
+	return &monitoringv1.PrometheusRule{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       monitoringv1.PrometheusRuleKind,
+			APIVersion: monitoringv1.SchemeGroupVersion.String(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      sm.Name,
+			Namespace: sm.Namespace,
+			Labels:    ruleLabels,
+		},
+		Spec: monitoringv1.PrometheusRuleSpec{
+			Groups: []monitoringv1.RuleGroup{{Name: sm.Name, Rules: rules}},
+		},
+	}, nil
+}
+
+// renderAlertMap 渲染告警的标签或注解，渲染结果为空的项被忽略
+func renderAlertMap(m map[string]string, data interface{}) (map[string]string, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	rendered := make(map[string]string, len(m))
+	for k, v := range m {
+		text, err := renderTemplate(v, data)
+		if err != nil {
+			return nil, err
+		}
+		if text = strings.TrimSpace(text); text != "" {
+			rendered[k] = text
+		}
+	}
+	return rendered, nil
+}
+
+// applyPrometheusRule 为生成的ServiceMonitor写入同名的PrometheusRule，并删除该Service以其他名称生成的PrometheusRule。
+// 同名的PrometheusRule不是由该Service生成时不接管
+func (r *ServiceReconciler) applyPrometheusRule(ctx context.Context, service *corev1.Service, sm *monitoringv1.ServiceMonitor) error {
+	if !r.Options.Alerts.Enabled {
+		return nil
+	}
+	owner := client.ObjectKeyFromObject(service)
+	rule, err := r.Options.desiredPrometheusRule(service, sm)
+	if err != nil {
+		return err
+	}
+
+	existing := &monitoringv1.PrometheusRule{}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(rule), existing); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if existing.ResourceVersion != "" {
+		if o, ok := ownerOf(existing); !ok || o != owner {
+			log.Log.WithValues("PrometheusRule", rule.Namespace+"/"+rule.Name).Info("PrometheusRule exists and is not generated for this Service, skip")
+			r.Recorder.Eventf(service, corev1.EventTypeWarning, reasonMonitorConflict, "PrometheusRule %s/%s exists and is not generated for this Service", rule.Namespace, rule.Name)
+			return nil
+		}
+	}
+	if err := r.Patch(ctx, rule, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership); err != nil {
+		return fmt.Errorf("failed to apply PrometheusRule %s/%s: %v", rule.Namespace, rule.Name, err)
+	}
+	if r.DryRun != nil {
+		r.DryRun.planObject(monitoringv1.PrometheusRuleKind, client.ObjectKeyFromObject(rule), owner.String(), existing.ResourceVersion == "",
+			managedMonitorFields{Labels: existing.Labels, Spec: existing.Spec},
+			managedMonitorFields{Labels: rule.Labels, Spec: rule.Spec})
+	} else if rule.ResourceVersion != existing.ResourceVersion {
+		log.Log.WithValues("Service", owner.String(), "PrometheusRule", rule.Namespace+"/"+rule.Name).Info("PrometheusRule applied")
+	}
+	return r.deletePrometheusRules(ctx, owner, rule.Name)
+}
+
+// deletePrometheusRules 删除由该Service生成的、名称不是keep的PrometheusRule，keep为空时全部删除。
+// 没有开启告警时不访问PrometheusRule，集群中可以没有该CRD
+func (r *ServiceReconciler) deletePrometheusRules(ctx context.Context, service types.NamespacedName, keep string) error {
+	if !r.Options.Alerts.Enabled {
+		return nil
+	}
+	ruleList := &monitoringv1.PrometheusRuleList{}
+	if err := r.List(ctx, ruleList, client.MatchingLabels(ownerLabels(service))); err != nil {
+		return err
+	}
+	for _, rule := range ruleList.Items {
+		if rule.Name == keep {
+			continue
+		}
+		if err := r.Delete(ctx, rule); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		if r.DryRun != nil {
+			r.DryRun.planDelete(monitoringv1.PrometheusRuleKind, client.ObjectKeyFromObject(rule), service.String())
+			continue
+		}
+		log.Log.WithValues("Service", service.String(), "PrometheusRule", rule.Namespace+"/"+rule.Name).Info("PrometheusRule deleted")
+	}
+	return nil
+}
+
+// collectOrphanPrometheusRules 删除Service已经不存在或所在命名空间不再被选中的PrometheusRule
+func (r *ServiceReconciler) collectOrphanPrometheusRules(ctx context.Context) {
+	if !r.Options.Alerts.Enabled {
+		return
+	}
+	ruleList := &monitoringv1.PrometheusRuleList{}
+	if err := r.List(ctx, ruleList, client.MatchingLabels{managedByLabel: managedByValue}); err != nil {
+		log.Log.Error(err, "failed to list PrometheusRules for garbage collection")
+		return
+	}
+	owners := map[types.NamespacedName]bool{}
+	for _, rule := range ruleList.Items {
+		if owner, ok := ownerOf(rule); ok {
+			owners[owner] = true
+		}
+	}
+	keys := make([]types.NamespacedName, 0, len(owners))
+	for owner := range owners {
+		keys = append(keys, owner)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	for _, owner := range keys {
+		if !r.serviceGone(ctx, owner) {
+			continue
+		}
+		if err := r.deletePrometheusRules(ctx, owner, ""); err != nil {
+			log.Log.Error(err, "failed to delete orphan PrometheusRule", "Service", owner.String())
+		}
+	}
+}
+
+// prometheusRuleToService 生成的PrometheusRule被修改或删除时重新处理生成它的Service
+func prometheusRuleToService(_ context.Context, obj client.Object) []reconcile.Request {
+	if owner, ok := ownerOf(obj); ok {
+		return []reconcile.Request{{NamespacedName: owner}}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("PrometheusRule alerts", func() {
+	var (
+		opts    Options
+		service *corev1.Service
+	)
+
+	BeforeEach(func() {
+		opts = DefaultOptions()
+		opts.Alerts = AlertOptions{
+			Enabled:       true,
+			SeverityLabel: "alerting.tal.com/severity",
+			RoutingLabels: []string{"team", "oncall"},
+		}
+		service = &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "api",
+				Namespace: "demo",
+				Labels:    map[string]string{"app": "api", "team": "payments", "alerting.tal.com/severity": "page"},
+			},
+			Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "http", Port: 8080}}},
+		}
+	})
+
+	It("generates the default alerts next to the ServiceMonitor", func() {
+		Expect(opts.Validate()).To(Succeed())
+		plan, err := opts.PlanService(service)
+		Expect(err).NotTo(HaveOccurred())
+
+		rule := plan.PrometheusRule
+		Expect(rule).NotTo(BeNil())
+		Expect(rule.Name).To(Equal(plan.ServiceMonitor.Name))
+		Expect(rule.Namespace).To(Equal(plan.ServiceMonitor.Namespace))
+		Expect(rule.Labels).To(Equal(plan.ServiceMonitor.Labels))
+
+		Expect(rule.Spec.Groups).To(HaveLen(1))
+		rules := rule.Spec.Groups[0].Rules
+		Expect(rules).To(HaveLen(len(defaultAlertRules)))
+		Expect(rules[0].Alert).To(Equal("TargetDown"))
+		Expect(rules[0].Expr.String()).To(Equal(`up{namespace="demo",service="api"} == 0`))
+		Expect(string(*rules[0].For)).To(Equal("5m"))
+		Expect(rules[0].Labels).To(Equal(map[string]string{"severity": "page", "team": "payments"}))
+		Expect(rules[0].Annotations["summary"]).To(ContainSubstring("demo/api"))
+	})
+
+	It("renders custom rule templates and drops empty labels", func() {
+		opts.Alerts.SeverityLabel = ""
+		opts.Alerts.Rules = []AlertRuleTemplate{{
+			Alert:  "TooManyErrors",
+			Expr:   `rate(http_errors_total{{ .Selector }}[5m]) > 1`,
+			Labels: map[string]string{"severity": "warning", "owner": `{{ index .Labels "owner" }}`},
+		}}
+		Expect(opts.Validate()).To(Succeed())
+		plan, err := opts.PlanService(service)
+		Expect(err).NotTo(HaveOccurred())
+
+		rules := plan.PrometheusRule.Spec.Groups[0].Rules
+		Expect(rules).To(HaveLen(1))
+		Expect(rules[0].Expr.String()).To(Equal(`rate(http_errors_total{namespace="demo",service="api"}[5m]) > 1`))
+		Expect(rules[0].For).To(BeNil())
+		Expect(rules[0].Labels).To(Equal(map[string]string{"severity": "warning", "team": "payments"}))
+	})
+
+	It("does not generate PrometheusRules unless enabled", func() {
+		opts.Alerts.Enabled = false
+		plan, err := opts.PlanService(service)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(plan.PrometheusRule).To(BeNil())
+	})
+
+	It("rejects invalid rule templates", func() {
+		opts.Alerts.Rules = []AlertRuleTemplate{{Alert: "Broken", Expr: "up{{ .Selector"}}
+		Expect(opts.Validate()).NotTo(Succeed())
+
+		opts.Alerts.Rules = []AlertRuleTemplate{{Alert: "NoExpr"}}
+		Expect(opts.Validate()).NotTo(Succeed())
+	})
+})
@@ -0,0 +1,300 @@
+package controller
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus/common/model"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Service上用于控制ServiceMonitor生成的注解，未设置的字段使用默认值
+//
+//	servicemonitorscale.tal.com/scrape:         "true"/"false"，为false时不生成ServiceMonitor
+//	servicemonitorscale.tal.com/ports:          逗号分隔的端口名称，默认为Service的所有TCP端口
+//	servicemonitorscale.tal.com/path:           metrics路径，默认为/metrics
+//	servicemonitorscale.tal.com/interval:       拉取间隔，默认为Interval环境变量或15s
+//	servicemonitorscale.tal.com/scrape-timeout: 拉取超时，不能大于interval
+//	servicemonitorscale.tal.com/scheme:         http或https，默认为http
+//	servicemonitorscale.tal.com/honor-labels:   "true"/"false"，默认为false
+const (
+	annotationPrefix        = "servicemonitorscale.tal.com/"
+	scrapeAnnotation        = annotationPrefix + "scrape"
+	portsAnnotation         = annotationPrefix + "ports"
+	pathAnnotation          = annotationPrefix + "path"
+	intervalAnnotation      = annotationPrefix + "interval"
+	scrapeTimeoutAnnotation = annotationPrefix + "scrape-timeout"
+	schemeAnnotation        = annotationPrefix + "scheme"
+	honorLabelsAnnotation   = annotationPrefix + "honor-labels"
+)
+
+// Prometheus kubernetes-service-endpoints示例配置使用的旧注解，只在没有设置对应的新注解时生效
+//
+//	prometheus.io/scrape: "true"/"false"，对应scrape
+//	prometheus.io/port:   要拉取的端口号，匹配Service端口的port或targetPort，对应ports
+//	prometheus.io/path:   对应path
+//	prometheus.io/scheme: 对应scheme
+const (
+	legacyAnnotationPrefix = "prometheus.io/"
+	legacyScrapeAnnotation = legacyAnnotationPrefix + "scrape"
+	legacyPortAnnotation   = legacyAnnotationPrefix + "port"
+	legacyPathAnnotation   = legacyAnnotationPrefix + "path"
+	legacySchemeAnnotation = legacyAnnotationPrefix + "scheme"
+)
+
+const (
+	defaultMetricsPath = "/metrics"
+	defaultInterval    = "15s"
+	defaultScheme      = "http"
+)
+
+// scrapeConfig 从Service注解解析出的拉取配置
+type scrapeConfig struct {
+	Enabled bool
+	// OptedIn 表示scrape注解被显式设置为true
+	OptedIn       bool
+	Ports         []string
+	Path          string
+	Interval      monitoringv1.Duration
+	ScrapeTimeout monitoringv1.Duration
+	Scheme        string
+	HonorLabels   bool
+	// Auth TLS和鉴权配置，没有设置相关注解时为nil
+	Auth *authConfig
+}
+
+// defaultScrapeConfig 返回未配置注解时的拉取配置
+func defaultScrapeConfig() *scrapeConfig {
+	interval := os.Getenv("Interval")
+	if interval == "" {
+		interval = defaultInterval
+	}
+	return &scrapeConfig{
+		Enabled:  true,
+		Path:     defaultMetricsPath,
+		Interval: monitoringv1.Duration(interval),
+	}
+}
+
+// parseScrapeConfig 解析并校验Service上的注解。非法的注解会被忽略并使用默认值，
+// 对应的错误一并返回，由调用方以Event的形式报告到Service上。legacy为true时同时识别prometheus.io/*注解
+func parseScrapeConfig(service *corev1.Service, legacy bool) (*scrapeConfig, []error) {
+	portNames := make([]string, 0, len(service.Spec.Ports))
+	for _, port := range service.Spec.Ports {
+		portNames = append(portNames, port.Name)
+	}
+	annotations := service.Annotations
+	var errs []error
+	if legacy {
+		annotations, errs = translateLegacyAnnotations(service)
+	}
+	cfg, parseErrs := parseScrapeAnnotations(annotations, "Service", portNames)
+	errs = append(errs, parseErrs...)
+
+	errs = append(errs, cfg.parseAuth(annotations, authSecretName(types.NamespacedName{Namespace: service.Namespace, Name: service.Name}))...)
+	return cfg, errs
+}
+
+// parseAuth 解析TLS和鉴权注解并写入拉取配置，secretName为复制引用内容的Secret名称
+func (c *scrapeConfig) parseAuth(annotations map[string]string, secretName string) []error {
+	auth, errs := parseAuthAnnotations(annotations)
+	if auth != nil {
+		auth.SecretName = secretName
+		// 配置了TLS但没有指定scheme时使用https
+		if _, ok := annotations[schemeAnnotation]; !ok && auth.tls() {
+			c.Scheme = "https"
+		}
+		c.Auth = auth
+	}
+	return errs
+}
+
+// translateLegacyAnnotations 把prometheus.io/*注解转换为对应的新注解，已设置的新注解优先。
+// prometheus.io/port是端口号，转换为port或targetPort与之相同的Service端口的名称
+func translateLegacyAnnotations(service *corev1.Service) (map[string]string, []error) {
+	annotations := make(map[string]string, len(service.Annotations))
+	for k, v := range service.Annotations {
+		annotations[k] = v
+	}
+	var errs []error
+	translate := func(legacy, current string) {
+		if v, ok := service.Annotations[legacy]; ok {
+			if _, set := service.Annotations[current]; !set {
+				annotations[current] = v
+			}
+		}
+	}
+	translate(legacyScrapeAnnotation, scrapeAnnotation)
+	translate(legacyPathAnnotation, pathAnnotation)
+	translate(legacySchemeAnnotation, schemeAnnotation)
+
+	v, ok := service.Annotations[legacyPortAnnotation]
+	if _, set := service.Annotations[portsAnnotation]; !ok || set {
+		return annotations, errs
+	}
+	number, err := strconv.ParseInt(v, 10, 32)
+	if err != nil {
+		return annotations, append(errs, fmt.Errorf("invalid %s %q: must be a port number", legacyPortAnnotation, v))
+	}
+	for _, port := range service.Spec.Ports {
+		if port.Port != int32(number) && !(port.TargetPort.Type == intstr.Int && port.TargetPort.IntVal == int32(number)) {
+			continue
+		}
+		// 未命名的端口只会出现在单端口的Service上，默认就会选中这个端口
+		if port.Name != "" {
+			annotations[portsAnnotation] = port.Name
+		}
+		return annotations, errs
+	}
+	return annotations, append(errs, fmt.Errorf("invalid %s %q: Service has no port or targetPort %d", legacyPortAnnotation, v, number))
+}
+
+// parseScrapeAnnotations 解析并校验拉取配置注解，kind和portNames用于校验ports注解
+func parseScrapeAnnotations(annotations map[string]string, kind string, portNames []string) (*scrapeConfig, []error) {
+	cfg := defaultScrapeConfig()
+	var errs []error
+
+	if v, ok := annotations[scrapeAnnotation]; ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s %q: %v", scrapeAnnotation, v, err))
+		} else {
+			cfg.Enabled = enabled
+			cfg.OptedIn = enabled
+		}
+	}
+
+	if v, ok := annotations[portsAnnotation]; ok {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if !contains(portNames, name) {
+				errs = append(errs, fmt.Errorf("invalid %s: %s has no port named %q", portsAnnotation, kind, name))
+				continue
+			}
+			cfg.Ports = append(cfg.Ports, name)
+		}
+	}
+
+	if v, ok := annotations[pathAnnotation]; ok {
+		if !strings.HasPrefix(v, "/") {
+			errs = append(errs, fmt.Errorf("invalid %s %q: must start with /", pathAnnotation, v))
+		} else {
+			cfg.Path = v
+		}
+	}
+
+	interval, err := model.ParseDuration(string(cfg.Interval))
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid Interval env %q: %v", cfg.Interval, err))
+		cfg.Interval = defaultInterval
+		interval, _ = model.ParseDuration(defaultInterval)
+	}
+	if v, ok := annotations[intervalAnnotation]; ok {
+		d, err := model.ParseDuration(v)
+		if err != nil || d <= 0 {
+			errs = append(errs, fmt.Errorf("invalid %s %q: must be a positive duration", intervalAnnotation, v))
+		} else {
+			cfg.Interval = monitoringv1.Duration(v)
+			interval = d
+		}
+	} else if os.Getenv("Interval") == "" {
+		log.Log.V(1).Info("未配置metrics拉取时间，统一设置", "kind", kind, "interval", cfg.Interval)
+	}
+
+	if v, ok := annotations[scrapeTimeoutAnnotation]; ok {
+		d, err := model.ParseDuration(v)
+		switch {
+		case err != nil || d <= 0:
+			errs = append(errs, fmt.Errorf("invalid %s %q: must be a positive duration", scrapeTimeoutAnnotation, v))
+		case time.Duration(d) > time.Duration(interval):
+			errs = append(errs, fmt.Errorf("invalid %s %q: must not be greater than interval %s", scrapeTimeoutAnnotation, v, cfg.Interval))
+		default:
+			cfg.ScrapeTimeout = monitoringv1.Duration(v)
+		}
+	}
+
+	if v, ok := annotations[schemeAnnotation]; ok {
+		if v != "http" && v != "https" {
+			errs = append(errs, fmt.Errorf("invalid %s %q: must be http or https", schemeAnnotation, v))
+		} else {
+			cfg.Scheme = v
+		}
+	}
+
+	if v, ok := annotations[honorLabelsAnnotation]; ok {
+		honorLabels, err := strconv.ParseBool(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s %q: %v", honorLabelsAnnotation, v, err))
+		} else {
+			cfg.HonorLabels = honorLabels
+		}
+	}
+
+	return cfg, errs
+}
+
+// endpoints 将拉取配置投影为ServiceMonitor的Endpoint列表，每个端口对应一个Endpoint。
+// 未命名的端口（非侵入模式下不会为其设置名称）使用数字形式的targetPort
+func (c *scrapeConfig) endpoints(ports []corev1.ServicePort) []monitoringv1.Endpoint {
+	endpoints := make([]monitoringv1.Endpoint, 0, len(ports))
+	for _, port := range ports {
+		var targetPort *intstr.IntOrString
+		if port.Name == "" {
+			tp := port.TargetPort
+			if tp.Type == intstr.Int && tp.IntVal == 0 {
+				tp = intstr.FromInt32(port.Port)
+			}
+			targetPort = &tp
+		}
+		ep := monitoringv1.Endpoint{
+			Port:          port.Name,
+			TargetPort:    targetPort,
+			Path:          c.Path,
+			Interval:      c.Interval,
+			ScrapeTimeout: c.ScrapeTimeout,
+			Scheme:        c.Scheme,
+			HonorLabels:   c.HonorLabels,
+		}
+		if c.Auth != nil {
+			c.Auth.endpointAuth(&ep)
+		}
+		endpoints = append(endpoints, ep)
+	}
+	return endpoints
+}
+
+// scheme 返回检查metrics端点时使用的协议
+func (c *scrapeConfig) scheme() string {
+	if c.Scheme == "" {
+		return defaultScheme
+	}
+	return c.Scheme
+}
+
+// selectedPorts 返回需要检查的Service端口，未通过注解指定时为所有TCP端口
+func (c *scrapeConfig) selectedPorts(service *corev1.Service) []corev1.ServicePort {
+	var ports []corev1.ServicePort
+	for _, port := range service.Spec.Ports {
+		if len(c.Ports) > 0 {
+			if contains(c.Ports, port.Name) {
+				ports = append(ports, port)
+			}
+			continue
+		}
+		if port.Protocol == "" || port.Protocol == corev1.ProtocolTCP {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
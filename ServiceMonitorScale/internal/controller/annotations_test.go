@@ -0,0 +1,157 @@
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+var _ = Describe("legacy prometheus.io annotations", func() {
+	var service *corev1.Service
+
+	BeforeEach(func() {
+		service = &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "demo"},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{
+					{Name: "http", Port: 80, TargetPort: intstr.FromInt(8080)},
+					{Name: "admin", Port: 9090, TargetPort: intstr.FromString("admin")},
+				},
+			},
+		}
+	})
+
+	It("translates the legacy annotations", func() {
+		service.Annotations = map[string]string{
+			legacyScrapeAnnotation: "true",
+			legacyPortAnnotation:   "8080",
+			legacyPathAnnotation:   "/stats",
+			legacySchemeAnnotation: "https",
+		}
+		cfg, errs := parseScrapeConfig(service, true)
+		Expect(errs).To(BeEmpty())
+		Expect(cfg.Ports).To(Equal([]string{"http"}))
+		Expect(cfg.Path).To(Equal("/stats"))
+		Expect(cfg.Scheme).To(Equal("https"))
+
+		service.Annotations[legacyPortAnnotation] = "9090"
+		cfg, _ = parseScrapeConfig(service, true)
+		Expect(cfg.Ports).To(Equal([]string{"admin"}))
+	})
+
+	It("prefers the controller's own annotations", func() {
+		service.Annotations = map[string]string{
+			legacyScrapeAnnotation: "true",
+			scrapeAnnotation:       "false",
+			legacyPortAnnotation:   "8080",
+			portsAnnotation:        "admin",
+		}
+		cfg, errs := parseScrapeConfig(service, true)
+		Expect(errs).To(BeEmpty())
+		Expect(cfg.Enabled).To(BeFalse())
+		Expect(cfg.Ports).To(Equal([]string{"admin"}))
+	})
+
+	It("reports a port number matching no Service port", func() {
+		service.Annotations = map[string]string{legacyPortAnnotation: "7000"}
+		cfg, errs := parseScrapeConfig(service, true)
+		Expect(errs).To(HaveLen(1))
+		Expect(cfg.Ports).To(BeEmpty())
+	})
+
+	It("ignores the legacy annotations when disabled", func() {
+		service.Annotations = map[string]string{legacyPathAnnotation: "/stats"}
+		cfg, _ := parseScrapeConfig(service, false)
+		Expect(cfg.Path).To(Equal(defaultMetricsPath))
+	})
+})
+
+var _ = Describe("scrape annotations", func() {
+	var service *corev1.Service
+
+	BeforeEach(func() {
+		service = &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "demo"},
+			Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{
+				{Name: "http", Port: 8080},
+				{Name: "admin", Port: 9090},
+			}},
+		}
+	})
+
+	It("uses the defaults without annotations", func() {
+		cfg, errs := parseScrapeConfig(service, false)
+		Expect(errs).To(BeEmpty())
+		Expect(cfg.Enabled).To(BeTrue())
+		Expect(cfg.OptedIn).To(BeFalse())
+		Expect(cfg.Ports).To(BeEmpty())
+		Expect(cfg.Path).To(Equal(defaultMetricsPath))
+		Expect(string(cfg.Interval)).To(Equal(defaultInterval))
+		Expect(cfg.scheme()).To(Equal(defaultScheme))
+		Expect(cfg.selectedPorts(service)).To(HaveLen(2))
+	})
+
+	It("takes the default interval from the Interval environment variable", func() {
+		GinkgoT().Setenv("Interval", "30s")
+		cfg, errs := parseScrapeConfig(service, false)
+		Expect(errs).To(BeEmpty())
+		Expect(string(cfg.Interval)).To(Equal("30s"))
+
+		GinkgoT().Setenv("Interval", "soon")
+		cfg, errs = parseScrapeConfig(service, false)
+		Expect(errs).To(HaveLen(1))
+		Expect(string(cfg.Interval)).To(Equal(defaultInterval))
+	})
+
+	It("parses valid annotations", func() {
+		service.Annotations = map[string]string{
+			scrapeAnnotation:        "true",
+			portsAnnotation:         " admin, ,http ",
+			pathAnnotation:          "/stats",
+			intervalAnnotation:      "1m",
+			scrapeTimeoutAnnotation: "1m",
+			schemeAnnotation:        "https",
+			honorLabelsAnnotation:   "true",
+		}
+		cfg, errs := parseScrapeConfig(service, false)
+		Expect(errs).To(BeEmpty())
+		Expect(cfg.OptedIn).To(BeTrue())
+		Expect(cfg.Ports).To(Equal([]string{"admin", "http"}))
+		Expect(cfg.Path).To(Equal("/stats"))
+		Expect(string(cfg.Interval)).To(Equal("1m"))
+		Expect(string(cfg.ScrapeTimeout)).To(Equal("1m"))
+		Expect(cfg.Scheme).To(Equal("https"))
+		Expect(cfg.HonorLabels).To(BeTrue())
+	})
+
+	It("ignores invalid annotations and reports each of them", func() {
+		service.Annotations = map[string]string{
+			scrapeAnnotation:        "maybe",
+			portsAnnotation:         "http,grpc",
+			pathAnnotation:          "metrics",
+			intervalAnnotation:      "0s",
+			scrapeTimeoutAnnotation: "20s",
+			schemeAnnotation:        "ftp",
+			honorLabelsAnnotation:   "yes please",
+		}
+		cfg, errs := parseScrapeConfig(service, false)
+		Expect(errs).To(HaveLen(7))
+		Expect(cfg.Enabled).To(BeTrue())
+		Expect(cfg.Ports).To(Equal([]string{"http"}))
+		Expect(cfg.Path).To(Equal(defaultMetricsPath))
+		Expect(string(cfg.Interval)).To(Equal(defaultInterval))
+		Expect(string(cfg.ScrapeTimeout)).To(BeEmpty())
+		Expect(cfg.Scheme).To(BeEmpty())
+		Expect(cfg.HonorLabels).To(BeFalse())
+	})
+
+	It("disables scraping", func() {
+		service.Annotations = map[string]string{scrapeAnnotation: "false"}
+		cfg, errs := parseScrapeConfig(service, false)
+		Expect(errs).To(BeEmpty())
+		Expect(cfg.Enabled).To(BeFalse())
+	})
+})
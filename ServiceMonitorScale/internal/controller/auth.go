@@ -0,0 +1,394 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// 拉取metrics端点时使用的TLS和鉴权注解。引用的格式为secret/<name>/<key>或configmap/<name>/<key>，
+// 引用的Secret和ConfigMap与Service在同一命名空间
+//
+//	servicemonitorscale.tal.com/tls-ca: configmap/ca/ca.crt
+//	servicemonitorscale.tal.com/tls-cert: secret/metrics-client/tls.crt
+//	servicemonitorscale.tal.com/tls-key: secret/metrics-client/tls.key
+//	servicemonitorscale.tal.com/tls-server-name: api.demo.svc
+//	servicemonitorscale.tal.com/tls-insecure-skip-verify: "false"
+//	servicemonitorscale.tal.com/bearer-token: secret/metrics-token/token
+//	servicemonitorscale.tal.com/basic-auth: secret/metrics-basic-auth
+const (
+	tlsCAAnnotation                 = annotationPrefix + "tls-ca"
+	tlsCertAnnotation               = annotationPrefix + "tls-cert"
+	tlsKeyAnnotation                = annotationPrefix + "tls-key"
+	tlsServerNameAnnotation         = annotationPrefix + "tls-server-name"
+	tlsInsecureSkipVerifyAnnotation = annotationPrefix + "tls-insecure-skip-verify"
+	bearerTokenAnnotation           = annotationPrefix + "bearer-token"
+	// basicAuthAnnotation 引用一个Secret，使用其中的username和password
+	basicAuthAnnotation = annotationPrefix + "basic-auth"
+)
+
+// Prometheus Operator只能引用ServiceMonitor所在命名空间中的Secret，
+// 因此控制器把引用的内容复制到ServiceMonitor命名空间中的一个Secret，以下为其中的键
+const (
+	authCAKey       = "ca.crt"
+	authCertKey     = "tls.crt"
+	authKeyKey      = "tls.key"
+	authTokenKey    = "token"
+	authUsernameKey = "username"
+	authPasswordKey = "password"
+)
+
+// errMissingAuthKey 引用的Secret或ConfigMap中没有指定的键
+var errMissingAuthKey = errors.New("key not found")
+
+// keyRef 引用Secret或ConfigMap中的一个键
+type keyRef struct {
+	// Kind 为Secret或ConfigMap
+	Kind string
+	Name string
+	Key  string
+}
+
+func (r keyRef) String() string {
+	return strings.ToLower(r.Kind) + "/" + r.Name + "/" + r.Key
+}
+
+// authConfig 从Service注解解析出的TLS和鉴权配置
+type authConfig struct {
+	CA                 *keyRef
+	Cert               *keyRef
+	Key                *keyRef
+	ServerName         string
+	InsecureSkipVerify bool
+	BearerToken        *keyRef
+	// BasicAuth basic-auth注解引用的Secret名称
+	BasicAuth string
+	// SecretName 复制引用内容的Secret名称，位于ServiceMonitor所在的命名空间
+	SecretName string
+}
+
+// tls 返回是否配置了TLS
+func (a *authConfig) tls() bool {
+	return a.CA != nil || a.Cert != nil || a.ServerName != "" || a.InsecureSkipVerify
+}
+
+// authSecretName 返回复制Service鉴权内容的Secret名称
+func authSecretName(service types.NamespacedName) string {
+	return fmt.Sprintf("%s-%s-%s", managedByValue, service.Namespace, service.Name)
+}
+
+// workloadAuthSecretName 返回复制工作负载鉴权内容的Secret名称，包含工作负载类型以免与Service的Secret重名
+func workloadAuthSecretName(kind string, workload types.NamespacedName) string {
+	return fmt.Sprintf("%s-%s-%s-%s", managedByValue, strings.ToLower(kind), workload.Namespace, workload.Name)
+}
+
+// parseKeyRef 解析secret/<name>/<key>或configmap/<name>/<key>格式的引用，secretOnly为true时只允许引用Secret
+func parseKeyRef(annotation, value string, secretOnly bool) (*keyRef, error) {
+	parts := strings.Split(value, "/")
+	if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+		return nil, fmt.Errorf("invalid %s %q: must be secret/<name>/<key> or configmap/<name>/<key>", annotation, value)
+	}
+	switch parts[0] {
+	case "secret":
+		return &keyRef{Kind: "Secret", Name: parts[1], Key: parts[2]}, nil
+	case "configmap":
+		if secretOnly {
+			return nil, fmt.Errorf("invalid %s %q: must reference a Secret", annotation, value)
+		}
+		return &keyRef{Kind: "ConfigMap", Name: parts[1], Key: parts[2]}, nil
+	}
+	return nil, fmt.Errorf("invalid %s %q: must be secret/<name>/<key> or configmap/<name>/<key>", annotation, value)
+}
+
+// parseAuthAnnotations 解析并校验TLS和鉴权注解，没有设置任何相关注解时返回nil
+func parseAuthAnnotations(annotations map[string]string) (*authConfig, []error) {
+	auth := &authConfig{}
+	var errs []error
+	set := false
+
+	refs := []struct {
+		annotation string
+		secretOnly bool
+		target     **keyRef
+	}{
+		{tlsCAAnnotation, false, &auth.CA},
+		{tlsCertAnnotation, false, &auth.Cert},
+		{tlsKeyAnnotation, true, &auth.Key},
+		{bearerTokenAnnotation, true, &auth.BearerToken},
+	}
+	for _, ref := range refs {
+		v, ok := annotations[ref.annotation]
+		if !ok {
+			continue
+		}
+		set = true
+		parsed, err := parseKeyRef(ref.annotation, v, ref.secretOnly)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		*ref.target = parsed
+	}
+	if (auth.Cert == nil) != (auth.Key == nil) {
+		errs = append(errs, fmt.Errorf("invalid %s and %s: client certificate and key must be set together", tlsCertAnnotation, tlsKeyAnnotation))
+		auth.Cert, auth.Key = nil, nil
+	}
+
+	if v, ok := annotations[tlsServerNameAnnotation]; ok {
+		set = true
+		auth.ServerName = v
+	}
+	if v, ok := annotations[tlsInsecureSkipVerifyAnnotation]; ok {
+		set = true
+		insecure, err := strconv.ParseBool(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s %q: %v", tlsInsecureSkipVerifyAnnotation, v, err))
+		} else {
+			auth.InsecureSkipVerify = insecure
+		}
+	}
+
+	if v, ok := annotations[basicAuthAnnotation]; ok {
+		set = true
+		name, found := strings.CutPrefix(v, "secret/")
+		if !found || name == "" || strings.Contains(name, "/") {
+			errs = append(errs, fmt.Errorf("invalid %s %q: must be secret/<name>", basicAuthAnnotation, v))
+		} else {
+			auth.BasicAuth = name
+		}
+	}
+	if auth.BearerToken != nil && auth.BasicAuth != "" {
+		errs = append(errs, fmt.Errorf("invalid %s: %s and %s must not be set together", basicAuthAnnotation, bearerTokenAnnotation, basicAuthAnnotation))
+		auth.BasicAuth = ""
+	}
+
+	if !set {
+		return nil, errs
+	}
+	return auth, errs
+}
+
+// endpointAuth 在Endpoint上设置TLS和鉴权字段，引用复制到ServiceMonitor命名空间的Secret
+func (a *authConfig) endpointAuth(ep *monitoringv1.Endpoint) {
+	secretKey := func(key string) *corev1.SecretKeySelector {
+		return &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: a.SecretName},
+			Key:                  key,
+		}
+	}
+	if a.tls() {
+		ep.TLSConfig = &monitoringv1.TLSConfig{SafeTLSConfig: monitoringv1.SafeTLSConfig{
+			ServerName:         a.ServerName,
+			InsecureSkipVerify: a.InsecureSkipVerify,
+		}}
+		if a.CA != nil {
+			ep.TLSConfig.CA.Secret = secretKey(authCAKey)
+		}
+		if a.Cert != nil {
+			ep.TLSConfig.Cert.Secret = secretKey(authCertKey)
+			ep.TLSConfig.KeySecret = secretKey(authKeyKey)
+		}
+	}
+	if a.BearerToken != nil {
+		ep.BearerTokenSecret = secretKey(authTokenKey)
+	}
+	if a.BasicAuth != "" {
+		ep.BasicAuth = &monitoringv1.BasicAuth{
+			Username: *secretKey(authUsernameKey),
+			Password: *secretKey(authPasswordKey),
+		}
+	}
+}
+
+// podEndpointAuth 在PodMonitor的Endpoint上设置与endpointAuth相同的TLS和鉴权字段
+func (a *authConfig) podEndpointAuth(ep *monitoringv1.PodMetricsEndpoint) {
+	var endpoint monitoringv1.Endpoint
+	a.endpointAuth(&endpoint)
+	if endpoint.TLSConfig != nil {
+		tlsConfig := endpoint.TLSConfig.SafeTLSConfig
+		ep.TLSConfig = &tlsConfig
+	}
+	if endpoint.BearerTokenSecret != nil {
+		ep.BearerTokenSecret = *endpoint.BearerTokenSecret
+	}
+	ep.BasicAuth = endpoint.BasicAuth
+}
+
+// probeTarget 用解析出的鉴权内容补充检查目标
+func (a *authConfig) probeTarget(target ProbeTarget, data map[string][]byte) ProbeTarget {
+	if a == nil {
+		return target
+	}
+	target.CABundle = data[authCAKey]
+	target.ClientCert = data[authCertKey]
+	target.ClientKey = data[authKeyKey]
+	target.ServerName = a.ServerName
+	target.InsecureSkipVerify = a.InsecureSkipVerify
+	target.BearerToken = string(data[authTokenKey])
+	target.Username = string(data[authUsernameKey])
+	target.Password = string(data[authPasswordKey])
+	return target
+}
+
+// resolveAuth 读取Service命名空间中被引用的Secret和ConfigMap，返回以复制后的键组织的内容。
+// 引用的对象或键不存在时返回的错误满足apierrors.IsNotFound或errors.Is(err, errMissingAuthKey)
+func (r *ServiceReconciler) resolveAuth(ctx context.Context, service *corev1.Service, auth *authConfig) (map[string][]byte, error) {
+	return readAuthData(ctx, r.apiReader, service.Namespace, auth)
+}
+
+// readAuthData 读取namespace中被auth引用的Secret和ConfigMap，由Service和工作负载共用
+func readAuthData(ctx context.Context, reader client.Reader, namespace string, auth *authConfig) (map[string][]byte, error) {
+	if auth == nil {
+		return nil, nil
+	}
+	data := map[string][]byte{}
+	read := func(ref *keyRef, key string) error {
+		if ref == nil {
+			return nil
+		}
+		value, err := readKey(ctx, reader, namespace, *ref)
+		if err != nil {
+			return err
+		}
+		data[key] = value
+		return nil
+	}
+	for key, ref := range map[string]*keyRef{
+		authCAKey:    auth.CA,
+		authCertKey:  auth.Cert,
+		authKeyKey:   auth.Key,
+		authTokenKey: auth.BearerToken,
+	} {
+		if err := read(ref, key); err != nil {
+			return nil, err
+		}
+	}
+	if auth.BasicAuth != "" {
+		if err := read(&keyRef{Kind: "Secret", Name: auth.BasicAuth, Key: authUsernameKey}, authUsernameKey); err != nil {
+			return nil, err
+		}
+		if err := read(&keyRef{Kind: "Secret", Name: auth.BasicAuth, Key: authPasswordKey}, authPasswordKey); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// readKey 读取Secret或ConfigMap中一个键的值
+func readKey(ctx context.Context, reader client.Reader, namespace string, ref keyRef) ([]byte, error) {
+	key := types.NamespacedName{Namespace: namespace, Name: ref.Name}
+	var values map[string][]byte
+	if ref.Kind == "ConfigMap" {
+		cm := &corev1.ConfigMap{}
+		if err := reader.Get(ctx, key, cm); err != nil {
+			return nil, fmt.Errorf("failed to get ConfigMap %s: %w", key, err)
+		}
+		values = cm.BinaryData
+		if v, ok := cm.Data[ref.Key]; ok {
+			return []byte(v), nil
+		}
+	} else {
+		secret := &corev1.Secret{}
+		if err := reader.Get(ctx, key, secret); err != nil {
+			return nil, fmt.Errorf("failed to get Secret %s: %w", key, err)
+		}
+		values = secret.Data
+	}
+	v, ok := values[ref.Key]
+	if !ok {
+		return nil, fmt.Errorf("%s %s: %s %w", ref.Kind, key, ref.Key, errMissingAuthKey)
+	}
+	return v, nil
+}
+
+// applyAuthSecret 把Service引用的鉴权内容写入ServiceMonitor命名空间中的Secret，
+// Service不再配置鉴权时删除该Secret
+func (r *ServiceReconciler) applyAuthSecret(ctx context.Context, service *corev1.Service, auth *authConfig, data map[string][]byte) error {
+	owner := client.ObjectKeyFromObject(service)
+	if auth == nil {
+		return r.deleteAuthSecrets(ctx, owner)
+	}
+	return applyOwnedAuthSecret(ctx, r.Client, r.DryRun, r.Options.MonitorNamespace, ownerLabels(owner), owner.String(), auth, data)
+}
+
+// applyOwnedAuthSecret 把鉴权内容写入namespace中名为auth.SecretName、带有归属标签labels的Secret。
+// 同名的Secret不带有这些标签时不接管。owner用于日志和dry-run报告
+func applyOwnedAuthSecret(ctx context.Context, c client.Client, dryRun *DryRunReport, namespace string, labels map[string]string, owner string, auth *authConfig, data map[string][]byte) error {
+	secret := &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{Kind: "Secret", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      auth.SecretName,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: data,
+	}
+	existing := &corev1.Secret{}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(secret), existing); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if existing.ResourceVersion != "" {
+		for k, v := range labels {
+			if existing.Labels[k] != v {
+				return fmt.Errorf("secret %s/%s exists and is not generated for %s", secret.Namespace, secret.Name, owner)
+			}
+		}
+	}
+	if err := c.Patch(ctx, secret, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership); err != nil {
+		return fmt.Errorf("failed to apply Secret %s/%s: %v", secret.Namespace, secret.Name, err)
+	}
+	if dryRun != nil {
+		dryRun.planObject("Secret", client.ObjectKeyFromObject(secret), owner, existing.ResourceVersion == "",
+			managedSecretFields(existing), managedSecretFields(secret))
+	} else if secret.ResourceVersion != existing.ResourceVersion {
+		log.Log.WithValues("owner", owner, "Secret", secret.Namespace+"/"+secret.Name).Info("Auth Secret applied")
+	}
+	return nil
+}
+
+// managedSecretFields Secret中控制器负责的字段，只包含各个值的摘要，dry-run的差异中不会出现密钥
+func managedSecretFields(secret *corev1.Secret) managedMonitorFields {
+	digests := make(map[string]string, len(secret.Data))
+	for k, v := range secret.Data {
+		digests[k] = fmt.Sprintf("sha256:%x", sha256.Sum256(v))
+	}
+	return managedMonitorFields{Labels: secret.Labels, Spec: digests}
+}
+
+// deleteAuthSecrets 删除为该Service复制鉴权内容的Secret
+func (r *ServiceReconciler) deleteAuthSecrets(ctx context.Context, service types.NamespacedName) error {
+	return deleteOwnedAuthSecrets(ctx, r.Client, r.DryRun, r.Options.MonitorNamespace, ownerLabels(service), service.String())
+}
+
+// deleteOwnedAuthSecrets 删除namespace中带有归属标签labels的鉴权Secret
+func deleteOwnedAuthSecrets(ctx context.Context, c client.Client, dryRun *DryRunReport, namespace string, labels map[string]string, owner string) error {
+	secrets := &corev1.SecretList{}
+	if err := c.List(ctx, secrets, client.InNamespace(namespace), client.MatchingLabels(labels)); err != nil {
+		return err
+	}
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		if err := c.Delete(ctx, secret); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		if dryRun != nil {
+			dryRun.planDelete("Secret", client.ObjectKeyFromObject(secret), owner)
+			continue
+		}
+		log.Log.WithValues("owner", owner, "Secret", secret.Namespace+"/"+secret.Name).Info("Auth Secret deleted")
+	}
+	return nil
+}
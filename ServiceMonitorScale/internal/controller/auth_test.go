@@ -0,0 +1,134 @@
+package controller
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("scrape authentication", func() {
+	var service *corev1.Service
+
+	BeforeEach(func() {
+		service = &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "demo"},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{{Name: "https", Port: 8443}},
+			},
+		}
+	})
+
+	It("renders endpoint auth referencing the copied Secret", func() {
+		service.Annotations = map[string]string{
+			tlsCAAnnotation:       "configmap/ca/ca.crt",
+			tlsCertAnnotation:     "secret/client/tls.crt",
+			tlsKeyAnnotation:      "secret/client/tls.key",
+			bearerTokenAnnotation: "secret/token/token",
+		}
+		cfg, errs := parseScrapeConfig(service, false)
+		Expect(errs).To(BeEmpty())
+		Expect(cfg.Scheme).To(Equal("https"))
+
+		ep := cfg.endpoints(service.Spec.Ports)[0]
+		secretName := "servicemonitorscale-demo-api"
+		Expect(ep.TLSConfig.CA.Secret.Name).To(Equal(secretName))
+		Expect(ep.TLSConfig.CA.Secret.Key).To(Equal(authCAKey))
+		Expect(ep.TLSConfig.Cert.Secret.Key).To(Equal(authCertKey))
+		Expect(ep.TLSConfig.KeySecret.Key).To(Equal(authKeyKey))
+		Expect(ep.BearerTokenSecret.Name).To(Equal(secretName))
+		Expect(ep.BasicAuth).To(BeNil())
+	})
+
+	It("rejects invalid references", func() {
+		service.Annotations = map[string]string{
+			tlsKeyAnnotation:    "configmap/client/tls.key",
+			basicAuthAnnotation: "credentials",
+		}
+		cfg, errs := parseScrapeConfig(service, false)
+		Expect(errs).To(HaveLen(2))
+		Expect(cfg.Auth.Key).To(BeNil())
+		Expect(cfg.Auth.BasicAuth).To(BeEmpty())
+	})
+
+	It("resolves references in the Service namespace", func() {
+		reader := fake.NewClientBuilder().WithObjects(
+			&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "ca", Namespace: "demo"}, Data: map[string]string{"ca.crt": "CA"}},
+			&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "basic", Namespace: "demo"}, Data: map[string][]byte{"username": []byte("u"), "password": []byte("p")}},
+		).Build()
+		r := &ServiceReconciler{apiReader: reader}
+
+		service.Annotations = map[string]string{tlsCAAnnotation: "configmap/ca/ca.crt", basicAuthAnnotation: "secret/basic"}
+		cfg, _ := parseScrapeConfig(service, false)
+		data, err := r.resolveAuth(context.Background(), service, cfg.Auth)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(Equal(map[string][]byte{authCAKey: []byte("CA"), authUsernameKey: []byte("u"), authPasswordKey: []byte("p")}))
+
+		service.Annotations[tlsCAAnnotation] = "configmap/ca/missing.crt"
+		cfg, _ = parseScrapeConfig(service, false)
+		_, err = r.resolveAuth(context.Background(), service, cfg.Auth)
+		Expect(errors.Is(err, errMissingAuthKey)).To(BeTrue())
+	})
+
+	It("probes HTTPS endpoints with a CA bundle and bearer token", func() {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = w.Write([]byte("up 1\n"))
+		}))
+		defer server.Close()
+		ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+		prober := &HTTPProber{}
+		result := prober.Probe(context.Background(), ProbeTarget{URL: server.URL, CABundle: ca})
+		Expect(result.StatusCode).To(Equal(http.StatusUnauthorized))
+
+		result = prober.Probe(context.Background(), ProbeTarget{URL: server.URL, CABundle: ca, BearerToken: "secret"})
+		Expect(result.Err).NotTo(HaveOccurred())
+		Expect(result.Healthy).To(BeTrue())
+	})
+
+	It("closes the connections of TLS probes", func() {
+		var mu sync.Mutex
+		open := 0
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("up 1\n"))
+		}))
+		server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+			mu.Lock()
+			defer mu.Unlock()
+			switch state {
+			case http.StateNew:
+				open++
+			case http.StateClosed, http.StateHijacked:
+				open--
+			}
+		}
+		server.StartTLS()
+		defer server.Close()
+		ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+		prober := &HTTPProber{}
+		for i := 0; i < 3; i++ {
+			result := prober.Probe(context.Background(), ProbeTarget{URL: server.URL, CABundle: ca})
+			Expect(result.Healthy).To(BeTrue())
+		}
+		Eventually(func() int {
+			mu.Lock()
+			defer mu.Unlock()
+			return open
+		}).Should(BeZero())
+	})
+})
@@ -0,0 +1,272 @@
+package controller
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+// Options 控制ServiceMonitor的生成方式，可以通过配置文件或cmd/main.go的命令行参数设置
+//
+//	monitorNamespace: monitoring
+//	discoveryLabels:
+//	  release: kube-prometheus-stack
+//	nameTemplate: "{{ .Namespace }}-{{ .Name }}"
+//	nonInvasive: false
+//	namespaceSelector: servicemonitorscale.tal.com/enabled=true
+//	includeNamespaces: [demo]
+//	excludeNamespaces: [kube-system]
+//	optIn: false
+//	excludeServiceTypes: [NodePort]
+//	excludeSelector: component=infra
+//	excludeNames: ["^kube-dns$"]
+//	ignoreLegacyAnnotations: false
+//	podMonitors: true
+//	podMonitorNameTemplate: "{{ .Namespace }}-{{ .Kind }}-{{ .Name }}"
+//	relabeling:
+//	  dropMetrics: ["go_gc_.*"]
+//	  targetLabels: [team, cost_center]
+//	namespaceRelabeling:
+//	  demo:
+//	    keepMetrics: ["http_.*", "up"]
+//	alerts:
+//	  enabled: true
+//	  routingLabels: [team]
+//	limits:
+//	  sampleLimit: 50000
+//	namespaceLimits:
+//	  batch:
+//	    sampleLimit: 200000
+type Options struct {
+	// MonitorNamespace 生成的ServiceMonitor所在的命名空间
+	MonitorNamespace string `json:"monitorNamespace,omitempty"`
+	// DiscoveryLabels 添加到Service和ServiceMonitor上的标签，需要与Prometheus的serviceMonitorSelector匹配
+	DiscoveryLabels map[string]string `json:"discoveryLabels,omitempty"`
+	// NameTemplate ServiceMonitor名称的模板，可以使用.Namespace、.Name和.App（Service的app标签）。
+	// 渲染结果会被转换为合法的DNS-1123名称，为空时使用<namespace>-<name>
+	NameTemplate string `json:"nameTemplate,omitempty"`
+	// NonInvasive 为true时控制器不修改Service：ServiceMonitor通过Service已有的标签选择Service，
+	// 未命名的端口使用targetPort
+	NonInvasive bool `json:"nonInvasive,omitempty"`
+	// NamespaceSelector 标签选择器，只处理标签匹配的命名空间中的Service，为空时不按标签选择
+	NamespaceSelector string `json:"namespaceSelector,omitempty"`
+	// IncludeNamespaces 无论标签如何都处理的命名空间
+	IncludeNamespaces []string `json:"includeNamespaces,omitempty"`
+	// ExcludeNamespaces 无论标签如何都不处理的命名空间，优先于IncludeNamespaces
+	ExcludeNamespaces []string `json:"excludeNamespaces,omitempty"`
+	// OptIn 为true时只处理scrape注解为true的Service，否则scrape注解为false的Service不处理
+	OptIn bool `json:"optIn,omitempty"`
+	// ExcludeServiceTypes 不处理的Service类型，ExternalName类型的Service总是不处理
+	ExcludeServiceTypes []string `json:"excludeServiceTypes,omitempty"`
+	// ExcludeSelector 标签选择器，标签匹配的Service不处理
+	ExcludeSelector string `json:"excludeSelector,omitempty"`
+	// ExcludeNames 正则表达式，名称匹配任意一个的Service不处理
+	ExcludeNames []string `json:"excludeNames,omitempty"`
+	// IgnoreLegacyAnnotations 为true时不识别Service上的prometheus.io/*注解
+	IgnoreLegacyAnnotations bool `json:"ignoreLegacyAnnotations,omitempty"`
+	// PodMonitors 为true时为带有scrape注解的Deployment、StatefulSet、DaemonSet和独立的Pod生成PodMonitor
+	PodMonitors bool `json:"podMonitors,omitempty"`
+	// PodMonitorNameTemplate PodMonitor名称的模板，可以使用.Namespace、.Name、.App和.Kind（小写的工作负载类型）
+	PodMonitorNameTemplate string `json:"podMonitorNameTemplate,omitempty"`
+	// Relabeling 合并到所有生成的ServiceMonitor和PodMonitor中的relabel模板
+	Relabeling RelabelingTemplate `json:"relabeling,omitempty"`
+	// NamespaceRelabeling 按Service或工作负载所在的命名空间追加在Relabeling之后的relabel模板
+	NamespaceRelabeling map[string]RelabelingTemplate `json:"namespaceRelabeling,omitempty"`
+	// Alerts 为每个生成的ServiceMonitor生成PrometheusRule告警
+	Alerts AlertOptions `json:"alerts,omitempty"`
+	// Limits 写入所有生成的ServiceMonitor和PodMonitor的拉取限制
+	Limits ScrapeLimits `json:"limits,omitempty"`
+	// NamespaceLimits 按Service或工作负载所在的命名空间覆盖Limits中的字段
+	NamespaceLimits map[string]ScrapeLimits `json:"namespaceLimits,omitempty"`
+}
+
+const (
+	defaultMonitorNamespace  = "default"
+	defaultNameTemplate      = "{{ .Namespace }}-{{ .Name }}"
+	defaultNamespaceSelector = "servicemonitorscale.tal.com/enabled=true"
+	// 工作负载通常没有app标签，默认使用命名空间和名称
+	defaultPodMonitorNameTemplate = "{{ .Namespace }}-{{ .Name }}"
+)
+
+// DefaultOptions 返回默认配置。与之前硬编码的行为相比，ServiceMonitor以<namespace>-<service>命名；
+// 默认不再处理demo命名空间，而是处理带有servicemonitorscale.tal.com/enabled=true标签的命名空间，
+// 并且总是排除kube-system。需要继续处理demo命名空间时设置ServiceNamespaces环境变量或includeNamespaces
+func DefaultOptions() Options {
+	return Options{
+		MonitorNamespace:  defaultMonitorNamespace,
+		DiscoveryLabels:   map[string]string{"release": "kube-prometheus-stack"},
+		NameTemplate:      defaultNameTemplate,
+		NamespaceSelector: defaultNamespaceSelector,
+		ExcludeNamespaces: []string{"kube-system"},
+
+		PodMonitorNameTemplate: defaultPodMonitorNameTemplate,
+	}
+}
+
+// LoadOptions 从YAML配置文件读取配置，未设置的字段使用默认值
+func LoadOptions(path string) (Options, error) {
+	opts := DefaultOptions()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return opts, err
+	}
+	// map类型的字段会与已有的值合并，配置文件中的发现标签需要替换而不是追加到默认值上
+	defaultLabels := opts.DiscoveryLabels
+	opts.DiscoveryLabels = nil
+	if err := yaml.UnmarshalStrict(data, &opts); err != nil {
+		return opts, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	if opts.DiscoveryLabels == nil {
+		opts.DiscoveryLabels = defaultLabels
+	}
+	return opts, opts.Validate()
+}
+
+// Validate 校验配置是否合法
+func (o Options) Validate() error {
+	if o.MonitorNamespace == "" {
+		return fmt.Errorf("monitorNamespace must not be empty")
+	}
+	if _, err := template.New("name").Parse(o.NameTemplate); err != nil {
+		return fmt.Errorf("invalid nameTemplate: %v", err)
+	}
+	if _, err := template.New("name").Parse(o.PodMonitorNameTemplate); err != nil {
+		return fmt.Errorf("invalid podMonitorNameTemplate: %v", err)
+	}
+	if _, err := o.parseNamespaceSelector(); err != nil {
+		return fmt.Errorf("invalid namespaceSelector: %v", err)
+	}
+	if _, err := o.compileRules(); err != nil {
+		return err
+	}
+	if err := o.validateRelabeling(); err != nil {
+		return err
+	}
+	if err := o.validateAlerts(); err != nil {
+		return err
+	}
+	return o.validateLimits()
+}
+
+// parseNamespaceSelector 解析NamespaceSelector，为空时不选中任何命名空间
+func (o Options) parseNamespaceSelector() (labels.Selector, error) {
+	if o.NamespaceSelector == "" {
+		return labels.Nothing(), nil
+	}
+	return labels.Parse(o.NamespaceSelector)
+}
+
+// monitorName 按NameTemplate渲染Service对应的ServiceMonitor名称，渲染结果为空时（例如Service没有app标签）
+// 使用<namespace>-<name>
+func (o Options) monitorName(service *corev1.Service) (string, error) {
+	name, err := renderName(o.NameTemplate, "Service", service)
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		name = service.Namespace + "-" + service.Name
+	}
+	return safeName(name, service.Namespace+"/"+service.Name), nil
+}
+
+// podMonitorName 按PodMonitorNameTemplate渲染工作负载对应的PodMonitor名称
+func (o Options) podMonitorName(kind string, obj metav1.Object) (string, error) {
+	name, err := renderName(o.PodMonitorNameTemplate, kind, obj)
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		return "", fmt.Errorf("podMonitorNameTemplate renders an empty name")
+	}
+	return safeName(name, kind+"/"+obj.GetNamespace()+"/"+obj.GetName()), nil
+}
+
+// safeName 把渲染出的名称转换为合法的DNS-1123标签：大写字母转为小写，其他非法字符替换为-。
+// 名称被修改或超过63个字符时截断，并追加key（生成该名称的对象）的哈希，
+// 使不同对象的名称不会因为转换或截断而相同
+func safeName(name, key string) string {
+	safe := strings.Trim(strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + ('a' - 'A')
+		}
+		return '-'
+	}, name), "-")
+	if safe == name && len(validation.IsDNS1123Label(safe)) == 0 {
+		return safe
+	}
+
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(key)))[:8]
+	if limit := validation.DNS1123LabelMaxLength - len(hash) - 1; len(safe) > limit {
+		safe = strings.TrimRight(safe[:limit], "-")
+	}
+	if safe == "" {
+		return hash
+	}
+	return safe + "-" + hash
+}
+
+func renderName(text, kind string, obj metav1.Object) (string, error) {
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, templateData(kind, obj)); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// templateData 返回名称模板和relabel模板可以使用的数据
+func templateData(kind string, obj metav1.Object) interface{} {
+	return struct {
+		Namespace string
+		Name      string
+		App       string
+		Kind      string
+		Labels    map[string]string
+	}{
+		Namespace: obj.GetNamespace(),
+		Name:      obj.GetName(),
+		App:       obj.GetLabels()["app"],
+		Kind:      strings.ToLower(kind),
+		Labels:    obj.GetLabels(),
+	}
+}
+
+// monitorSelector 返回ServiceMonitor用于选择Service的标签：发现标签加上app标签，Service没有app标签时不包含app。
+// 非侵入模式下发现标签不会被添加到Service上，因此使用Service已有的标签。
+// Service上已被设置为其他值的发现标签不会被控制器修改，不包含在selector中。
+// 选中的其他Service的target由Endpoint中按Service名称保留的relabel配置排除
+func (o Options) monitorSelector(service *corev1.Service) map[string]string {
+	if o.NonInvasive {
+		selector := make(map[string]string, len(service.Labels))
+		for k, v := range service.Labels {
+			selector[k] = v
+		}
+		return selector
+	}
+	selector := make(map[string]string, len(o.DiscoveryLabels)+1)
+	for k, v := range o.DiscoveryLabels {
+		if current, ok := service.Labels[k]; ok && current != v {
+			continue
+		}
+		selector[k] = v
+	}
+	if app := service.Labels["app"]; app != "" {
+		selector["app"] = app
+	}
+	return selector
+}
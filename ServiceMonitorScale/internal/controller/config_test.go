@@ -0,0 +1,123 @@
+package controller
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+var _ = Describe("ServiceMonitor naming", func() {
+	service := func(namespace, name, app string) *corev1.Service {
+		return &corev1.Service{ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			Labels:    map[string]string{"app": app},
+		}}
+	}
+
+	It("keeps Services with the same app label in different namespaces apart", func() {
+		a, err := DefaultOptions().monitorName(service("team-a", "api", "api"))
+		Expect(err).NotTo(HaveOccurred())
+		b, err := DefaultOptions().monitorName(service("team-b", "api", "api"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(a).To(Equal("team-a-api"))
+		Expect(b).To(Equal("team-b-api"))
+	})
+
+	It("falls back to namespace and name when the template renders empty", func() {
+		opts := DefaultOptions()
+		opts.NameTemplate = "{{ .App }}"
+		name, err := opts.monitorName(service("demo", "api", ""))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(name).To(Equal("demo-api"))
+	})
+
+	It("truncates and hashes names that are not valid DNS-1123 labels", func() {
+		long := service(strings.Repeat("n", 63), strings.Repeat("s", 63), "")
+		name, err := DefaultOptions().monitorName(long)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(validation.IsDNS1123Label(name)).To(BeEmpty())
+
+		other := service(strings.Repeat("n", 63), strings.Repeat("s", 62), "")
+		otherName, err := DefaultOptions().monitorName(other)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(otherName).NotTo(Equal(name))
+
+		Expect(safeName("API_v2", "demo/api")).To(MatchRegexp(`^api-v2-[0-9a-f]{8}$`))
+		Expect(safeName("api", "demo/api")).To(Equal("api"))
+	})
+
+	It("recognizes ServiceMonitors generated before ownership labels", func() {
+		svc := service("demo", "api", "api")
+		legacy := &monitoringv1.ServiceMonitor{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Labels: map[string]string{"app": "api", "release": "kube-prometheus-stack"}},
+			Spec: monitoringv1.ServiceMonitorSpec{
+				NamespaceSelector: monitoringv1.NamespaceSelector{MatchNames: []string{"demo"}},
+				Selector:          metav1.LabelSelector{MatchLabels: map[string]string{"app": "api", "release": "kube-prometheus-stack"}},
+			},
+		}
+		Expect(isLegacyServiceMonitor(legacy, svc)).To(BeTrue())
+
+		legacy.Labels["team"] = "payments"
+		Expect(isLegacyServiceMonitor(legacy, svc)).To(BeFalse())
+		delete(legacy.Labels, "team")
+
+		legacy.Spec.NamespaceSelector.MatchNames = []string{"other"}
+		Expect(isLegacyServiceMonitor(legacy, svc)).To(BeFalse())
+	})
+
+	It("writes ServiceMonitors to the configured namespace with the discovery labels", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "config.yaml")
+		Expect(os.WriteFile(path, []byte(`
+monitorNamespace: monitoring
+discoveryLabels:
+  prometheus: platform
+nameTemplate: "{{ .App }}-{{ index .Labels \"tier\" }}"
+`), 0o600)).To(Succeed())
+		opts, err := LoadOptions(path)
+		Expect(err).NotTo(HaveOccurred())
+
+		svc := service("demo", "api", "api")
+		svc.Labels["tier"] = "web"
+		cfg, _ := parseScrapeConfig(svc, false)
+		sm, err := opts.desiredServiceMonitor(svc, cfg, []corev1.ServicePort{{Name: "http", Port: 8080}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sm.Name).To(Equal("api-web"))
+		Expect(sm.Namespace).To(Equal("monitoring"))
+		Expect(sm.Labels).To(HaveKeyWithValue("prometheus", "platform"))
+		Expect(sm.Labels).NotTo(HaveKey("release"))
+		Expect(sm.Spec.Selector.MatchLabels).To(HaveKeyWithValue("prometheus", "platform"))
+		Expect(sm.Spec.NamespaceSelector.MatchNames).To(Equal([]string{"demo"}))
+	})
+
+	It("rejects invalid configuration", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "config.yaml")
+		Expect(os.WriteFile(path, []byte("nameTemplate: \"{{ .Namespace\"\n"), 0o600)).To(Succeed())
+		_, err := LoadOptions(path)
+		Expect(err).To(MatchError(ContainSubstring("nameTemplate")))
+
+		Expect(os.WriteFile(path, []byte("monitorNamespaces: monitoring\n"), 0o600)).To(Succeed())
+		_, err = LoadOptions(path)
+		Expect(err).To(HaveOccurred())
+
+		opts := DefaultOptions()
+		opts.MonitorNamespace = ""
+		Expect(opts.Validate()).NotTo(Succeed())
+	})
+
+	It("reports templates referring to unknown fields", func() {
+		opts := DefaultOptions()
+		opts.NameTemplate = "{{ .Team }}"
+		_, err := opts.monitorName(service("demo", "api", "api"))
+		Expect(err).To(HaveOccurred())
+	})
+})
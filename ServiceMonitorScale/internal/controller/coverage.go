@@ -0,0 +1,200 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// reasonNotReconciled 没有被任何ServiceMonitor选中、本副本也还没有处理过的Service的原因，
+// 例如刚创建的Service，或者没有成为leader的副本
+const reasonNotReconciled = "NotReconciled"
+
+// UnmonitoredService 覆盖率报告中没有被任何ServiceMonitor拉取的Service
+type UnmonitoredService struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// State skipped表示Service被注解或过滤规则排除，unmonitored表示Service需要监控但没有ServiceMonitor
+	State   string `json:"state"`
+	Reason  string `json:"reason"`
+	Message string `json:"message,omitempty"`
+	// ProbeResult 最近一次检查各端口metrics端点的结果
+	ProbeResult string `json:"probeResult,omitempty"`
+}
+
+// CoverageReport 被监控命名空间中Service的ServiceMonitor覆盖情况
+type CoverageReport struct {
+	GeneratedAt time.Time `json:"generatedAt"`
+	// Services 被监控命名空间中Service的数量
+	Services int `json:"services"`
+	// Monitored 被生成的或手动维护的ServiceMonitor选中的Service数量
+	Monitored   int                  `json:"monitored"`
+	Unmonitored []UnmonitoredService `json:"unmonitored"`
+}
+
+// Markdown 以Markdown表格的形式输出报告
+func (c *CoverageReport) Markdown() string {
+	var b strings.Builder
+	b.WriteString("# ServiceMonitor coverage\n\n")
+	fmt.Fprintf(&b, "%d of %d Services in watched namespaces are monitored (%s).\n",
+		c.Monitored, c.Services, c.GeneratedAt.UTC().Format(time.RFC3339))
+	if len(c.Unmonitored) == 0 {
+		return b.String()
+	}
+	b.WriteString("\n| Namespace | Service | State | Reason | Message | Probe result |\n")
+	b.WriteString("|-----------|---------|-------|--------|---------|--------------|\n")
+	escape := strings.NewReplacer("|", `\|`, "\n", " ")
+	for _, s := range c.Unmonitored {
+		fmt.Fprintf(&b, "| %s | %s | %s | %s | %s | %s |\n",
+			s.Namespace, s.Name, s.State, s.Reason, escape.Replace(s.Message), escape.Replace(s.ProbeResult))
+	}
+	return b.String()
+}
+
+// CoverageHandler 通过HTTP提供覆盖率报告，默认返回JSON，
+// 请求参数format=markdown或Accept为text/markdown时返回Markdown。
+// 报告在每次请求时根据控制器的缓存计算
+type CoverageHandler struct {
+	mu     sync.RWMutex
+	report func(ctx context.Context) (*CoverageReport, error)
+}
+
+// NewCoverageHandler 创建CoverageHandler，ServiceReconciler启动前请求返回503
+func NewCoverageHandler() *CoverageHandler {
+	return &CoverageHandler{}
+}
+
+// setSource 设置计算报告的函数
+func (h *CoverageHandler) setSource(report func(ctx context.Context) (*CoverageReport, error)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.report = report
+}
+
+// ServeHTTP 计算并返回覆盖率报告
+func (h *CoverageHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.mu.RLock()
+	source := h.report
+	h.mu.RUnlock()
+	if source == nil {
+		http.Error(w, "controller is not started", http.StatusServiceUnavailable)
+		return
+	}
+	report, err := source(req.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if req.URL.Query().Get("format") == "markdown" || strings.Contains(req.Header.Get("Accept"), "text/markdown") {
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		_, _ = w.Write([]byte(report.Markdown()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// coverage 根据缓存中的Service和ServiceMonitor计算覆盖率报告。
+// 生成的和手动维护的ServiceMonitor都计入覆盖，没有被覆盖的Service按过滤规则、Monitored条件和最近一次Reconcile的状态给出原因
+func (r *ServiceReconciler) coverage(ctx context.Context) (*CoverageReport, error) {
+	services := &corev1.ServiceList{}
+	if err := r.List(ctx, services); err != nil {
+		return nil, fmt.Errorf("failed to list Services: %v", err)
+	}
+	smList := &monitoringv1.ServiceMonitorList{}
+	if err := r.List(ctx, smList); err != nil {
+		return nil, fmt.Errorf("failed to list ServiceMonitors: %v", err)
+	}
+
+	report := &CoverageReport{GeneratedAt: time.Now(), Unmonitored: []UnmonitoredService{}}
+	watched := map[string]bool{}
+	for i := range services.Items {
+		service := &services.Items[i]
+		if _, ok := watched[service.Namespace]; !ok {
+			ok, err := r.namespaces.watched(ctx, service.Namespace)
+			if err != nil {
+				return nil, err
+			}
+			watched[service.Namespace] = ok
+		}
+		if !watched[service.Namespace] {
+			continue
+		}
+		report.Services++
+		if r.scrapedByServiceMonitor(service, smList.Items) {
+			report.Monitored++
+			continue
+		}
+		report.Unmonitored = append(report.Unmonitored, r.unmonitoredService(service))
+	}
+
+	sort.Slice(report.Unmonitored, func(i, j int) bool {
+		a, b := report.Unmonitored[i], report.Unmonitored[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+	return report, nil
+}
+
+// scrapedByServiceMonitor 判断是否有ServiceMonitor的命名空间和标签选择器选中Service，并且至少拉取了它的一个端口
+func (r *ServiceReconciler) scrapedByServiceMonitor(service *corev1.Service, smList []*monitoringv1.ServiceMonitor) bool {
+	for _, sm := range smList {
+		namespaces := serviceMonitorNamespaces(sm)
+		if !contains(namespaces, indexAll) && !contains(namespaces, service.Namespace) {
+			continue
+		}
+		if !r.selectorMatchesService(&sm.Spec.Selector, service.Labels) {
+			continue
+		}
+		if len(coveredPorts(sm, service)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// unmonitoredService 返回Service没有被监控的原因。过滤规则根据当前配置计算；
+// 其余原因优先使用leader写入的Monitored条件，非侵入模式下没有条件时使用本副本记录的状态
+func (r *ServiceReconciler) unmonitoredService(service *corev1.Service) UnmonitoredService {
+	result := UnmonitoredService{
+		Namespace:   service.Namespace,
+		Name:        service.Name,
+		State:       stateUnmonitored,
+		Reason:      reasonNotReconciled,
+		Message:     "Service has not been reconciled yet",
+		ProbeResult: service.Annotations[lastProbeResultAnnotation],
+	}
+
+	cfg, _ := parseScrapeConfig(service, !r.Options.IgnoreLegacyAnnotations)
+	if reason, message := r.rules.skipReason(service, cfg); reason != "" {
+		result.State, result.Reason, result.Message = stateSkipped, reason, message
+		return result
+	}
+	if condition := meta.FindStatusCondition(service.Status.Conditions, monitoredCondition); condition != nil && condition.Status == metav1.ConditionFalse {
+		result.Reason, result.Message = condition.Reason, condition.Message
+		return result
+	}
+	if s, ok := serviceStates.get(client.ObjectKeyFromObject(service)); ok && s.state == stateUnmonitored {
+		result.Reason, result.Message = s.reason, ""
+	}
+	return result
+}
@@ -0,0 +1,110 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("coverage report", func() {
+	var (
+		r       *ServiceReconciler
+		handler *CoverageHandler
+	)
+
+	newService := func(namespace, name string, annotations map[string]string) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: map[string]string{"app": name}, Annotations: annotations},
+			Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "http", Port: 8080}}},
+		}
+	}
+
+	BeforeEach(func() {
+		scheme := runtime.NewScheme()
+		Expect(corev1.AddToScheme(scheme)).To(Succeed())
+		Expect(monitoringv1.AddToScheme(scheme)).To(Succeed())
+
+		conflicting := newService("demo", "conflicting", nil)
+		conflicting.Status.Conditions = []metav1.Condition{{
+			Type:    monitoredCondition,
+			Status:  metav1.ConditionFalse,
+			Reason:  reasonMonitorConflict,
+			Message: "ServiceMonitor name is taken",
+		}}
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			newService("demo", "api", nil),
+			newService("demo", "disabled", map[string]string{scrapeAnnotation: "false"}),
+			newService("demo", "unhealthy", map[string]string{lastProbeResultAnnotation: "http=Unreachable"}),
+			conflicting,
+			newService("kube-system", "kube-dns", nil),
+			&monitoringv1.ServiceMonitor{
+				ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "monitoring"},
+				Spec: monitoringv1.ServiceMonitorSpec{
+					Selector:          metav1.LabelSelector{MatchLabels: map[string]string{"app": "api"}},
+					NamespaceSelector: monitoringv1.NamespaceSelector{MatchNames: []string{"demo"}},
+					Endpoints:         []monitoringv1.Endpoint{{Port: "http"}},
+				},
+			},
+		).Build()
+
+		opts := DefaultOptions()
+		opts.IncludeNamespaces = []string{"demo"}
+		r = &ServiceReconciler{Client: c, Options: opts}
+		var err error
+		r.namespaces, err = opts.namespaceFilter(c)
+		Expect(err).NotTo(HaveOccurred())
+		r.rules, err = opts.compileRules()
+		Expect(err).NotTo(HaveOccurred())
+
+		unhealthy := types.NamespacedName{Namespace: "demo", Name: "unhealthy"}
+		serviceStates.set(unhealthy, stateUnmonitored, reasonMetricsUnreachable)
+		DeferCleanup(serviceStates.forget, unhealthy)
+
+		handler = NewCoverageHandler()
+		handler.setSource(r.coverage)
+	})
+
+	It("reports Services in watched namespaces no ServiceMonitor scrapes", func() {
+		report, err := r.coverage(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Services).To(Equal(4))
+		Expect(report.Monitored).To(Equal(1))
+		Expect(report.Unmonitored).To(Equal([]UnmonitoredService{
+			{Namespace: "demo", Name: "conflicting", State: stateUnmonitored, Reason: reasonMonitorConflict, Message: "ServiceMonitor name is taken"},
+			{Namespace: "demo", Name: "disabled", State: stateSkipped, Reason: skipReasonScrapeDisabled, Message: scrapeAnnotation + " annotation is false"},
+			{Namespace: "demo", Name: "unhealthy", State: stateUnmonitored, Reason: reasonMetricsUnreachable, ProbeResult: "http=Unreachable"},
+		}))
+	})
+
+	It("serves the report as JSON and Markdown", func() {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/coverage", nil))
+		Expect(recorder.Header().Get("Content-Type")).To(Equal("application/json"))
+		var report CoverageReport
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &report)).To(Succeed())
+		Expect(report.Unmonitored).To(HaveLen(3))
+
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/coverage?format=markdown", nil))
+		Expect(recorder.Body.String()).To(ContainSubstring("1 of 4 Services in watched namespaces are monitored"))
+		Expect(recorder.Body.String()).To(ContainSubstring("| demo | unhealthy | unmonitored | MetricsUnreachable |  | http=Unreachable |"))
+	})
+
+	It("is unavailable until the controller is set up", func() {
+		recorder := httptest.NewRecorder()
+		NewCoverageHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/coverage", nil))
+		Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+	})
+})
@@ -0,0 +1,231 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus/client_golang/prometheus"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// 计划执行的操作
+const (
+	actionCreate = "create"
+	actionUpdate = "update"
+	actionDelete = "delete"
+)
+
+// PlannedChange dry-run模式下控制器计划执行、但没有执行的一次写操作
+type PlannedChange struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Action    string `json:"action"`
+	// Service 触发该操作的Service，PodMonitor为工作负载（kind/namespace/name）
+	Service string `json:"service"`
+	// Diff 当前对象与期望对象中控制器负责的字段的差异
+	Diff      string    `json:"diff,omitempty"`
+	PlannedAt time.Time `json:"plannedAt"`
+}
+
+// DryRunReport 汇总dry-run模式下最近一次Reconcile计划执行的写操作。
+// 通过ServeHTTP以JSON的形式提供，并以servicemonitorscale_dry_run_planned_changes指标导出
+type DryRunReport struct {
+	mu      sync.Mutex
+	changes map[string]PlannedChange
+
+	desc *prometheus.Desc
+}
+
+// NewDryRunReport 创建DryRunReport，需要注册到指标Registry后才会导出指标
+func NewDryRunReport() *DryRunReport {
+	return &DryRunReport{
+		changes: make(map[string]PlannedChange),
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "dry_run_planned_changes"),
+			"Number of writes the controller would perform if dry-run mode was disabled.",
+			[]string{"kind", "action"}, nil),
+	}
+}
+
+func changeKey(kind string, obj types.NamespacedName) string {
+	return kind + "/" + obj.String()
+}
+
+// plan 记录一次计划执行的写操作，同一对象只保留最新的计划
+func (d *DryRunReport) plan(change PlannedChange) {
+	change.PlannedAt = time.Now()
+	log.Log.WithValues("kind", change.Kind, "object", change.Namespace+"/"+change.Name, "action", change.Action, "service", change.Service).
+		Info("Dry run: change planned, not applied\n" + change.Diff)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.changes[changeKey(change.Kind, types.NamespacedName{Namespace: change.Namespace, Name: change.Name})] = change
+}
+
+// resolve 对象已经是期望的状态，删除之前记录的计划
+func (d *DryRunReport) resolve(kind string, obj types.NamespacedName) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.changes, changeKey(kind, obj))
+}
+
+// Changes 返回按对象排序的计划写操作
+func (d *DryRunReport) Changes() []PlannedChange {
+	d.mu.Lock()
+	changes := make([]PlannedChange, 0, len(d.changes))
+	for _, change := range d.changes {
+		changes = append(changes, change)
+	}
+	d.mu.Unlock()
+
+	sort.Slice(changes, func(i, j int) bool {
+		a, b := changes[i], changes[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+	return changes
+}
+
+// ServeHTTP 以JSON的形式返回计划执行的写操作
+func (d *DryRunReport) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(d.Changes()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Describe 实现prometheus.Collector
+func (d *DryRunReport) Describe(ch chan<- *prometheus.Desc) {
+	ch <- d.desc
+}
+
+// Collect 实现prometheus.Collector
+func (d *DryRunReport) Collect(ch chan<- prometheus.Metric) {
+	counts := make(map[[2]string]int)
+	for _, change := range d.Changes() {
+		counts[[2]string{change.Kind, change.Action}]++
+	}
+	for key, n := range counts {
+		ch <- prometheus.MustNewConstMetric(d.desc, prometheus.GaugeValue, float64(n), key[0], key[1])
+	}
+}
+
+// managedServiceFields Service中控制器负责的字段，用于计算dry-run的差异
+type managedServiceFields struct {
+	Labels map[string]string
+	Ports  []corev1.ServicePort
+}
+
+// planServiceFields 记录Service发现标签和端口名称的变化，current和applied分别是apply前后的Service
+func (d *DryRunReport) planServiceFields(current, applied *corev1.Service) {
+	key := client.ObjectKeyFromObject(current)
+	diff := cmp.Diff(
+		managedServiceFields{Labels: current.Labels, Ports: current.Spec.Ports},
+		managedServiceFields{Labels: applied.Labels, Ports: applied.Spec.Ports})
+	if diff == "" {
+		d.resolve("Service", key)
+		return
+	}
+	d.plan(PlannedChange{
+		Kind:      "Service",
+		Namespace: key.Namespace,
+		Name:      key.Name,
+		Action:    actionUpdate,
+		Service:   key.String(),
+		Diff:      diff,
+	})
+}
+
+// managedMonitorFields ServiceMonitor和PodMonitor中控制器负责的字段，用于计算dry-run的差异
+type managedMonitorFields struct {
+	Labels map[string]string
+	Spec   interface{}
+}
+
+// planServiceMonitor 记录ServiceMonitor的创建或修改，current为空对象时表示创建，返回是否发生了变化
+func (d *DryRunReport) planServiceMonitor(service *corev1.Service, current, applied *monitoringv1.ServiceMonitor) bool {
+	return d.planObject(monitoringv1.ServiceMonitorsKind, client.ObjectKeyFromObject(applied),
+		client.ObjectKeyFromObject(service).String(), current.ResourceVersion == "",
+		managedMonitorFields{Labels: current.Labels, Spec: current.Spec},
+		managedMonitorFields{Labels: applied.Labels, Spec: applied.Spec})
+}
+
+// planObject 记录对象的创建或修改，current和applied为对象中控制器负责的字段，返回是否发生了变化
+func (d *DryRunReport) planObject(kind string, key types.NamespacedName, owner string, create bool, current, applied interface{}) bool {
+	diff := cmp.Diff(current, applied)
+	if diff == "" {
+		d.resolve(kind, key)
+		return false
+	}
+	action := actionUpdate
+	if create {
+		action = actionCreate
+	}
+	d.plan(PlannedChange{
+		Kind:      kind,
+		Namespace: key.Namespace,
+		Name:      key.Name,
+		Action:    action,
+		Service:   owner,
+		Diff:      diff,
+	})
+	return true
+}
+
+// planDelete 记录对象的删除，owner为生成该对象的Service或工作负载
+func (d *DryRunReport) planDelete(kind string, key types.NamespacedName, owner string) {
+	d.plan(PlannedChange{
+		Kind:      kind,
+		Namespace: key.Namespace,
+		Name:      key.Name,
+		Action:    actionDelete,
+		Service:   owner,
+	})
+}
+
+// dryRunRecorder dry-run模式下不创建Event，只记录日志
+type dryRunRecorder struct{}
+
+var _ record.EventRecorder = dryRunRecorder{}
+
+func (dryRunRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	log.Log.WithValues("object", objectRef(object), "type", eventtype, "reason", reason).Info("Dry run: event not recorded: " + message)
+}
+
+func (r dryRunRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.Event(object, eventtype, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (r dryRunRecorder) AnnotatedEventf(object runtime.Object, _ map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.Eventf(object, eventtype, reason, messageFmt, args...)
+}
+
+func objectRef(object runtime.Object) string {
+	if obj, ok := object.(interface {
+		GetNamespace() string
+		GetName() string
+	}); ok {
+		return obj.GetNamespace() + "/" + obj.GetName()
+	}
+	return ""
+}
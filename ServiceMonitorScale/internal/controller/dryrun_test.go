@@ -0,0 +1,66 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("DryRunReport", func() {
+	var (
+		report  *DryRunReport
+		service *corev1.Service
+		desired *monitoringv1.ServiceMonitor
+	)
+
+	BeforeEach(func() {
+		report = NewDryRunReport()
+		service = &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "demo", Name: "api"}}
+		desired = &monitoringv1.ServiceMonitor{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "monitoring", Name: "api", Labels: map[string]string{"app": "api"}},
+			Spec:       monitoringv1.ServiceMonitorSpec{Endpoints: []monitoringv1.Endpoint{{Port: "http"}}},
+		}
+	})
+
+	It("plans a create for a ServiceMonitor that does not exist", func() {
+		Expect(report.planServiceMonitor(service, &monitoringv1.ServiceMonitor{}, desired)).To(BeTrue())
+
+		changes := report.Changes()
+		Expect(changes).To(HaveLen(1))
+		Expect(changes[0].Action).To(Equal(actionCreate))
+		Expect(changes[0].Service).To(Equal("demo/api"))
+		Expect(changes[0].Diff).To(ContainSubstring("http"))
+	})
+
+	It("drops the plan once the ServiceMonitor is up to date", func() {
+		existing := desired.DeepCopy()
+		existing.ResourceVersion = "1"
+		existing.Spec.Endpoints[0].Interval = "30s"
+		Expect(report.planServiceMonitor(service, existing, desired)).To(BeTrue())
+		Expect(report.Changes()[0].Action).To(Equal(actionUpdate))
+
+		Expect(report.planServiceMonitor(service, desired.DeepCopy(), desired)).To(BeFalse())
+		Expect(report.Changes()).To(BeEmpty())
+	})
+
+	It("serves the planned changes as JSON", func() {
+		report.planDelete(monitoringv1.ServiceMonitorsKind, client.ObjectKeyFromObject(desired), "demo/api")
+
+		recorder := httptest.NewRecorder()
+		report.ServeHTTP(recorder, httptest.NewRequest("GET", "/dry-run", nil))
+
+		var changes []PlannedChange
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &changes)).To(Succeed())
+		Expect(changes).To(HaveLen(1))
+		Expect(changes[0].Kind).To(Equal(monitoringv1.ServiceMonitorsKind))
+		Expect(changes[0].Name).To(Equal("api"))
+		Expect(changes[0].Action).To(Equal(actionDelete))
+	})
+})
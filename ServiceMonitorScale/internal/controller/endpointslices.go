@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// maxProbedEndpoints 每个端口最多检查的后端地址数量
+const maxProbedEndpoints = 3
+
+// readyEndpoints 通过EndpointSlice解析Service各端口就绪的后端地址（ip:targetPort），
+// 与Prometheus一样直接访问Pod而不是Service的DNS名称。每个端口最多返回maxProbedEndpoints个地址
+func (r *ServiceReconciler) readyEndpoints(ctx context.Context, service *corev1.Service) (map[string][]string, error) {
+	sliceList := &discoveryv1.EndpointSliceList{}
+	if err := r.List(ctx, sliceList,
+		client.InNamespace(service.Namespace),
+		client.MatchingLabels{discoveryv1.LabelServiceName: service.Name},
+	); err != nil {
+		return nil, err
+	}
+
+	addresses := make(map[string]map[string]struct{})
+	for _, slice := range sliceList.Items {
+		for _, port := range slice.Ports {
+			if port.Port == nil {
+				continue
+			}
+			if port.Protocol != nil && *port.Protocol != corev1.ProtocolTCP {
+				continue
+			}
+			name := ""
+			if port.Name != nil {
+				name = *port.Name
+			}
+			for _, endpoint := range slice.Endpoints {
+				// Ready为空时按照约定视为就绪
+				if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+					continue
+				}
+				for _, ip := range endpoint.Addresses {
+					if addresses[name] == nil {
+						addresses[name] = make(map[string]struct{})
+					}
+					addresses[name][net.JoinHostPort(ip, strconv.Itoa(int(*port.Port)))] = struct{}{}
+				}
+			}
+		}
+	}
+
+	result := make(map[string][]string, len(addresses))
+	for name, set := range addresses {
+		list := make([]string, 0, len(set))
+		for address := range set {
+			list = append(list, address)
+		}
+		// 排序保证每次检查的是同一批地址，检查结果可以命中缓存
+		sort.Strings(list)
+		if len(list) > maxProbedEndpoints {
+			list = list[:maxProbedEndpoints]
+		}
+		result[name] = list
+	}
+	return result, nil
+}
+
+// endpointSliceToService 将EndpointSlice的变化映射为所属Service的reconcile请求
+func endpointSliceToService(_ context.Context, obj client.Object) []reconcile.Request {
+	serviceName := obj.GetLabels()[discoveryv1.LabelServiceName]
+	if serviceName == "" {
+		return nil
+	}
+	return []reconcile.Request{{
+		NamespacedName: types.NamespacedName{Namespace: obj.GetNamespace(), Name: serviceName},
+	}}
+}
@@ -0,0 +1,74 @@
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+var _ = Describe("EndpointSlices", func() {
+	It("resolves the ready pod addresses of each port", func() {
+		http, metrics, dns := "http", "metrics", "dns"
+		httpPort, metricsPort, dnsPort := int32(8080), int32(9090), int32(53)
+		udp := corev1.ProtocolUDP
+		ready, notReady := true, false
+		sliceLabels := map[string]string{discoveryv1.LabelServiceName: "api"}
+
+		scheme := runtime.NewScheme()
+		Expect(discoveryv1.AddToScheme(scheme)).To(Succeed())
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			&discoveryv1.EndpointSlice{
+				ObjectMeta:  metav1.ObjectMeta{Name: "api-1", Namespace: "demo", Labels: sliceLabels},
+				AddressType: discoveryv1.AddressTypeIPv4,
+				Endpoints: []discoveryv1.Endpoint{
+					{Addresses: []string{"10.0.0.4"}},
+					{Addresses: []string{"10.0.0.1"}, Conditions: discoveryv1.EndpointConditions{Ready: &ready}},
+					{Addresses: []string{"10.0.0.9"}, Conditions: discoveryv1.EndpointConditions{Ready: &notReady}},
+				},
+				Ports: []discoveryv1.EndpointPort{{Name: &http, Port: &httpPort}, {Name: &dns, Port: &dnsPort, Protocol: &udp}},
+			},
+			&discoveryv1.EndpointSlice{
+				ObjectMeta:  metav1.ObjectMeta{Name: "api-2", Namespace: "demo", Labels: sliceLabels},
+				AddressType: discoveryv1.AddressTypeIPv4,
+				Endpoints:   []discoveryv1.Endpoint{{Addresses: []string{"10.0.0.3", "10.0.0.2"}}},
+				Ports:       []discoveryv1.EndpointPort{{Name: &http, Port: &httpPort}, {Name: &metrics, Port: &metricsPort}},
+			},
+			&discoveryv1.EndpointSlice{
+				ObjectMeta:  metav1.ObjectMeta{Name: "web-1", Namespace: "demo", Labels: map[string]string{discoveryv1.LabelServiceName: "web"}},
+				AddressType: discoveryv1.AddressTypeIPv4,
+				Endpoints:   []discoveryv1.Endpoint{{Addresses: []string{"10.0.1.1"}}},
+				Ports:       []discoveryv1.EndpointPort{{Name: &http, Port: &httpPort}},
+			},
+		).Build()
+		r := &ServiceReconciler{Client: c}
+
+		service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "demo"}}
+		endpoints, err := r.readyEndpoints(context.Background(), service)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(endpoints).To(Equal(map[string][]string{
+			"http":    {"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080"},
+			"metrics": {"10.0.0.2:9090", "10.0.0.3:9090"},
+		}))
+	})
+
+	It("maps EndpointSlices to the Service they belong to", func() {
+		slice := &discoveryv1.EndpointSlice{ObjectMeta: metav1.ObjectMeta{
+			Name: "api-x1", Namespace: "demo", Labels: map[string]string{discoveryv1.LabelServiceName: "api"},
+		}}
+		Expect(endpointSliceToService(context.Background(), slice)).To(Equal([]reconcile.Request{
+			{NamespacedName: types.NamespacedName{Namespace: "demo", Name: "api"}},
+		}))
+
+		slice.Labels = nil
+		Expect(endpointSliceToService(context.Background(), slice)).To(BeEmpty())
+	})
+})
@@ -0,0 +1,249 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+const (
+	// acceptHeader 与Prometheus拉取时的内容协商保持一致，优先protobuf，其次OpenMetrics和文本格式
+	acceptHeader = expfmt.ProtoFmt + ` encoding=delimited;q=0.8,` +
+		expfmt.OpenMetricsType + `;version=` + expfmt.OpenMetricsVersion_1_0_0 + `;q=0.6,` +
+		expfmt.OpenMetricsType + `;version=` + expfmt.OpenMetricsVersion_0_0_1 + `;q=0.5,` +
+		`text/plain;version=` + expfmt.TextVersion + `;q=0.4,*/*;q=0.1`
+	// maxExpositionBytes 检查时最多读取的响应体大小
+	maxExpositionBytes = 16 << 20
+	// maxReportedFamilies 检查结果中记录的指标名称数量
+	maxReportedFamilies = 5
+)
+
+// exposition 解析metrics响应得到的摘要信息
+type exposition struct {
+	Format   string
+	Samples  int
+	Families []string
+	// Truncated 响应体超过maxExpositionBytes，只统计了前面部分的sample，Samples是实际数量的下限
+	Truncated bool
+}
+
+// parseExposition 按响应的Content-Type解析Prometheus文本格式、OpenMetrics或protobuf格式的metrics，
+// 无法解析或不包含任何样本时返回错误。响应体超过maxExpositionBytes时不解析，
+// 只统计截断前完整的sample，避免标签爆炸的端点被误判为格式错误
+func parseExposition(header http.Header, body io.Reader) (*exposition, error) {
+	mediatype, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	data, err := io.ReadAll(io.LimitReader(body, maxExpositionBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxExpositionBytes {
+		protobuf := mediatype != expfmt.OpenMetricsType && expfmt.ResponseFormat(header) == expfmt.FmtProtoDelim
+		return &exposition{
+			Format:    formatName(mediatype),
+			Samples:   truncatedSamples(data[:maxExpositionBytes], protobuf),
+			Truncated: true,
+		}, nil
+	}
+	body = bytes.NewReader(data)
+
+	var families map[string]*dto.MetricFamily
+	switch {
+	case mediatype == expfmt.OpenMetricsType:
+		families, err = parseOpenMetrics(body)
+	case expfmt.ResponseFormat(header) == expfmt.FmtProtoDelim:
+		families, err = parseProtoDelimited(body)
+	case mediatype == "" || mediatype == "text/plain":
+		var parser expfmt.TextParser
+		families, err = parser.TextToMetricFamilies(body)
+	default:
+		return nil, fmt.Errorf("unexpected content type %q", mediatype)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s metrics: %v", formatName(mediatype), err)
+	}
+
+	result := &exposition{Format: formatName(mediatype)}
+	for name, family := range families {
+		result.Samples += familySeries(family)
+		result.Families = append(result.Families, name)
+	}
+	if result.Samples == 0 {
+		return nil, errors.New("metrics endpoint exposes no samples")
+	}
+	sort.Strings(result.Families)
+	if len(result.Families) > maxReportedFamilies {
+		result.Families = result.Families[:maxReportedFamilies]
+	}
+	return result, nil
+}
+
+// familySeries 返回metric family拉取后得到的sample数量，与Prometheus的sampleLimit计数一致：
+// histogram为每个bucket（包括没有显式给出的+Inf）加上_sum和_count，summary为每个quantile加上_sum和_count
+func familySeries(family *dto.MetricFamily) int {
+	series := 0
+	for _, metric := range family.GetMetric() {
+		switch {
+		case metric.GetHistogram() != nil:
+			buckets := metric.GetHistogram().GetBucket()
+			series += len(buckets) + 2
+			if len(buckets) == 0 || !math.IsInf(buckets[len(buckets)-1].GetUpperBound(), +1) {
+				series++
+			}
+		case metric.GetSummary() != nil:
+			series += len(metric.GetSummary().GetQuantile()) + 2
+		default:
+			series++
+		}
+	}
+	return series
+}
+
+// truncatedSamples 统计被截断的响应体中完整的sample数量。文本格式和OpenMetrics中每个非注释行是一个sample，
+// 最后一行可能不完整；protobuf格式统计截断前可以完整解码的metric family
+func truncatedSamples(data []byte, protobuf bool) int {
+	if protobuf {
+		samples := 0
+		decoder := expfmt.NewDecoder(bytes.NewReader(data), expfmt.FmtProtoDelim)
+		for {
+			family := &dto.MetricFamily{}
+			if err := decoder.Decode(family); err != nil {
+				return samples
+			}
+			samples += familySeries(family)
+		}
+	}
+	i := bytes.LastIndexByte(data, '\n')
+	if i < 0 {
+		return 0
+	}
+	samples := 0
+	for _, line := range bytes.Split(data[:i], []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 && line[0] != '#' {
+			samples++
+		}
+	}
+	return samples
+}
+
+func parseProtoDelimited(body io.Reader) (map[string]*dto.MetricFamily, error) {
+	families := make(map[string]*dto.MetricFamily)
+	decoder := expfmt.NewDecoder(body, expfmt.FmtProtoDelim)
+	for {
+		family := &dto.MetricFamily{}
+		if err := decoder.Decode(family); err != nil {
+			if errors.Is(err, io.EOF) {
+				return families, nil
+			}
+			return nil, err
+		}
+		families[family.GetName()] = family
+	}
+}
+
+// parseOpenMetrics 将OpenMetrics转换为Prometheus文本格式后解析。
+// 去掉文本格式不支持的# EOF、# UNIT和exemplar，把秒为单位的时间戳转换为毫秒，并把文本格式没有的类型视为untyped
+func parseOpenMetrics(body io.Reader) (map[string]*dto.MetricFamily, error) {
+	var buf bytes.Buffer
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxExpositionBytes)
+	sawEOF := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "# EOF":
+			sawEOF = true
+			continue
+		case strings.HasPrefix(line, "# UNIT "):
+			continue
+		case strings.HasPrefix(line, "# TYPE "):
+			fields := strings.Fields(line)
+			if len(fields) == 4 {
+				switch fields[3] {
+				case "counter", "gauge", "histogram", "summary":
+				default:
+					line = strings.Join(fields[:3], " ") + " untyped"
+				}
+			}
+		case !strings.HasPrefix(line, "#"):
+			if i := strings.Index(line, " # {"); i >= 0 {
+				line = line[:i]
+			}
+			var err error
+			if line, err = openMetricsTimestampToMillis(line); err != nil {
+				return nil, err
+			}
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !sawEOF {
+		return nil, errors.New("missing # EOF")
+	}
+	var parser expfmt.TextParser
+	return parser.TextToMetricFamilies(&buf)
+}
+
+// openMetricsTimestampToMillis 把OpenMetrics样本中以秒为单位、可以带小数的时间戳转换为文本格式的毫秒整数
+func openMetricsTimestampToMillis(line string) (string, error) {
+	// 跳过标签，标签值中可能包含空格和转义的引号
+	start := 0
+	if i := strings.IndexByte(line, '{'); i >= 0 {
+		inQuotes, escaped := false, false
+		for j := i; j < len(line); j++ {
+			c := line[j]
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = inQuotes
+			case c == '"':
+				inQuotes = !inQuotes
+			case c == '}' && !inQuotes:
+				start = j + 1
+			}
+			if start > 0 {
+				break
+			}
+		}
+	}
+	fields := strings.Fields(line[start:])
+	if start == 0 && len(fields) > 0 {
+		// 没有标签时第一个字段是指标名称
+		fields = fields[1:]
+	}
+	if len(fields) != 2 {
+		return line, nil
+	}
+	seconds, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid timestamp %q", fields[1])
+	}
+	i := strings.LastIndex(line, fields[1])
+	return line[:i] + strconv.FormatInt(int64(math.Round(seconds*1000)), 10), nil
+}
+
+func formatName(mediatype string) string {
+	switch mediatype {
+	case expfmt.OpenMetricsType:
+		return "OpenMetrics"
+	case expfmt.ProtoType:
+		return "protobuf"
+	default:
+		return "Prometheus text"
+	}
+}
@@ -0,0 +1,122 @@
+package controller
+
+import (
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var _ = Describe("parseExposition", func() {
+	header := func(contentType string) http.Header {
+		h := http.Header{}
+		h.Set("Content-Type", contentType)
+		return h
+	}
+
+	It("parses Prometheus text format", func() {
+		body := "# TYPE http_requests_total counter\n" +
+			"http_requests_total{code=\"200\"} 10\n" +
+			"http_requests_total{code=\"500\"} 1\n" +
+			"up 1\n"
+		exp, err := parseExposition(header("text/plain; version=0.0.4"), strings.NewReader(body))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(exp.Samples).To(Equal(3))
+		Expect(exp.Families).To(Equal([]string{"http_requests_total", "up"}))
+	})
+
+	It("parses OpenMetrics", func() {
+		body := "# TYPE build info\n" +
+			"build_info{version=\"1.0\"} 1\n" +
+			"# TYPE requests counter\n" +
+			"requests_total 3 # {trace_id=\"abc\"} 1\n" +
+			"# EOF\n"
+		exp, err := parseExposition(header("application/openmetrics-text; version=1.0.0"), strings.NewReader(body))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(exp.Format).To(Equal("OpenMetrics"))
+		Expect(exp.Samples).To(Equal(2))
+	})
+
+	It("converts OpenMetrics timestamps in seconds to milliseconds", func() {
+		body := "# TYPE foo gauge\n" +
+			"foo 1 1700000000.123\n" +
+			"foo{path=\"/a b\",quote=\"\\\"}\"} 2 1700000001\n" +
+			"# EOF\n"
+		exp, err := parseExposition(header("application/openmetrics-text; version=1.0.0"), strings.NewReader(body))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(exp.Samples).To(Equal(2))
+
+		line, err := openMetricsTimestampToMillis(`foo{path="/a b"} 2 1700000001.5`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(line).To(Equal(`foo{path="/a b"} 2 1700000001500`))
+		line, err = openMetricsTimestampToMillis("foo 1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(line).To(Equal("foo 1"))
+		_, err = openMetricsTimestampToMillis("foo 1 yesterday")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("counts every series of histograms and summaries", func() {
+		text := "# TYPE latency histogram\n" +
+			"latency_bucket{le=\"0.1\"} 1\n" +
+			"latency_bucket{le=\"1\"} 3\n" +
+			"latency_bucket{le=\"+Inf\"} 4\n" +
+			"latency_sum 2.5\n" +
+			"latency_count 4\n" +
+			"# TYPE rpc summary\n" +
+			"rpc{quantile=\"0.5\"} 0.2\n" +
+			"rpc{quantile=\"0.99\"} 0.9\n" +
+			"rpc_sum 12\n" +
+			"rpc_count 30\n" +
+			"# TYPE up gauge\n" +
+			"up 1\n"
+		exp, err := parseExposition(header("text/plain; version=0.0.4"), strings.NewReader(text))
+		Expect(err).NotTo(HaveOccurred())
+		// histogram 3个bucket+_sum+_count，summary 2个quantile+_sum+_count，gauge 1个
+		Expect(exp.Samples).To(Equal(5 + 4 + 1))
+
+		exp, err = parseExposition(header("application/openmetrics-text; version=1.0.0"), strings.NewReader(text+"# EOF\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(exp.Samples).To(Equal(5 + 4 + 1))
+	})
+
+	It("counts the implicit +Inf bucket of histograms", func() {
+		upperBound := func(v float64) *float64 { return &v }
+		family := &dto.MetricFamily{Metric: []*dto.Metric{{Histogram: &dto.Histogram{Bucket: []*dto.Bucket{
+			{UpperBound: upperBound(0.1)},
+			{UpperBound: upperBound(1)},
+		}}}}}
+		Expect(familySeries(family)).To(Equal(2 + 1 + 2))
+	})
+
+	It("rejects OpenMetrics without # EOF", func() {
+		_, err := parseExposition(header("application/openmetrics-text"), strings.NewReader("up 1\n"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("rejects HTML pages", func() {
+		_, err := parseExposition(header("text/html"), strings.NewReader("<html></html>"))
+		Expect(err).To(MatchError(ContainSubstring("unexpected content type")))
+
+		_, err = parseExposition(header("text/plain"), strings.NewReader("<!DOCTYPE html>\n"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("counts the complete lines of bodies larger than the read limit", func() {
+		line := "http_requests_total{path=\"/" + strings.Repeat("a", 1000) + "\"} 1\n"
+		lines := maxExpositionBytes/len(line) + 10
+		body := "# TYPE http_requests_total counter\n" + strings.Repeat(line, lines)
+		exp, err := parseExposition(header("text/plain; version=0.0.4"), strings.NewReader(body))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(exp.Truncated).To(BeTrue())
+		Expect(exp.Samples).To(BeNumerically(">", lines-20))
+		Expect(exp.Samples).To(BeNumerically("<", lines))
+	})
+
+	It("rejects empty payloads", func() {
+		_, err := parseExposition(header("text/plain"), strings.NewReader(""))
+		Expect(err).To(MatchError(ContainSubstring("no samples")))
+	})
+})
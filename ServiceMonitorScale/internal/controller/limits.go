@@ -0,0 +1,129 @@
+package controller
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// ScrapeLimits 写入生成的ServiceMonitor和PodMonitor的拉取限制，超过限制的拉取会被Prometheus拒绝。
+// 未设置的字段不限制，设置为0表示不限制
+//
+//	limits:
+//	  sampleLimit: 50000
+//	  targetLimit: 100
+//	  labelLimit: 60
+//	  bodySizeLimit: 10MB
+type ScrapeLimits struct {
+	// SampleLimit 每个target在metric relabeling之后的sample数量上限
+	SampleLimit *uint64 `json:"sampleLimit,omitempty"`
+	// TargetLimit 每个ServiceMonitor或PodMonitor的target数量上限
+	TargetLimit *uint64 `json:"targetLimit,omitempty"`
+	// LabelLimit 每个sample的标签数量上限
+	LabelLimit *uint64 `json:"labelLimit,omitempty"`
+	// BodySizeLimit 每次拉取的未压缩响应体大小上限，例如10MB
+	BodySizeLimit *monitoringv1.ByteSize `json:"bodySizeLimit,omitempty"`
+}
+
+// byteSizePattern 与PodMonitor和ServiceMonitor CRD中bodySizeLimit的校验规则一致
+var byteSizePattern = regexp.MustCompile(`^(0|([0-9]*[.])?[0-9]+((K|M|G|T|E|P)i?)?B)$`)
+
+// scrapeLimits 返回适用于命名空间的拉取限制，NamespaceLimits中设置的字段覆盖Limits
+func (o Options) scrapeLimits(namespace string) ScrapeLimits {
+	limits := o.Limits
+	override, ok := o.NamespaceLimits[namespace]
+	if !ok {
+		return limits
+	}
+	if override.SampleLimit != nil {
+		limits.SampleLimit = override.SampleLimit
+	}
+	if override.TargetLimit != nil {
+		limits.TargetLimit = override.TargetLimit
+	}
+	if override.LabelLimit != nil {
+		limits.LabelLimit = override.LabelLimit
+	}
+	if override.BodySizeLimit != nil {
+		limits.BodySizeLimit = override.BodySizeLimit
+	}
+	return limits
+}
+
+// validateLimits 校验所有拉取限制中的bodySizeLimit
+func (o Options) validateLimits() error {
+	namespaces := make([]string, 0, len(o.NamespaceLimits))
+	for namespace := range o.NamespaceLimits {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	validate := func(field string, limits ScrapeLimits) error {
+		if limits.BodySizeLimit != nil && !byteSizePattern.MatchString(string(*limits.BodySizeLimit)) {
+			return fmt.Errorf("invalid %s.bodySizeLimit %q", field, *limits.BodySizeLimit)
+		}
+		return nil
+	}
+	if err := validate("limits", o.Limits); err != nil {
+		return err
+	}
+	for _, namespace := range namespaces {
+		if err := validate("namespaceLimits."+namespace, o.NamespaceLimits[namespace]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// overSampleLimit 判断暴露的sample数量是否超过sampleLimit，未设置或为0时不限制
+func (l ScrapeLimits) overSampleLimit(samples int) bool {
+	return l.SampleLimit != nil && *l.SampleLimit > 0 && uint64(samples) > *l.SampleLimit
+}
+
+// exceedsSampleLimit 判断检查结果是否超过sampleLimit。响应体被截断时只统计了部分sample，
+// 设置了sampleLimit时同样视为超过限制
+func (l ScrapeLimits) exceedsSampleLimit(result ProbeResult) bool {
+	if result.Truncated {
+		return l.SampleLimit != nil && *l.SampleLimit > 0
+	}
+	return l.overSampleLimit(result.Samples)
+}
+
+// sampleLimitMessage 返回端口超过sampleLimit时事件的内容，truncated表示响应体被截断，samples只是下限
+func (l ScrapeLimits) sampleLimitMessage(port string, samples int, truncated bool) string {
+	if truncated {
+		return fmt.Sprintf("Port %s exposes at least %d samples in a response larger than %d bytes, more than the sample limit %d; the port is not scraped", port, samples, maxExpositionBytes, *l.SampleLimit)
+	}
+	return fmt.Sprintf("Port %s exposes %d samples, more than the sample limit %d; the port is not scraped", port, samples, *l.SampleLimit)
+}
+
+// applyToServiceMonitor 把拉取限制写入ServiceMonitor
+func (l ScrapeLimits) applyToServiceMonitor(spec *monitoringv1.ServiceMonitorSpec) {
+	spec.SampleLimit = l.SampleLimit
+	spec.TargetLimit = l.TargetLimit
+	spec.LabelLimit = l.LabelLimit
+	spec.BodySizeLimit = l.BodySizeLimit
+}
+
+// applyToPodMonitor 把拉取限制写入PodMonitor
+func (l ScrapeLimits) applyToPodMonitor(spec *monitoringv1.PodMonitorSpec) {
+	spec.SampleLimit = l.SampleLimit
+	spec.TargetLimit = l.TargetLimit
+	spec.LabelLimit = l.LabelLimit
+	spec.BodySizeLimit = l.BodySizeLimit
+}
+
+// forgetSampleLimit 删除Service各端口超过sampleLimit的记录
+func forgetSampleLimit(service types.NamespacedName) {
+	sampleLimitExceeded.DeletePartialMatch(prometheus.Labels{"namespace": service.Namespace, "service": service.Name})
+}
+
+// forgetWorkloadSampleLimit 删除工作负载各端口超过sampleLimit的记录
+func forgetWorkloadSampleLimit(kind string, workload types.NamespacedName) {
+	workloadSampleLimitExceeded.DeletePartialMatch(prometheus.Labels{"namespace": workload.Namespace, "kind": kind, "workload": workload.Name})
+}
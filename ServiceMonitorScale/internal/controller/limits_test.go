@@ -0,0 +1,169 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// limit 返回指向limit的指针
+func limit(n uint64) *uint64 {
+	return &n
+}
+
+var _ = Describe("scrape limits", func() {
+	var (
+		opts    Options
+		service *corev1.Service
+	)
+
+	BeforeEach(func() {
+		opts = DefaultOptions()
+		bodySize := monitoringv1.ByteSize("10MB")
+		opts.Limits = ScrapeLimits{SampleLimit: limit(1000), LabelLimit: limit(60), BodySizeLimit: &bodySize}
+		opts.NamespaceLimits = map[string]ScrapeLimits{"batch": {SampleLimit: limit(0), TargetLimit: limit(10)}}
+		service = &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "demo", Labels: map[string]string{"app": "api"}},
+			Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "http", Port: 8080}}},
+		}
+	})
+
+	It("writes the limits of the namespace into the ServiceMonitor", func() {
+		Expect(opts.Validate()).To(Succeed())
+		plan, err := opts.PlanService(service)
+		Expect(err).NotTo(HaveOccurred())
+		spec := plan.ServiceMonitor.Spec
+		Expect(*spec.SampleLimit).To(BeEquivalentTo(1000))
+		Expect(spec.TargetLimit).To(BeNil())
+		Expect(*spec.LabelLimit).To(BeEquivalentTo(60))
+		Expect(string(*spec.BodySizeLimit)).To(Equal("10MB"))
+
+		limits := opts.scrapeLimits("batch")
+		Expect(*limits.SampleLimit).To(BeEquivalentTo(0))
+		Expect(*limits.TargetLimit).To(BeEquivalentTo(10))
+		Expect(*limits.LabelLimit).To(BeEquivalentTo(60))
+		Expect(limits.overSampleLimit(1 << 20)).To(BeFalse())
+		Expect(limits.exceedsSampleLimit(ProbeResult{Healthy: true, Samples: 10, Truncated: true})).To(BeFalse())
+		Expect(opts.scrapeLimits("demo").exceedsSampleLimit(ProbeResult{Healthy: true, Samples: 10, Truncated: true})).To(BeTrue())
+	})
+
+	It("rejects an invalid body size limit", func() {
+		bodySize := monitoringv1.ByteSize("10 megabytes")
+		opts.NamespaceLimits["batch"] = ScrapeLimits{BodySizeLimit: &bodySize}
+		Expect(opts.Validate()).NotTo(Succeed())
+	})
+
+	It("does not scrape ports exposing more samples than the sample limit", func() {
+		portName, port := "http", int32(8080)
+		scheme := runtime.NewScheme()
+		Expect(discoveryv1.AddToScheme(scheme)).To(Succeed())
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&discoveryv1.EndpointSlice{
+			ObjectMeta:  metav1.ObjectMeta{Name: "api-1", Namespace: "demo", Labels: map[string]string{discoveryv1.LabelServiceName: "api"}},
+			AddressType: discoveryv1.AddressTypeIPv4,
+			Endpoints:   []discoveryv1.Endpoint{{Addresses: []string{"10.0.0.1"}}},
+			Ports:       []discoveryv1.EndpointPort{{Name: &portName, Port: &port}},
+		}).Build()
+		probes := NewProbeWorkerPool(nil, 0, time.Minute)
+		r := &ServiceReconciler{Client: c, Options: opts, Probes: probes, Recorder: record.NewFakeRecorder(10)}
+		DeferCleanup(forgetSampleLimit, client.ObjectKeyFromObject(service))
+
+		cfg, _ := parseScrapeConfig(service, false)
+		target := ProbeTarget{URL: "http://10.0.0.1:8080/metrics", Namespace: "demo"}
+		probes.results[target.key()] = ProbeResult{Healthy: true, Samples: 5000, CheckedAt: time.Now()}
+
+		status, err := r.checkMetricsEndpoint(context.Background(), service, cfg, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(status.healthyPorts).To(BeEmpty())
+		Expect(status.reason()).To(Equal(reasonSampleLimitExceeded))
+		Expect(status.result()).To(Equal("http=SampleLimitExceeded"))
+		Expect(testutil.ToFloat64(sampleLimitExceeded.WithLabelValues("demo", "api", "http"))).To(BeEquivalentTo(5000))
+		Expect(r.Recorder.(*record.FakeRecorder).Events).To(Receive(ContainSubstring(reasonSampleLimitExceeded)))
+
+		probes.results[target.key()] = ProbeResult{Healthy: true, Samples: 500, CheckedAt: time.Now()}
+		status, err = r.checkMetricsEndpoint(context.Background(), service, cfg, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(status.healthyPorts).To(HaveLen(1))
+		Expect(testutil.CollectAndCount(sampleLimitExceeded)).To(BeZero())
+	})
+
+	It("removes a port from an existing ServiceMonitor once it exceeds the sample limit", func() {
+		ctx := context.Background()
+		http, admin := "http", "admin"
+		httpPort, adminPort := int32(8080), int32(9090)
+		service.Spec.Ports = []corev1.ServicePort{{Name: http, Port: httpPort}, {Name: admin, Port: adminPort}}
+		scheme := runtime.NewScheme()
+		Expect(corev1.AddToScheme(scheme)).To(Succeed())
+		Expect(discoveryv1.AddToScheme(scheme)).To(Succeed())
+		Expect(monitoringv1.AddToScheme(scheme)).To(Succeed())
+		c := withApply(fake.NewClientBuilder().WithScheme(scheme)).
+			WithIndex(&monitoringv1.ServiceMonitor{}, serviceMonitorNamespaceIndex, serviceMonitorNamespaces).
+			WithIndex(&monitoringv1.ServiceMonitor{}, serviceMonitorSelectorIndex, serviceMonitorSelectorKeys).
+			WithObjects(service, &discoveryv1.EndpointSlice{
+				ObjectMeta:  metav1.ObjectMeta{Name: "api-1", Namespace: "demo", Labels: map[string]string{discoveryv1.LabelServiceName: "api"}},
+				AddressType: discoveryv1.AddressTypeIPv4,
+				Endpoints:   []discoveryv1.Endpoint{{Addresses: []string{"10.0.0.1"}}, {Addresses: []string{"10.0.0.2"}}},
+				Ports:       []discoveryv1.EndpointPort{{Name: &http, Port: &httpPort}, {Name: &admin, Port: &adminPort}},
+			}).Build()
+		probes := NewProbeWorkerPool(nil, 0, time.Minute)
+		recorder := record.NewFakeRecorder(20)
+		opts.NonInvasive = true
+		r := &ServiceReconciler{Client: c, Options: opts, Probes: probes, Recorder: recorder}
+		DeferCleanup(forgetSampleLimit, client.ObjectKeyFromObject(service))
+		DeferCleanup(serviceStates.forget, client.ObjectKeyFromObject(service))
+
+		probe := func(address string, samples int) {
+			target := ProbeTarget{URL: "http://" + address + "/metrics", Namespace: "demo"}
+			probes.results[target.key()] = ProbeResult{Healthy: true, Samples: samples, CheckedAt: time.Now()}
+		}
+		cfg, _ := parseScrapeConfig(service, false)
+		key := client.ObjectKey{Namespace: opts.MonitorNamespace, Name: "demo-api"}
+		ports := func() []string {
+			sm := &monitoringv1.ServiceMonitor{}
+			Expect(c.Get(ctx, key, sm)).To(Succeed())
+			var names []string
+			for _, ep := range sm.Spec.Endpoints {
+				names = append(names, ep.Port)
+			}
+			return names
+		}
+
+		for _, address := range []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.1:9090", "10.0.0.2:9090"} {
+			probe(address, 100)
+		}
+		_, err := r.createOrUpdateServiceMonitor(ctx, service, cfg)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ports()).To(Equal([]string{"http", "admin"}))
+
+		// 一个后端超过限制时，即使另一个后端健康，端口也不再被拉取
+		probe("10.0.0.2:9090", 5000)
+		_, err = r.createOrUpdateServiceMonitor(ctx, service, cfg)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ports()).To(Equal([]string{"http"}))
+		var events []string
+		for len(recorder.Events) > 0 {
+			events = append(events, <-recorder.Events)
+		}
+		Expect(events).To(ContainElement(ContainSubstring("Port admin exposes 5000 samples")))
+
+		probe("10.0.0.1:8080", 5000)
+		_, err = r.createOrUpdateServiceMonitor(ctx, service, cfg)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(apierrors.IsNotFound(c.Get(ctx, key, &monitoringv1.ServiceMonitor{}))).To(BeTrue())
+		state, _ := serviceStates.get(client.ObjectKeyFromObject(service))
+		Expect(state.reason).To(Equal(reasonSampleLimitExceeded))
+	})
+})
@@ -0,0 +1,199 @@
+package controller
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const metricsNamespace = "servicemonitorscale"
+
+// ServiceMonitor和PodMonitor的操作
+const (
+	operationCreated = "created"
+	operationUpdated = "updated"
+	operationDeleted = "deleted"
+)
+
+// Service的监控状态
+const (
+	stateMonitored   = "monitored"
+	stateUnmonitored = "unmonitored"
+	stateSkipped     = "skipped"
+)
+
+var (
+	probesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "probes_total",
+		Help:      "Number of metrics endpoint probes, by namespace of the Service or workload.",
+	}, []string{"namespace"})
+
+	probeFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "probe_failures_total",
+		Help:      "Number of metrics endpoint probes that found the endpoint unhealthy, by namespace of the Service or workload.",
+	}, []string{"namespace"})
+
+	probeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "probe_duration_seconds",
+		Help:      "Duration of metrics endpoint probes, by result.",
+		// 5ms到约10s，覆盖probeTimeout
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"result"})
+
+	serviceMonitorOperationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "servicemonitor_operations_total",
+		Help:      "Number of generated ServiceMonitors created, updated and deleted.",
+	}, []string{"operation"})
+
+	podMonitorOperationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "podmonitor_operations_total",
+		Help:      "Number of generated PodMonitors created, updated and deleted.",
+	}, []string{"operation"})
+
+	// sampleLimitExceeded 只包含检查时暴露的sample数量超过sampleLimit的Service端口，值为暴露的sample数量
+	sampleLimitExceeded = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "sample_limit_exceeded",
+		Help:      "Samples exposed by Service ports above the sample limit. These ports are not scraped.",
+	}, []string{"namespace", "service", "port"})
+
+	// workloadSampleLimitExceeded 与sampleLimitExceeded相同，只包含超过sampleLimit的工作负载容器端口
+	workloadSampleLimitExceeded = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "workload_sample_limit_exceeded",
+		Help:      "Samples exposed by workload container ports above the sample limit. These ports are not scraped.",
+	}, []string{"namespace", "kind", "workload", "port"})
+
+	serviceStates = newServiceStateCollector()
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		probesTotal,
+		probeFailuresTotal,
+		probeDuration,
+		serviceMonitorOperationsTotal,
+		podMonitorOperationsTotal,
+		sampleLimitExceeded,
+		workloadSampleLimitExceeded,
+		serviceStates,
+	)
+}
+
+// observeProbe 记录一次检查的结果
+func observeProbe(target ProbeTarget, result ProbeResult) {
+	probesTotal.WithLabelValues(target.Namespace).Inc()
+	outcome := portHealthy
+	switch {
+	case result.InvalidFormat:
+		outcome = portInvalidFormat
+	case !result.Healthy:
+		outcome = portUnreachable
+	}
+	if !result.Healthy {
+		probeFailuresTotal.WithLabelValues(target.Namespace).Inc()
+	}
+	probeDuration.WithLabelValues(outcome).Observe(result.Duration.Seconds())
+}
+
+// serviceState 最近一次Reconcile得到的Service监控状态
+type serviceState struct {
+	state  string
+	reason string
+}
+
+// serviceStateCollector 记录每个Service当前的监控状态，采集时汇总为各状态的Service数量，
+// 用于发现没有被监控的Service
+type serviceStateCollector struct {
+	mu     sync.Mutex
+	states map[types.NamespacedName]serviceState
+
+	monitored   *prometheus.Desc
+	unmonitored *prometheus.Desc
+	skipped     *prometheus.Desc
+}
+
+func newServiceStateCollector() *serviceStateCollector {
+	return &serviceStateCollector{
+		states: make(map[types.NamespacedName]serviceState),
+		monitored: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "services_monitored"),
+			"Number of Services monitored by a generated ServiceMonitor.",
+			[]string{"namespace"}, nil),
+		unmonitored: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "services_unmonitored"),
+			"Number of Services that should be monitored but have no ServiceMonitor, by reason.",
+			[]string{"namespace", "reason"}, nil),
+		skipped: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "services_skipped"),
+			"Number of Services in watched namespaces skipped by annotations or filtering rules, by reason.",
+			[]string{"reason"}, nil),
+	}
+}
+
+// set 记录Service的监控状态
+func (c *serviceStateCollector) set(service types.NamespacedName, state, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.states[service] = serviceState{state: state, reason: reason}
+}
+
+// get 返回Service最近一次记录的监控状态
+func (c *serviceStateCollector) get(service types.NamespacedName) (serviceState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.states[service]
+	return s, ok
+}
+
+// forget 删除已删除或不再被处理的Service的状态
+func (c *serviceStateCollector) forget(service types.NamespacedName) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.states, service)
+}
+
+// Describe 实现prometheus.Collector
+func (c *serviceStateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.monitored
+	ch <- c.unmonitored
+	ch <- c.skipped
+}
+
+// Collect 实现prometheus.Collector
+func (c *serviceStateCollector) Collect(ch chan<- prometheus.Metric) {
+	monitored := make(map[string]int)
+	unmonitored := make(map[[2]string]int)
+	skipped := make(map[string]int)
+
+	c.mu.Lock()
+	for service, s := range c.states {
+		switch s.state {
+		case stateMonitored:
+			monitored[service.Namespace]++
+		case stateUnmonitored:
+			unmonitored[[2]string{service.Namespace, s.reason}]++
+		case stateSkipped:
+			skipped[s.reason]++
+		}
+	}
+	c.mu.Unlock()
+
+	for namespace, n := range monitored {
+		ch <- prometheus.MustNewConstMetric(c.monitored, prometheus.GaugeValue, float64(n), namespace)
+	}
+	for key, n := range unmonitored {
+		ch <- prometheus.MustNewConstMetric(c.unmonitored, prometheus.GaugeValue, float64(n), key[0], key[1])
+	}
+	for reason, n := range skipped {
+		ch <- prometheus.MustNewConstMetric(c.skipped, prometheus.GaugeValue, float64(n), reason)
+	}
+}
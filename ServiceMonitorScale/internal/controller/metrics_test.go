@@ -0,0 +1,35 @@
+package controller
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var _ = Describe("serviceStateCollector", func() {
+	It("counts Services by state", func() {
+		c := newServiceStateCollector()
+		c.set(types.NamespacedName{Namespace: "demo", Name: "api"}, stateMonitored, "")
+		c.set(types.NamespacedName{Namespace: "demo", Name: "web"}, stateUnmonitored, reasonMetricsUnreachable)
+		c.set(types.NamespacedName{Namespace: "demo", Name: "db"}, stateSkipped, skipReasonNotOptedIn)
+		c.set(types.NamespacedName{Namespace: "other", Name: "db"}, stateSkipped, skipReasonNotOptedIn)
+		c.forget(types.NamespacedName{Namespace: "other", Name: "db"})
+
+		expected := `
+# HELP servicemonitorscale_services_monitored Number of Services monitored by a generated ServiceMonitor.
+# TYPE servicemonitorscale_services_monitored gauge
+servicemonitorscale_services_monitored{namespace="demo"} 1
+# HELP servicemonitorscale_services_skipped Number of Services in watched namespaces skipped by annotations or filtering rules, by reason.
+# TYPE servicemonitorscale_services_skipped gauge
+servicemonitorscale_services_skipped{reason="NotOptedIn"} 1
+# HELP servicemonitorscale_services_unmonitored Number of Services that should be monitored but have no ServiceMonitor, by reason.
+# TYPE servicemonitorscale_services_unmonitored gauge
+servicemonitorscale_services_unmonitored{namespace="demo",reason="MetricsUnreachable"} 1
+`
+		Expect(testutil.CollectAndCompare(c, strings.NewReader(expected))).To(Succeed())
+	})
+})
@@ -0,0 +1,113 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// namespaceFilter 按Options选择需要处理的命名空间，由ServiceReconciler和PodMonitorReconciler共用
+type namespaceFilter struct {
+	reader   client.Reader
+	include  []string
+	exclude  []string
+	selector labels.Selector
+}
+
+// namespaceFilter 解析Options中的命名空间选择配置
+func (o Options) namespaceFilter(reader client.Reader) (*namespaceFilter, error) {
+	selector, err := o.parseNamespaceSelector()
+	if err != nil {
+		return nil, err
+	}
+	return &namespaceFilter{
+		reader:   reader,
+		include:  o.IncludeNamespaces,
+		exclude:  o.ExcludeNamespaces,
+		selector: selector,
+	}, nil
+}
+
+// watched 判断命名空间中的对象是否需要处理：
+// 在ExcludeNamespaces中的不处理，在IncludeNamespaces中的处理，其余按命名空间标签是否匹配NamespaceSelector判断。
+// 命名空间不存在时不处理；读取命名空间失败时返回错误，调用方不能据此删除已生成的监控对象
+func (f *namespaceFilter) watched(ctx context.Context, namespace string) (bool, error) {
+	if contains(f.exclude, namespace) {
+		return false, nil
+	}
+	if contains(f.include, namespace) {
+		return true, nil
+	}
+	ns := &corev1.Namespace{}
+	if err := f.reader.Get(ctx, types.NamespacedName{Name: namespace}, ns); err != nil {
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to get Namespace %s: %v", namespace, err)
+	}
+	return f.selector.Matches(labels.Set(ns.Labels)), nil
+}
+
+// unwatched 判断命名空间是否确定不再被选中，用于启动时清理监控对象。读取命名空间失败时记录日志并返回false
+func (f *namespaceFilter) unwatched(ctx context.Context, namespace string) bool {
+	watched, err := f.watched(ctx, namespace)
+	if err != nil {
+		log.Log.Error(err, "failed to check whether the Namespace is watched", "namespace", namespace)
+		return false
+	}
+	return !watched
+}
+
+// predicate 只处理被选中命名空间中的对象。删除事件总是放行，
+// 以便命名空间不再被选中后删除的对象也能清理生成的监控对象
+func (f *namespaceFilter) predicate() predicate.Predicate {
+	watched := func(obj client.Object) bool {
+		ok, err := f.watched(context.Background(), obj.GetNamespace())
+		if err != nil {
+			// 交给Reconcile返回错误并重试
+			log.Log.Error(err, "failed to check whether the Namespace is watched", "namespace", obj.GetNamespace())
+			return true
+		}
+		return ok
+	}
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return watched(e.Object)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return watched(e.ObjectNew)
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return true
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			return watched(e.Object)
+		},
+	}
+}
+
+// namespaceToServices 命名空间创建或标签变化时，将其中所有Service加入队列。
+// 新选中的命名空间会立即生成ServiceMonitor，不再选中的命名空间会清理已生成的ServiceMonitor
+func (r *ServiceReconciler) namespaceToServices(ctx context.Context, obj client.Object) []reconcile.Request {
+	serviceList := &corev1.ServiceList{}
+	if err := r.List(ctx, serviceList, client.InNamespace(obj.GetName())); err != nil {
+		log.Log.Error(err, "failed to list Services", "namespace", obj.GetName())
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(serviceList.Items))
+	for _, service := range serviceList.Items {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Namespace: service.Namespace, Name: service.Name},
+		})
+	}
+	return requests
+}
@@ -0,0 +1,98 @@
+package controller
+
+import (
+	"context"
+	"errors"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+var _ = Describe("namespace selection", func() {
+	var scheme *runtime.Scheme
+
+	namespace := func(name string, nsLabels map[string]string) *corev1.Namespace {
+		return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: nsLabels}}
+	}
+	enabled := map[string]string{"servicemonitorscale.tal.com/enabled": "true"}
+
+	BeforeEach(func() {
+		scheme = runtime.NewScheme()
+		Expect(corev1.AddToScheme(scheme)).To(Succeed())
+		Expect(monitoringv1.AddToScheme(scheme)).To(Succeed())
+	})
+
+	It("excludes before it includes and selects by labels last", func() {
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			namespace("labeled", enabled),
+			namespace("unlabeled", nil),
+			namespace("kube-system", enabled),
+			namespace("legacy", nil),
+		).Build()
+		opts := DefaultOptions()
+		opts.IncludeNamespaces = []string{"legacy", "kube-system"}
+		filter, err := opts.namespaceFilter(c)
+		Expect(err).NotTo(HaveOccurred())
+
+		for name, expected := range map[string]bool{
+			"labeled":     true,
+			"unlabeled":   false,
+			"kube-system": false,
+			"legacy":      true,
+			"missing":     false,
+		} {
+			watched, err := filter.watched(context.Background(), name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(watched).To(Equal(expected), name)
+		}
+
+		opts.NamespaceSelector = ""
+		filter, err = opts.namespaceFilter(c)
+		Expect(err).NotTo(HaveOccurred())
+		watched, err := filter.watched(context.Background(), "labeled")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(watched).To(BeFalse())
+	})
+
+	It("keeps the generated monitors when the Namespace cannot be read", func() {
+		owner := types.NamespacedName{Namespace: "demo", Name: "api"}
+		sm := &monitoringv1.ServiceMonitor{ObjectMeta: metav1.ObjectMeta{Name: "demo-api", Namespace: "default", Labels: ownerLabels(owner)}}
+		c := fake.NewClientBuilder().WithScheme(scheme).
+			WithObjects(
+				namespace("demo", enabled),
+				&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "demo"}},
+				sm,
+			).
+			WithInterceptorFuncs(interceptor.Funcs{
+				Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+					if _, ok := obj.(*corev1.Namespace); ok {
+						return errors.New("etcdserver: request timed out")
+					}
+					return c.Get(ctx, key, obj, opts...)
+				},
+			}).Build()
+		filter, err := DefaultOptions().namespaceFilter(c)
+		Expect(err).NotTo(HaveOccurred())
+		r := &ServiceReconciler{Client: c, Options: DefaultOptions(), Recorder: record.NewFakeRecorder(10), namespaces: filter}
+
+		_, err = r.Reconcile(context.Background(), ctrl.Request{NamespacedName: owner})
+		Expect(err).To(MatchError(ContainSubstring("request timed out")))
+		Expect(c.Get(context.Background(), client.ObjectKeyFromObject(sm), &monitoringv1.ServiceMonitor{})).To(Succeed())
+
+		// 无法判断时放行事件，由Reconcile返回错误重试
+		Expect(filter.predicate().Create(event.CreateEvent{Object: &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "demo"}}})).To(BeTrue())
+	})
+})
@@ -0,0 +1,211 @@
+package controller
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// 以下函数不访问集群，由ServiceReconciler和离线的plan命令共用
+
+// serviceFields 返回控制器需要写入Service的发现标签和端口名称，以及Service是否缺少这些字段。
+// 已被设置为其他值的标签不属于控制器，不包含在结果中。未命名的端口以app标签的值命名，
+// 没有app标签时为Service的名称；已命名的端口不包含在结果中。
+// 名称不是合法的DNS label（例如含有大写字母或.）时端口不被命名，Endpoint通过targetPort选择端口
+func (o Options) serviceFields(service *corev1.Service) (map[string]string, []corev1.ServicePort, bool) {
+	appName := service.Labels["app"]
+	if appName == "" {
+		appName = service.Name
+	}
+
+	needsApply := false
+	fieldLabels := map[string]string{}
+	for k, v := range o.DiscoveryLabels {
+		current, ok := service.Labels[k]
+		if !ok {
+			needsApply = true
+		}
+		if !ok || current == v {
+			fieldLabels[k] = v
+		}
+	}
+
+	// 多端口的Service必须为每个端口命名，因此只有单端口的Service可能缺少端口名称。
+	// 端口名称设置后控制器放弃端口的所有权，之后的apply不再包含端口
+	var fieldPorts []corev1.ServicePort
+	if len(service.Spec.Ports) == 1 && service.Spec.Ports[0].Name == "" {
+		port := service.Spec.Ports[0]
+		if errs := validation.IsDNS1123Label(appName); len(errs) > 0 {
+			log.Log.WithValues("Service", service.Namespace+"/"+service.Name, "name", appName).V(1).Info("Port name is not a valid DNS label, the port is scraped by targetPort: " + strings.Join(errs, "; "))
+		} else {
+			needsApply = true
+			protocol := port.Protocol
+			if protocol == "" {
+				protocol = corev1.ProtocolTCP
+			}
+			fieldPorts = append(fieldPorts, corev1.ServicePort{
+				Name:     appName,
+				Port:     port.Port,
+				Protocol: protocol,
+			})
+		}
+	}
+	return fieldLabels, fieldPorts, needsApply
+}
+
+// labelConflicts 返回Service上已被设置为其他值的发现标签，按名称排序。
+// 控制器不修改这些标签，ServiceMonitor的selector也不使用它们
+func (o Options) labelConflicts(service *corev1.Service) []string {
+	var conflicts []string
+	for k, v := range o.DiscoveryLabels {
+		if current, ok := service.Labels[k]; ok && current != v {
+			conflicts = append(conflicts, k)
+		}
+	}
+	sort.Strings(conflicts)
+	return conflicts
+}
+
+// desiredServiceMonitor 构建控制器期望的ServiceMonitor，只包含控制器负责的字段
+func (o Options) desiredServiceMonitor(service *corev1.Service, cfg *scrapeConfig, ports []corev1.ServicePort) (*monitoringv1.ServiceMonitor, error) {
+	// 获取app标签的值
+	appName := service.Labels["app"]
+	smName, err := o.monitorName(service)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render ServiceMonitor name: %v", err)
+	}
+	smLabels := ownerLabels(types.NamespacedName{Namespace: service.Namespace, Name: service.Name})
+	for k, v := range o.DiscoveryLabels {
+		smLabels[k] = v
+	}
+	if appName != "" {
+		smLabels["app"] = appName
+	}
+	endpoints, relabel, err := o.serviceEndpoints(service, cfg, ports)
+	if err != nil {
+		return nil, err
+	}
+	sm := &monitoringv1.ServiceMonitor{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       monitoringv1.ServiceMonitorsKind,
+			APIVersion: monitoringv1.SchemeGroupVersion.String(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      smName,
+			Namespace: o.MonitorNamespace,
+			Labels:    smLabels,
+			Annotations: map[string]string{
+				generatedEndpointsAnnotation: serviceEndpointKeys(endpoints),
+			},
+		},
+		Spec: monitoringv1.ServiceMonitorSpec{
+			NamespaceSelector: monitoringv1.NamespaceSelector{
+				MatchNames: []string{service.Namespace},
+			},
+			Selector: metav1.LabelSelector{
+				MatchLabels: o.monitorSelector(service),
+			},
+			Endpoints:    endpoints,
+			TargetLabels: relabel.targetLabels,
+		},
+	}
+	o.scrapeLimits(service.Namespace).applyToServiceMonitor(&sm.Spec)
+	return sm, nil
+}
+
+// serviceEndpoints 返回合并了relabel模板的Endpoint列表，以及渲染后的relabel配置
+func (o Options) serviceEndpoints(service *corev1.Service, cfg *scrapeConfig, ports []corev1.ServicePort) ([]monitoringv1.Endpoint, *relabeling, error) {
+	relabel, err := o.relabeling("Service", service)
+	if err != nil {
+		return nil, nil, err
+	}
+	// selector选中的标签可能同时出现在其他Service上（例如foo和foo-headless），
+	// 只保留该Service的target，避免同一个后端被重复拉取
+	relabel.relabelings = append([]*monitoringv1.RelabelConfig{{
+		SourceLabels: []monitoringv1.LabelName{"__meta_kubernetes_service_name"},
+		Regex:        regexp.QuoteMeta(service.Name),
+		Action:       "keep",
+	}}, relabel.relabelings...)
+	endpoints := cfg.endpoints(ports)
+	relabel.applyToEndpoints(endpoints)
+	return endpoints, relabel, nil
+}
+
+// ServicePlan 控制器对一个Service的处理结果
+type ServicePlan struct {
+	// Service 写入发现标签和端口名称后的Service，非侵入模式下与输入相同
+	Service *corev1.Service
+	// ServiceChanged 控制器是否会修改Service
+	ServiceChanged bool
+	// ServiceMonitor 生成的ServiceMonitor，Service被跳过时为nil
+	ServiceMonitor *monitoringv1.ServiceMonitor
+	// PrometheusRule 开启告警时与ServiceMonitor一起生成的PrometheusRule
+	PrometheusRule *monitoringv1.PrometheusRule
+	// SkipReason、SkipMessage Service被跳过的原因及说明
+	SkipReason  string
+	SkipMessage string
+	// Warnings 非法的注解，这些注解使用默认值
+	Warnings []error
+}
+
+// PlanService 不访问集群，按控制器的规则计算Service对应的ServiceMonitor。
+// 命名空间只按IncludeNamespaces和ExcludeNamespaces判断，不检查命名空间的标签；
+// 无法检查metrics端点，假设所有选中的端口都是健康的
+func (o Options) PlanService(service *corev1.Service) (*ServicePlan, error) {
+	rules, err := o.compileRules()
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &ServicePlan{Service: service.DeepCopy()}
+	if contains(o.ExcludeNamespaces, service.Namespace) {
+		plan.SkipReason = skipReasonNamespaceNotWatched
+		plan.SkipMessage = fmt.Sprintf("Namespace %s is excluded", service.Namespace)
+		return plan, nil
+	}
+
+	cfg, errs := parseScrapeConfig(plan.Service, !o.IgnoreLegacyAnnotations)
+	plan.Warnings = errs
+	if reason, message := rules.skipReason(plan.Service, cfg); reason != "" {
+		plan.SkipReason, plan.SkipMessage = reason, message
+		return plan, nil
+	}
+
+	if !o.NonInvasive {
+		fieldLabels, fieldPorts, needsApply := o.serviceFields(plan.Service)
+		plan.ServiceChanged = needsApply
+		if plan.Service.Labels == nil {
+			plan.Service.Labels = map[string]string{}
+		}
+		for k, v := range fieldLabels {
+			plan.Service.Labels[k] = v
+		}
+		// 单端口的Service只有一个端口，端口名称直接写入
+		if len(fieldPorts) == 1 {
+			plan.Service.Spec.Ports[0].Name = fieldPorts[0].Name
+		}
+	}
+
+	if conflicts := o.labelConflicts(plan.Service); len(conflicts) > 0 && !o.NonInvasive {
+		plan.Warnings = append(plan.Warnings, fmt.Errorf("discovery labels %s have different values on the Service and are not used to select it", strings.Join(conflicts, ",")))
+	}
+	plan.ServiceMonitor, err = o.desiredServiceMonitor(plan.Service, cfg, cfg.selectedPorts(plan.Service))
+	if err != nil {
+		return nil, err
+	}
+	if o.Alerts.Enabled {
+		if plan.PrometheusRule, err = o.desiredPrometheusRule(plan.Service, plan.ServiceMonitor); err != nil {
+			return nil, err
+		}
+	}
+	return plan, nil
+}
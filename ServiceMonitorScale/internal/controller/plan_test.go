@@ -0,0 +1,107 @@
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+var _ = Describe("PlanService", func() {
+	var service *corev1.Service
+
+	BeforeEach(func() {
+		service = &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "api",
+				Namespace: "demo",
+				Labels:    map[string]string{"app": "api"},
+			},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{{Port: 8080, TargetPort: intstr.FromInt(9090)}},
+			},
+		}
+	})
+
+	It("names the port and renders the ServiceMonitor", func() {
+		plan, err := DefaultOptions().PlanService(service)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(plan.SkipReason).To(BeEmpty())
+		Expect(plan.ServiceChanged).To(BeTrue())
+		Expect(plan.Service.Labels).To(HaveKeyWithValue("release", "kube-prometheus-stack"))
+		Expect(plan.Service.Spec.Ports[0].Name).To(Equal("api"))
+		// 输入的Service不被修改
+		Expect(service.Spec.Ports[0].Name).To(BeEmpty())
+
+		sm := plan.ServiceMonitor
+		Expect(sm.Name).To(Equal("demo-api"))
+		Expect(sm.Namespace).To(Equal(defaultMonitorNamespace))
+		Expect(sm.Spec.NamespaceSelector.MatchNames).To(Equal([]string{"demo"}))
+		Expect(sm.Spec.Selector.MatchLabels).To(Equal(map[string]string{"app": "api", "release": "kube-prometheus-stack"}))
+		Expect(sm.Spec.Endpoints).To(HaveLen(1))
+		Expect(sm.Spec.Endpoints[0].Port).To(Equal("api"))
+	})
+
+	It("leaves the Service alone in non-invasive mode", func() {
+		opts := DefaultOptions()
+		opts.NonInvasive = true
+		plan, err := opts.PlanService(service)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(plan.ServiceChanged).To(BeFalse())
+		Expect(plan.Service).To(Equal(service))
+		Expect(plan.ServiceMonitor.Spec.Endpoints[0].TargetPort).To(Equal(&intstr.IntOrString{Type: intstr.Int, IntVal: 9090}))
+	})
+
+	It("reports why a Service is skipped", func() {
+		service.Namespace = "kube-system"
+		plan, err := DefaultOptions().PlanService(service)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(plan.SkipReason).To(Equal(skipReasonNamespaceNotWatched))
+		Expect(plan.ServiceMonitor).To(BeNil())
+	})
+
+	It("selects Services without an app label by the discovery labels", func() {
+		delete(service.Labels, "app")
+		plan, err := DefaultOptions().PlanService(service)
+		Expect(err).NotTo(HaveOccurred())
+
+		sm := plan.ServiceMonitor
+		Expect(sm.Labels).NotTo(HaveKey("app"))
+		Expect(sm.Spec.Selector.MatchLabels).To(Equal(map[string]string{"release": "kube-prometheus-stack"}))
+		selector, err := metav1.LabelSelectorAsSelector(&sm.Spec.Selector)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(selector.Matches(labels.Set(plan.Service.Labels))).To(BeTrue())
+		Expect(sm.Spec.Endpoints[0].Port).To(Equal("api"))
+		Expect(sm.Spec.Endpoints[0].RelabelConfigs[0].Regex).To(Equal("api"))
+	})
+
+	It("selects a Service whose discovery label has another value without that label", func() {
+		service.Labels["release"] = "my-helm-release"
+		plan, err := DefaultOptions().PlanService(service)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(plan.Service.Labels).To(HaveKeyWithValue("release", "my-helm-release"))
+		Expect(plan.Warnings).To(ContainElement(MatchError(ContainSubstring("discovery labels release"))))
+
+		sm := plan.ServiceMonitor
+		Expect(sm.Labels).To(HaveKeyWithValue("release", "kube-prometheus-stack"))
+		Expect(sm.Spec.Selector.MatchLabels).To(Equal(map[string]string{"app": "api"}))
+		selector, err := metav1.LabelSelectorAsSelector(&sm.Spec.Selector)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(selector.Matches(labels.Set(plan.Service.Labels))).To(BeTrue())
+	})
+
+	It("scrapes the port by targetPort when the app label is not a valid port name", func() {
+		service.Labels["app"] = "Billing.API"
+		plan, err := DefaultOptions().PlanService(service)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(plan.Service.Spec.Ports[0].Name).To(BeEmpty())
+
+		sm := plan.ServiceMonitor
+		Expect(sm.Spec.Endpoints).To(HaveLen(1))
+		Expect(sm.Spec.Endpoints[0].Port).To(BeEmpty())
+		Expect(sm.Spec.Endpoints[0].TargetPort).To(Equal(&intstr.IntOrString{Type: intstr.Int, IntVal: 9090}))
+	})
+})
@@ -0,0 +1,576 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// PodMonitor的归属标签。与ServiceMonitor一样，PodMonitor与工作负载可能不在同一命名空间，无法使用OwnerReference
+const (
+	workloadKindLabel      = "servicemonitorscale.tal.com/workload-kind"
+	workloadNameLabel      = "servicemonitorscale.tal.com/workload-name"
+	workloadNamespaceLabel = "servicemonitorscale.tal.com/workload-namespace"
+)
+
+// PodMonitorReconciler 为没有Service的工作负载生成PodMonitor。
+// 工作负载需要通过scrape注解显式开启，拉取配置注解和metrics端点检查规则与Service相同
+type PodMonitorReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	Probes   *ProbeWorkerPool
+	Options  Options
+	// DryRun 不为空时不执行任何写操作，只把计划执行的修改记录到DryRun中
+	DryRun *DryRunReport
+
+	namespaces *namespaceFilter
+	rules      *serviceRules
+	// apiReader 不经过缓存读取工作负载引用的Secret和ConfigMap
+	apiReader client.Reader
+}
+
+// workloadLabels 返回PodMonitor的归属标签
+func workloadLabels(kind string, workload types.NamespacedName) map[string]string {
+	return map[string]string{
+		managedByLabel:         managedByValue,
+		workloadKindLabel:      kind,
+		workloadNameLabel:      workload.Name,
+		workloadNamespaceLabel: workload.Namespace,
+	}
+}
+
+func workloadRef(kind string, workload types.NamespacedName) string {
+	return kind + "/" + workload.String()
+}
+
+func (r *PodMonitorReconciler) reconcileWorkload(ctx context.Context, kind workloadKind, req ctrl.Request) (ctrl.Result, error) {
+	ref := workloadRef(kind.kind, req.NamespacedName)
+	obj := kind.newObject()
+	if err := r.Get(ctx, req.NamespacedName, obj); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return ctrl.Result{}, err
+		}
+		log.Log.WithValues("workload", ref).Info("Workload is deleted.")
+		forgetWorkloadSampleLimit(kind.kind, req.NamespacedName)
+		return ctrl.Result{}, r.deletePodMonitors(ctx, kind.kind, req.NamespacedName)
+	}
+
+	watched, err := r.namespaces.watched(ctx, obj.GetNamespace())
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !watched {
+		log.Log.WithValues("workload", ref, "reason", skipReasonNamespaceNotWatched).Info("Namespace is not watched, skip")
+		forgetWorkloadSampleLimit(kind.kind, req.NamespacedName)
+		return ctrl.Result{}, r.deletePodMonitors(ctx, kind.kind, req.NamespacedName)
+	}
+	selector, template, ok := kind.podTemplate(obj)
+	if !ok {
+		// Pod由Deployment、StatefulSet或DaemonSet管理，由对应的工作负载生成PodMonitor
+		return ctrl.Result{}, nil
+	}
+
+	portNames := make([]string, 0)
+	for _, port := range containerPorts(template) {
+		portNames = append(portNames, port.Name)
+	}
+	cfg, errs := parseScrapeAnnotations(obj.GetAnnotations(), kind.kind, portNames)
+	errs = append(errs, cfg.parseAuth(obj.GetAnnotations(), workloadAuthSecretName(kind.kind, req.NamespacedName))...)
+	for _, e := range errs {
+		r.Recorder.Event(obj, corev1.EventTypeWarning, reasonInvalidAnnotation, e.Error())
+	}
+	ports := cfg.selectedContainerPorts(template)
+	if reason, message := r.rules.workloadSkipReason(obj, selector, cfg, ports); reason != "" {
+		log.Log.WithValues("workload", ref, "reason", reason).Info("Skip workload: " + message)
+		if err := r.deletePodMonitors(ctx, kind.kind, req.NamespacedName); err != nil {
+			return ctrl.Result{}, err
+		}
+		r.Recorder.Eventf(obj, corev1.EventTypeNormal, reasonSkipped, "%s: %s", reason, message)
+		forgetWorkloadSampleLimit(kind.kind, req.NamespacedName)
+		return ctrl.Result{}, nil
+	}
+
+	// 与Service相同，读取TLS和鉴权注解引用的Secret和ConfigMap，引用不存在时等待用户创建
+	authData, err := readAuthData(ctx, r.apiReader, obj.GetNamespace(), cfg.Auth)
+	if err != nil {
+		if !apierrors.IsNotFound(err) && !errors.Is(err, errMissingAuthKey) {
+			return ctrl.Result{}, err
+		}
+		r.Recorder.Eventf(obj, corev1.EventTypeWarning, reasonAuthUnavailable, "TLS or auth reference is not available: %v", err)
+		return ctrl.Result{RequeueAfter: probeResultTTL}, nil
+	}
+
+	healthyPorts, status, err := r.checkPods(ctx, kind.kind, obj, selector, cfg, ports, authData)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	result := ctrl.Result{RequeueAfter: status.requeueAfter}
+	if len(healthyPorts) == 0 {
+		// 与ServiceMonitor一致，没有健康的端口时删除之前生成的PodMonitor，仍在等待检查结果时保留
+		log.Log.WithValues("workload", ref, "result", status.result()).Info("Workload metrics is unhealthy, will not create PodMonitor")
+		if status.reason() != reasonMetricsPending {
+			if err := r.deletePodMonitors(ctx, kind.kind, req.NamespacedName); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		if status.reason() == reasonMetricsUnreachable {
+			r.Recorder.Eventf(obj, corev1.EventTypeWarning, reasonMetricsUnreachable, "No healthy metrics endpoint, PodMonitor is not generated: %s", status.result())
+		}
+		return result, nil
+	}
+
+	pm, err := r.Options.desiredPodMonitor(kind.kind, obj, selector, cfg, healthyPorts)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	// PodMonitor引用的鉴权内容需要先复制到PodMonitor所在的命名空间
+	if cfg.Auth == nil {
+		err = deleteOwnedAuthSecrets(ctx, r.Client, r.DryRun, r.Options.MonitorNamespace, workloadLabels(kind.kind, req.NamespacedName), ref)
+	} else {
+		err = applyOwnedAuthSecret(ctx, r.Client, r.DryRun, r.Options.MonitorNamespace, workloadLabels(kind.kind, req.NamespacedName), ref, cfg.Auth, authData)
+	}
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	return result, r.applyPodMonitor(ctx, kind.kind, obj, pm)
+}
+
+// desiredPodMonitor 构建控制器期望的PodMonitor，只包含控制器负责的字段
+func (o Options) desiredPodMonitor(kind string, workload metav1.Object, selector *metav1.LabelSelector, cfg *scrapeConfig, ports []corev1.ContainerPort) (*monitoringv1.PodMonitor, error) {
+	name, err := o.podMonitorName(kind, workload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render PodMonitor name: %v", err)
+	}
+	pmLabels := workloadLabels(kind, types.NamespacedName{Namespace: workload.GetNamespace(), Name: workload.GetName()})
+	for k, v := range o.DiscoveryLabels {
+		pmLabels[k] = v
+	}
+	relabel, err := o.relabeling(kind, workload)
+	if err != nil {
+		return nil, err
+	}
+	if kind == "Pod" {
+		// 独立Pod以自身的标签作为selector，同一个Job的Pod标签相同，只保留该Pod的target，避免重复拉取
+		relabel.relabelings = append([]*monitoringv1.RelabelConfig{{
+			SourceLabels: []monitoringv1.LabelName{"__meta_kubernetes_pod_name"},
+			Regex:        regexp.QuoteMeta(workload.GetName()),
+			Action:       "keep",
+		}}, relabel.relabelings...)
+	}
+	endpoints := cfg.podMetricsEndpoints(ports)
+	relabel.applyToPodMetricsEndpoints(endpoints)
+	pm := &monitoringv1.PodMonitor{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       monitoringv1.PodMonitorsKind,
+			APIVersion: monitoringv1.SchemeGroupVersion.String(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: o.MonitorNamespace,
+			Labels:    pmLabels,
+			Annotations: map[string]string{
+				generatedEndpointsAnnotation: podEndpointKeys(endpoints),
+			},
+		},
+		Spec: monitoringv1.PodMonitorSpec{
+			NamespaceSelector: monitoringv1.NamespaceSelector{
+				MatchNames: []string{workload.GetNamespace()},
+			},
+			Selector:            *selector.DeepCopy(),
+			PodMetricsEndpoints: endpoints,
+			PodTargetLabels:     relabel.targetLabels,
+		},
+	}
+	o.scrapeLimits(workload.GetNamespace()).applyToPodMonitor(&pm.Spec)
+	return pm, nil
+}
+
+// podMetricsEndpoints 将拉取配置投影为PodMonitor的Endpoint列表，未命名的容器端口使用数字形式的targetPort。
+// TLS和鉴权字段引用复制到PodMonitor命名空间的Secret
+func (c *scrapeConfig) podMetricsEndpoints(ports []corev1.ContainerPort) []monitoringv1.PodMetricsEndpoint {
+	endpoints := make([]monitoringv1.PodMetricsEndpoint, 0, len(ports))
+	for _, port := range ports {
+		var targetPort *intstr.IntOrString
+		if port.Name == "" {
+			tp := intstr.FromInt32(port.ContainerPort)
+			targetPort = &tp
+		}
+		ep := monitoringv1.PodMetricsEndpoint{
+			Port:          port.Name,
+			TargetPort:    targetPort,
+			Path:          c.Path,
+			Interval:      c.Interval,
+			ScrapeTimeout: c.ScrapeTimeout,
+			Scheme:        c.Scheme,
+			HonorLabels:   c.HonorLabels,
+		}
+		if c.Auth != nil {
+			c.Auth.podEndpointAuth(&ep)
+		}
+		endpoints = append(endpoints, ep)
+	}
+	return endpoints
+}
+
+// checkPods 检查工作负载就绪的Pod的metrics端点，规则与Service相同：端口只要有一个Pod健康、
+// 且没有Pod暴露的sample数量超过sampleLimit即认为健康。authData为readAuthData读取的鉴权内容
+func (r *PodMonitorReconciler) checkPods(ctx context.Context, kind string, workload client.Object, selector *metav1.LabelSelector, cfg *scrapeConfig, ports []corev1.ContainerPort, authData map[string][]byte) ([]corev1.ContainerPort, *probeStatus, error) {
+	podSelector, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return nil, nil, err
+	}
+	podList := &corev1.PodList{}
+	if pod, ok := workload.(*corev1.Pod); ok {
+		// 独立Pod只检查自身，与PodMonitor中按Pod名称保留的relabel配置一致
+		podList.Items = []corev1.Pod{*pod}
+	} else if err := r.List(ctx, podList, client.InNamespace(workload.GetNamespace()), client.MatchingLabelsSelector{Selector: podSelector}); err != nil {
+		return nil, nil, err
+	}
+
+	limits := r.Options.scrapeLimits(workload.GetNamespace())
+	forgetWorkloadSampleLimit(kind, client.ObjectKeyFromObject(workload))
+	var healthyPorts []corev1.ContainerPort
+	status := &probeStatus{}
+	for _, port := range ports {
+		addresses := readyPodAddresses(podList.Items, port)
+		if len(addresses) == 0 {
+			// Pod就绪状态变化会更新工作负载的status，重新触发Reconcile
+			status.add(portLabel(port), portNoReadyEndpoints)
+			continue
+		}
+
+		healthy, pending := false, false
+		overLimit, overLimitTruncated, overLimitSamples := false, false, 0
+		for _, address := range addresses {
+			target := cfg.Auth.probeTarget(ProbeTarget{URL: metricsURL(address, cfg), Namespace: workload.GetNamespace()}, authData)
+			result, ok := r.Probes.Result(target)
+			switch {
+			case !ok:
+				pending = true
+			case result.Healthy && limits.exceedsSampleLimit(result):
+				overLimit = true
+				overLimitTruncated = overLimitTruncated || result.Truncated
+				if result.Samples > overLimitSamples {
+					overLimitSamples = result.Samples
+				}
+			case result.Healthy:
+				healthy = true
+			case result.InvalidFormat:
+				r.Recorder.Eventf(workload, corev1.EventTypeWarning, reasonInvalidMetricsFormat, "Port %s endpoint %s: %v", portLabel(port), address, result.Err)
+			}
+		}
+
+		switch {
+		case overLimit:
+			r.Recorder.Event(workload, corev1.EventTypeWarning, reasonSampleLimitExceeded, limits.sampleLimitMessage(portLabel(port), overLimitSamples, overLimitTruncated))
+			workloadSampleLimitExceeded.WithLabelValues(workload.GetNamespace(), kind, workload.GetName(), portLabel(port)).Set(float64(overLimitSamples))
+			status.requeueAfter = shorterRequeue(status.requeueAfter, probeResultTTL)
+			status.add(portLabel(port), portSampleLimitExceeded)
+		case healthy:
+			healthyPorts = append(healthyPorts, port)
+			status.add(portLabel(port), portHealthy)
+		case pending:
+			status.requeueAfter = shorterRequeue(status.requeueAfter, probePendingRequeue)
+			status.add(portLabel(port), portPending)
+		default:
+			status.requeueAfter = shorterRequeue(status.requeueAfter, probeResultTTL)
+			status.add(portLabel(port), portUnreachable)
+		}
+	}
+	return healthyPorts, status, nil
+}
+
+// readyPodAddresses 返回就绪Pod上端口的地址（ip:containerPort），最多返回maxProbedEndpoints个
+func readyPodAddresses(pods []corev1.Pod, port corev1.ContainerPort) []string {
+	var addresses []string
+	for _, pod := range pods {
+		if pod.Status.PodIP == "" || pod.DeletionTimestamp != nil || !podReady(&pod) {
+			continue
+		}
+		addresses = append(addresses, net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(int(port.ContainerPort))))
+	}
+	// 排序保证每次检查的是同一批地址，检查结果可以命中缓存
+	sort.Strings(addresses)
+	if len(addresses) > maxProbedEndpoints {
+		addresses = addresses[:maxProbedEndpoints]
+	}
+	return addresses
+}
+
+func podReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// portLabel 返回容器端口的名称，未命名时为端口号
+func portLabel(port corev1.ContainerPort) string {
+	if port.Name != "" {
+		return port.Name
+	}
+	return strconv.Itoa(int(port.ContainerPort))
+}
+
+// applyPodMonitor 以控制器的field manager通过server-side apply写入PodMonitor。
+// 同名的PodMonitor不是由该工作负载生成时不接管
+func (r *PodMonitorReconciler) applyPodMonitor(ctx context.Context, kind string, workload client.Object, pm *monitoringv1.PodMonitor) error {
+	ref := workloadRef(kind, client.ObjectKeyFromObject(workload))
+	existing := &monitoringv1.PodMonitor{}
+	err := r.Get(ctx, client.ObjectKeyFromObject(pm), existing)
+	switch {
+	case apierrors.IsNotFound(err):
+	case err != nil:
+		return err
+	default:
+		if owner, ok := podMonitorOwner(existing); !ok || owner != ref {
+			log.Log.WithValues("PodMonitor", pm.Namespace+"/"+pm.Name).Info("PodMonitor exists and is not generated for this workload, skip")
+			r.Recorder.Eventf(workload, corev1.EventTypeWarning, reasonMonitorConflict, "PodMonitor %s/%s exists and is not generated for this %s", pm.Namespace, pm.Name, kind)
+			return nil
+		}
+		// Endpoint列表是原子类型，需要带上用户额外添加的Endpoint，否则会被apply覆盖
+		pm.Spec.PodMetricsEndpoints = mergePodMetricsEndpoints(existing.Spec.PodMetricsEndpoints, pm.Spec.PodMetricsEndpoints, generatedEndpoints(existing))
+	}
+
+	if err := r.Patch(ctx, pm, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership); err != nil {
+		return fmt.Errorf("failed to apply PodMonitor %s/%s: %v", pm.Namespace, pm.Name, err)
+	}
+	changed := pm.ResourceVersion != existing.ResourceVersion
+	if r.DryRun != nil {
+		changed = r.DryRun.planObject(monitoringv1.PodMonitorsKind, client.ObjectKeyFromObject(pm), ref, existing.ResourceVersion == "",
+			managedMonitorFields{Labels: existing.Labels, Spec: existing.Spec},
+			managedMonitorFields{Labels: pm.Labels, Spec: pm.Spec})
+	}
+	if !changed {
+		log.Log.WithValues("PodMonitor", pm.Namespace+"/"+pm.Name).Info("PodMonitor does not need to be updated")
+		return nil
+	}
+	log.Log.WithValues("PodMonitor", pm.Namespace+"/"+pm.Name, "created", existing.ResourceVersion == "").Info("PodMonitor applied")
+	if existing.ResourceVersion == "" {
+		podMonitorOperationsTotal.WithLabelValues(operationCreated).Inc()
+		r.Recorder.Eventf(workload, corev1.EventTypeNormal, reasonMonitorCreated, "Created PodMonitor %s/%s", pm.Namespace, pm.Name)
+	} else {
+		podMonitorOperationsTotal.WithLabelValues(operationUpdated).Inc()
+		r.Recorder.Eventf(workload, corev1.EventTypeNormal, reasonMonitorUpdated, "Updated PodMonitor %s/%s", pm.Namespace, pm.Name)
+	}
+	return nil
+}
+
+// mergePodMetricsEndpoints 与mergeEndpoints相同，用desired替换existing中端口相同的Endpoint，
+// 删除generated中记录、但不再需要的Endpoint，保留用户添加的Endpoint
+func mergePodMetricsEndpoints(existing, desired []monitoringv1.PodMetricsEndpoint, generated map[string]bool) []monitoringv1.PodMetricsEndpoint {
+	desiredByPort := make(map[string]monitoringv1.PodMetricsEndpoint, len(desired))
+	for _, ep := range desired {
+		desiredByPort[podEndpointKey(ep)] = ep
+	}
+	merged := make([]monitoringv1.PodMetricsEndpoint, 0, len(existing)+len(desired))
+	for _, ep := range existing {
+		if d, ok := desiredByPort[podEndpointKey(ep)]; ok {
+			merged = append(merged, d)
+			delete(desiredByPort, podEndpointKey(ep))
+			continue
+		}
+		if generated == nil || generated[podEndpointKey(ep)] {
+			continue
+		}
+		merged = append(merged, ep)
+	}
+	for _, ep := range desired {
+		if _, ok := desiredByPort[podEndpointKey(ep)]; ok {
+			merged = append(merged, ep)
+		}
+	}
+	return merged
+}
+
+// podEndpointKey 返回PodMonitor Endpoint指向的端口，按端口名称或targetPort区分
+func podEndpointKey(ep monitoringv1.PodMetricsEndpoint) string {
+	if ep.Port != "" || ep.TargetPort == nil {
+		return ep.Port
+	}
+	return "targetPort/" + ep.TargetPort.String()
+}
+
+// podEndpointKeys 返回生成的PodMonitor Endpoint的podEndpointKey，写入generatedEndpointsAnnotation
+func podEndpointKeys(endpoints []monitoringv1.PodMetricsEndpoint) string {
+	keys := make([]string, 0, len(endpoints))
+	for _, ep := range endpoints {
+		keys = append(keys, podEndpointKey(ep))
+	}
+	return strings.Join(keys, ",")
+}
+
+// podMonitorOwner 通过归属标签返回生成PodMonitor的工作负载（kind/namespace/name）
+func podMonitorOwner(pm *monitoringv1.PodMonitor) (string, bool) {
+	if pm.Labels[managedByLabel] != managedByValue {
+		return "", false
+	}
+	kind, name, namespace := pm.Labels[workloadKindLabel], pm.Labels[workloadNameLabel], pm.Labels[workloadNamespaceLabel]
+	if kind == "" || name == "" || namespace == "" {
+		return "", false
+	}
+	return workloadRef(kind, types.NamespacedName{Namespace: namespace, Name: name}), true
+}
+
+// deletePodMonitors 删除由工作负载生成的所有PodMonitor及其鉴权Secret
+func (r *PodMonitorReconciler) deletePodMonitors(ctx context.Context, kind string, workload types.NamespacedName) error {
+	pmList := &monitoringv1.PodMonitorList{}
+	if err := r.List(ctx, pmList, client.MatchingLabels(workloadLabels(kind, workload))); err != nil {
+		return err
+	}
+	for _, pm := range pmList.Items {
+		if err := r.Delete(ctx, pm); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		if r.DryRun != nil {
+			r.DryRun.planDelete(monitoringv1.PodMonitorsKind, client.ObjectKeyFromObject(pm), workloadRef(kind, workload))
+			continue
+		}
+		podMonitorOperationsTotal.WithLabelValues(operationDeleted).Inc()
+		log.Log.WithValues("workload", workloadRef(kind, workload), "PodMonitor", pm.Namespace+"/"+pm.Name).Info("PodMonitor deleted")
+	}
+	return deleteOwnedAuthSecrets(ctx, r.Client, r.DryRun, r.Options.MonitorNamespace, workloadLabels(kind, workload), workloadRef(kind, workload))
+}
+
+// collectOrphanPodMonitors 启动时删除工作负载已经不存在或所在命名空间不再被选中的PodMonitor和鉴权Secret，
+// 对应控制器停止期间删除的工作负载和取消选中的命名空间
+func (r *PodMonitorReconciler) collectOrphanPodMonitors(ctx context.Context) error {
+	pmList := &monitoringv1.PodMonitorList{}
+	if err := r.List(ctx, pmList, client.MatchingLabels{managedByLabel: managedByValue}, client.HasLabels{workloadKindLabel}); err != nil {
+		log.Log.Error(err, "failed to list generated PodMonitors")
+		return nil
+	}
+	secrets := &corev1.SecretList{}
+	if err := r.List(ctx, secrets, client.InNamespace(r.Options.MonitorNamespace), client.MatchingLabels{managedByLabel: managedByValue}, client.HasLabels{workloadKindLabel}); err != nil {
+		log.Log.Error(err, "failed to list auth Secrets of workloads")
+		return nil
+	}
+	owned := make([]metav1.Object, 0, len(pmList.Items)+len(secrets.Items))
+	for _, pm := range pmList.Items {
+		owned = append(owned, pm)
+	}
+	for i := range secrets.Items {
+		owned = append(owned, &secrets.Items[i])
+	}
+
+	checked := map[string]bool{}
+	for _, obj := range owned {
+		labels := obj.GetLabels()
+		kindName := labels[workloadKindLabel]
+		workload := types.NamespacedName{Namespace: labels[workloadNamespaceLabel], Name: labels[workloadNameLabel]}
+		var kind *workloadKind
+		for i := range workloadKinds {
+			if workloadKinds[i].kind == kindName {
+				kind = &workloadKinds[i]
+			}
+		}
+		if kind == nil || workload.Name == "" || workload.Namespace == "" || checked[workloadRef(kindName, workload)] {
+			continue
+		}
+		checked[workloadRef(kindName, workload)] = true
+		err := r.Get(ctx, workload, kind.newObject())
+		if err != nil && !apierrors.IsNotFound(err) {
+			log.Log.Error(err, "failed to get workload", "workload", workloadRef(kindName, workload))
+			continue
+		}
+		if err == nil && !r.namespaces.unwatched(ctx, workload.Namespace) {
+			continue
+		}
+		if err := r.deletePodMonitors(ctx, kindName, workload); err != nil {
+			log.Log.Error(err, "failed to delete orphan PodMonitor", "workload", workloadRef(kindName, workload))
+		}
+	}
+	return nil
+}
+
+// podMonitorToWorkload 将生成的PodMonitor的变化映射为对应工作负载的reconcile请求
+func podMonitorToWorkload(kind string) handler.MapFunc {
+	return func(_ context.Context, obj client.Object) []reconcile.Request {
+		labels := obj.GetLabels()
+		if labels[managedByLabel] != managedByValue || labels[workloadKindLabel] != kind {
+			return nil
+		}
+		if labels[workloadNameLabel] == "" || labels[workloadNamespaceLabel] == "" {
+			return nil
+		}
+		return []reconcile.Request{{
+			NamespacedName: types.NamespacedName{Namespace: labels[workloadNamespaceLabel], Name: labels[workloadNameLabel]},
+		}}
+	}
+}
+
+func (r *PodMonitorReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if err := r.Options.Validate(); err != nil {
+		return err
+	}
+
+	if r.DryRun != nil {
+		r.Client = client.NewDryRunClient(r.Client)
+		r.Recorder = dryRunRecorder{}
+	}
+	r.apiReader = mgr.GetAPIReader()
+	var err error
+	if r.namespaces, err = r.Options.namespaceFilter(r.Client); err != nil {
+		return err
+	}
+	if r.rules, err = r.Options.compileRules(); err != nil {
+		return err
+	}
+
+	// 外部传入的ProbeWorkerPool由调用方启动
+	if r.Probes == nil {
+		r.Probes = NewDefaultProbeWorkerPool()
+		if err := mgr.Add(r.Probes); err != nil {
+			return err
+		}
+	}
+	if err := mgr.Add(manager.RunnableFunc(r.collectOrphanPodMonitors)); err != nil {
+		return err
+	}
+
+	// 每种工作负载使用一个独立的controller
+	for _, kind := range workloadKinds {
+		kind := kind
+		err := ctrl.NewControllerManagedBy(mgr).
+			Named("podmonitor-"+strings.ToLower(kind.kind)).
+			For(kind.newObject(), builder.WithPredicates(r.namespaces.predicate(), scrapeAnnotatedPredicate())).
+			Watches(&monitoringv1.PodMonitor{},
+				handler.EnqueueRequestsFromMapFunc(podMonitorToWorkload(kind.kind))).
+			Watches(&corev1.Namespace{},
+				handler.EnqueueRequestsFromMapFunc(r.namespaceToWorkloads(kind)),
+				builder.WithPredicates(predicate.LabelChangedPredicate{})).
+			Complete(reconcile.Func(func(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+				return r.reconcileWorkload(ctx, kind, req)
+			}))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,290 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("PodMonitor generation", func() {
+	var deployment *appsv1.Deployment
+
+	BeforeEach(func() {
+		deployment = &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "agent",
+				Namespace:   "demo",
+				Annotations: map[string]string{scrapeAnnotation: "true"},
+			},
+			Spec: appsv1.DeploymentSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"name": "agent"}},
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{Containers: []corev1.Container{{
+						Name: "agent",
+						Ports: []corev1.ContainerPort{
+							{Name: "metrics", ContainerPort: 9100},
+							{ContainerPort: 9200},
+							{Name: "dns", ContainerPort: 53, Protocol: corev1.ProtocolUDP},
+						},
+					}}},
+				},
+			},
+		}
+	})
+
+	It("renders a PodMonitor for the TCP container ports", func() {
+		cfg, errs := parseScrapeAnnotations(deployment.Annotations, "Deployment", []string{"metrics"})
+		Expect(errs).To(BeEmpty())
+		ports := cfg.selectedContainerPorts(&deployment.Spec.Template)
+		Expect(ports).To(HaveLen(2))
+
+		pm, err := DefaultOptions().desiredPodMonitor("Deployment", deployment, deployment.Spec.Selector, cfg, ports)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pm.Name).To(Equal("demo-agent"))
+		Expect(pm.Labels).To(HaveKeyWithValue(workloadKindLabel, "Deployment"))
+		Expect(pm.Spec.Selector.MatchLabels).To(Equal(map[string]string{"name": "agent"}))
+		Expect(pm.Spec.NamespaceSelector.MatchNames).To(Equal([]string{"demo"}))
+		Expect(pm.Spec.PodMetricsEndpoints).To(HaveLen(2))
+		Expect(pm.Spec.PodMetricsEndpoints[0].Port).To(Equal("metrics"))
+		Expect(pm.Spec.PodMetricsEndpoints[1].TargetPort).To(Equal(&intstr.IntOrString{Type: intstr.Int, IntVal: 9200}))
+
+		owner, ok := podMonitorOwner(pm)
+		Expect(ok).To(BeTrue())
+		Expect(owner).To(Equal("Deployment/demo/agent"))
+	})
+
+	It("requires workloads to opt in", func() {
+		rules, err := DefaultOptions().compileRules()
+		Expect(err).NotTo(HaveOccurred())
+		delete(deployment.Annotations, scrapeAnnotation)
+		cfg, _ := parseScrapeAnnotations(deployment.Annotations, "Deployment", nil)
+		reason, _ := rules.workloadSkipReason(deployment, deployment.Spec.Selector, cfg, cfg.selectedContainerPorts(&deployment.Spec.Template))
+		Expect(reason).To(Equal(skipReasonNotOptedIn))
+	})
+
+	It("leaves Pods of a Deployment to the Deployment", func() {
+		isController := true
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:            "agent-5d4f-x2x9",
+			OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "agent-5d4f", Controller: &isController}},
+		}}
+		podKind := workloadKinds[len(workloadKinds)-1]
+		_, _, ok := podKind.podTemplate(pod)
+		Expect(ok).To(BeFalse())
+
+		pod.OwnerReferences[0].Kind = "Job"
+		_, _, ok = podKind.podTemplate(pod)
+		Expect(ok).To(BeTrue())
+	})
+
+	It("keeps only the targets of a standalone Pod and skips Pods without labels", func() {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "migrate-x2x9",
+				Namespace:   "demo",
+				Labels:      map[string]string{"job-name": "migrate"},
+				Annotations: map[string]string{scrapeAnnotation: "true"},
+			},
+			Spec: deployment.Spec.Template.Spec,
+		}
+		podKind := workloadKinds[len(workloadKinds)-1]
+		selector, template, ok := podKind.podTemplate(pod)
+		Expect(ok).To(BeTrue())
+		cfg, _ := parseScrapeAnnotations(pod.Annotations, "Pod", []string{"metrics"})
+		ports := cfg.selectedContainerPorts(template)
+
+		pm, err := DefaultOptions().desiredPodMonitor("Pod", pod, selector, cfg, ports)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pm.Spec.Selector.MatchLabels).To(Equal(map[string]string{"job-name": "migrate"}))
+		for _, ep := range pm.Spec.PodMetricsEndpoints {
+			Expect(ep.RelabelConfigs[0]).To(Equal(&monitoringv1.RelabelConfig{
+				SourceLabels: []monitoringv1.LabelName{"__meta_kubernetes_pod_name"},
+				Regex:        "migrate-x2x9",
+				Action:       "keep",
+			}))
+		}
+
+		rules, err := DefaultOptions().compileRules()
+		Expect(err).NotTo(HaveOccurred())
+		reason, _ := rules.workloadSkipReason(pod, selector, cfg, ports)
+		Expect(reason).To(BeEmpty())
+		pod.Labels = nil
+		selector, _, _ = podKind.podTemplate(pod)
+		reason, _ = rules.workloadSkipReason(pod, selector, cfg, ports)
+		Expect(reason).To(Equal(skipReasonNoSelectableLabels))
+	})
+
+	It("prunes endpoints of unhealthy ports and deletes the PodMonitor when no port is healthy", func() {
+		ctx := context.Background()
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "agent-1", Namespace: "demo", Labels: map[string]string{"name": "agent"}},
+			Status: corev1.PodStatus{
+				PodIP:      "10.0.0.1",
+				Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+			},
+		}
+		scheme := runtime.NewScheme()
+		Expect(corev1.AddToScheme(scheme)).To(Succeed())
+		Expect(appsv1.AddToScheme(scheme)).To(Succeed())
+		Expect(monitoringv1.AddToScheme(scheme)).To(Succeed())
+		c := withApply(fake.NewClientBuilder().WithScheme(scheme)).WithObjects(deployment, pod).Build()
+
+		opts := DefaultOptions()
+		opts.IncludeNamespaces = []string{"demo"}
+		filter, err := opts.namespaceFilter(c)
+		Expect(err).NotTo(HaveOccurred())
+		rules, err := opts.compileRules()
+		Expect(err).NotTo(HaveOccurred())
+		probes := NewProbeWorkerPool(nil, 0, time.Minute)
+		r := &PodMonitorReconciler{Client: c, Options: opts, Probes: probes, Recorder: record.NewFakeRecorder(10), namespaces: filter, rules: rules}
+
+		probe := func(port string, healthy bool) {
+			target := ProbeTarget{URL: "http://10.0.0.1:" + port + "/metrics", Namespace: "demo"}
+			probes.results[target.key()] = ProbeResult{Healthy: healthy, CheckedAt: time.Now()}
+		}
+		reconcile := func() {
+			_, err := r.reconcileWorkload(ctx, workloadKinds[0], ctrl.Request{NamespacedName: client.ObjectKeyFromObject(deployment)})
+			Expect(err).NotTo(HaveOccurred())
+		}
+		key := client.ObjectKey{Namespace: opts.MonitorNamespace, Name: "demo-agent"}
+		endpoints := func() []string {
+			pm := &monitoringv1.PodMonitor{}
+			Expect(c.Get(ctx, key, pm)).To(Succeed())
+			var keys []string
+			for _, ep := range pm.Spec.PodMetricsEndpoints {
+				keys = append(keys, podEndpointKey(ep))
+			}
+			return keys
+		}
+
+		probe("9100", true)
+		probe("9200", true)
+		reconcile()
+		Expect(endpoints()).To(Equal([]string{"metrics", "targetPort/9200"}))
+
+		pm := &monitoringv1.PodMonitor{}
+		Expect(c.Get(ctx, key, pm)).To(Succeed())
+		pm.Spec.PodMetricsEndpoints = append(pm.Spec.PodMetricsEndpoints, monitoringv1.PodMetricsEndpoint{Port: "debug"})
+		Expect(c.Update(ctx, pm)).To(Succeed())
+
+		probe("9200", false)
+		reconcile()
+		Expect(endpoints()).To(Equal([]string{"metrics", "debug"}))
+
+		probe("9100", false)
+		reconcile()
+		Expect(apierrors.IsNotFound(c.Get(ctx, key, &monitoringv1.PodMonitor{}))).To(BeTrue())
+	})
+
+	It("probes with the workload's auth and drops ports over the sample limit", func() {
+		ctx := context.Background()
+		deployment.Annotations[bearerTokenAnnotation] = "secret/metrics-token/token"
+		deployment.Spec.Template.Spec.Containers[0].Ports = deployment.Spec.Template.Spec.Containers[0].Ports[:1]
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "agent-1", Namespace: "demo", Labels: map[string]string{"name": "agent"}},
+			Status: corev1.PodStatus{
+				PodIP:      "10.0.0.1",
+				Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+			},
+		}
+		token := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "metrics-token", Namespace: "demo"},
+			Data:       map[string][]byte{"token": []byte("secret")},
+		}
+		scheme := runtime.NewScheme()
+		Expect(corev1.AddToScheme(scheme)).To(Succeed())
+		Expect(appsv1.AddToScheme(scheme)).To(Succeed())
+		Expect(monitoringv1.AddToScheme(scheme)).To(Succeed())
+		c := withApply(fake.NewClientBuilder().WithScheme(scheme)).WithObjects(deployment, pod, token).Build()
+
+		opts := DefaultOptions()
+		opts.IncludeNamespaces = []string{"demo"}
+		sampleLimit := uint64(1000)
+		opts.Limits.SampleLimit = &sampleLimit
+		filter, err := opts.namespaceFilter(c)
+		Expect(err).NotTo(HaveOccurred())
+		rules, err := opts.compileRules()
+		Expect(err).NotTo(HaveOccurred())
+		probes := NewProbeWorkerPool(nil, 0, time.Minute)
+		recorder := record.NewFakeRecorder(10)
+		r := &PodMonitorReconciler{Client: c, Options: opts, Probes: probes, Recorder: recorder, namespaces: filter, rules: rules, apiReader: c}
+		workload := client.ObjectKeyFromObject(deployment)
+		DeferCleanup(forgetWorkloadSampleLimit, "Deployment", workload)
+
+		// 检查目标带有从Secret读取的token，只有带token的检查结果才会被使用
+		target := ProbeTarget{URL: "http://10.0.0.1:9100/metrics", Namespace: "demo", BearerToken: "secret"}
+		probes.results[target.key()] = ProbeResult{Healthy: true, Samples: 10, CheckedAt: time.Now()}
+		_, err = r.reconcileWorkload(ctx, workloadKinds[0], ctrl.Request{NamespacedName: workload})
+		Expect(err).NotTo(HaveOccurred())
+
+		key := client.ObjectKey{Namespace: opts.MonitorNamespace, Name: "demo-agent"}
+		pm := &monitoringv1.PodMonitor{}
+		Expect(c.Get(ctx, key, pm)).To(Succeed())
+		Expect(pm.Spec.PodMetricsEndpoints).To(HaveLen(1))
+		secretName := workloadAuthSecretName("Deployment", workload)
+		Expect(pm.Spec.PodMetricsEndpoints[0].BearerTokenSecret.Name).To(Equal(secretName))
+		copied := &corev1.Secret{}
+		Expect(c.Get(ctx, client.ObjectKey{Namespace: opts.MonitorNamespace, Name: secretName}, copied)).To(Succeed())
+		Expect(copied.Data).To(HaveKeyWithValue(authTokenKey, []byte("secret")))
+
+		probes.results[target.key()] = ProbeResult{Healthy: true, Samples: 5000, CheckedAt: time.Now()}
+		_, err = r.reconcileWorkload(ctx, workloadKinds[0], ctrl.Request{NamespacedName: workload})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(apierrors.IsNotFound(c.Get(ctx, key, &monitoringv1.PodMonitor{}))).To(BeTrue())
+		Expect(apierrors.IsNotFound(c.Get(ctx, client.ObjectKey{Namespace: opts.MonitorNamespace, Name: secretName}, &corev1.Secret{}))).To(BeTrue())
+		var events []string
+		for len(recorder.Events) > 0 {
+			events = append(events, <-recorder.Events)
+		}
+		Expect(events).To(ContainElement(ContainSubstring("Port metrics exposes 5000 samples")))
+		Expect(testutil.ToFloat64(workloadSampleLimitExceeded.WithLabelValues("demo", "Deployment", "agent", "metrics"))).To(BeEquivalentTo(5000))
+	})
+
+	It("deletes PodMonitors of workloads in unwatched Namespaces at startup", func() {
+		ctx := context.Background()
+		kept := deployment.DeepCopy()
+		kept.Namespace = "prod"
+		generated := func(workload client.Object) *monitoringv1.PodMonitor {
+			return &monitoringv1.PodMonitor{ObjectMeta: metav1.ObjectMeta{
+				Name:      workload.GetNamespace() + "-" + workload.GetName(),
+				Namespace: "monitoring",
+				Labels:    workloadLabels("Deployment", client.ObjectKeyFromObject(workload)),
+			}}
+		}
+		scheme := runtime.NewScheme()
+		Expect(corev1.AddToScheme(scheme)).To(Succeed())
+		Expect(appsv1.AddToScheme(scheme)).To(Succeed())
+		Expect(monitoringv1.AddToScheme(scheme)).To(Succeed())
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "demo"}},
+			deployment, kept, generated(deployment), generated(kept),
+		).Build()
+
+		opts := DefaultOptions()
+		opts.MonitorNamespace = "monitoring"
+		opts.IncludeNamespaces = []string{"prod"}
+		filter, err := opts.namespaceFilter(c)
+		Expect(err).NotTo(HaveOccurred())
+		r := &PodMonitorReconciler{Client: c, Options: opts, Recorder: record.NewFakeRecorder(10), namespaces: filter}
+
+		Expect(r.collectOrphanPodMonitors(ctx)).To(Succeed())
+		Expect(apierrors.IsNotFound(c.Get(ctx, client.ObjectKey{Namespace: "monitoring", Name: "demo-agent"}, &monitoringv1.PodMonitor{}))).To(BeTrue())
+		Expect(c.Get(ctx, client.ObjectKey{Namespace: "monitoring", Name: "prod-agent"}, &monitoringv1.PodMonitor{})).To(Succeed())
+	})
+})
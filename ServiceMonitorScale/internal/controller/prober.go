@@ -0,0 +1,290 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// probeTimeout 单次检查的超时时间
+	probeTimeout = 10 * time.Second
+	// probeWorkers 默认并发执行检查的worker数量
+	probeWorkers = 4
+	// probeResultTTL 检查结果的有效期，过期后下次查询时会重新检查
+	probeResultTTL = time.Minute
+	// probePendingRequeue 检查结果尚未返回时Service重新入队的间隔
+	probePendingRequeue = 5 * time.Second
+	// probeQueueSize 等待检查的队列长度，队列满时本次不检查，等待下次Reconcile
+	probeQueueSize = 1024
+)
+
+// ProbeTarget 描述一个需要检查的metrics端点
+type ProbeTarget struct {
+	URL string
+	// Namespace 端点所属Service的命名空间，只用于记录指标
+	Namespace string
+	// CABundle PEM格式的CA证书，用于校验HTTPS端点
+	CABundle []byte
+	// ClientCert、ClientKey PEM格式的客户端证书和私钥，用于mTLS
+	ClientCert []byte
+	ClientKey  []byte
+	// ServerName 校验HTTPS证书时使用的主机名，为空时使用URL中的地址
+	ServerName string
+	// InsecureSkipVerify 为true时不校验HTTPS证书
+	InsecureSkipVerify bool
+	// BearerToken 不为空时以Authorization: Bearer的方式发送
+	BearerToken string
+	// Username、Password 不为空时以basic auth的方式发送
+	Username string
+	Password string
+}
+
+// key 返回用于缓存检查结果的键，鉴权信息不同的同一端点分别缓存
+func (t ProbeTarget) key() string {
+	h := sha256.New()
+	for _, v := range [][]byte{t.CABundle, t.ClientCert, t.ClientKey, []byte(t.ServerName), []byte(t.BearerToken), []byte(t.Username), []byte(t.Password)} {
+		// 带上长度，避免相邻字段拼接后相同
+		fmt.Fprintf(h, "%d:", len(v))
+		h.Write(v)
+	}
+	return fmt.Sprintf("%s|%t|%x", t.URL, t.InsecureSkipVerify, h.Sum(nil))
+}
+
+// ProbeResult 一次检查的结果
+type ProbeResult struct {
+	Healthy    bool
+	StatusCode int
+	Err        error
+	// InvalidFormat 为true时表示端点可以访问，但返回的内容不是合法的metrics
+	InvalidFormat bool
+	// Format、Samples和MetricFamilies描述端点返回的metrics，仅在健康时有值
+	Format         string
+	Samples        int
+	MetricFamilies []string
+	// Truncated 响应体过大没有被完整读取，Samples是实际数量的下限
+	Truncated bool
+	Duration  time.Duration
+	CheckedAt time.Time
+}
+
+// Prober 检查metrics端点是否健康
+type Prober interface {
+	Probe(ctx context.Context, target ProbeTarget) ProbeResult
+}
+
+// HTTPProber 通过HTTP(S) GET请求检查metrics端点，支持自定义CA、客户端证书、bearer token和basic auth
+type HTTPProber struct {
+	Timeout time.Duration
+
+	once   sync.Once
+	client *http.Client
+}
+
+var _ Prober = &HTTPProber{}
+
+// Probe 实现Prober接口，返回200且响应体是合法的Prometheus/OpenMetrics格式时认为端点健康
+func (p *HTTPProber) Probe(ctx context.Context, target ProbeTarget) (result ProbeResult) {
+	start := time.Now()
+	result.CheckedAt = start
+	defer func() { result.Duration = time.Since(start) }()
+
+	httpClient, shared, err := p.clientFor(target)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	if !shared {
+		// 带TLS配置的client只用于本次检查，关闭其保持的连接，否则每次检查都会留下一个空闲连接
+		defer httpClient.CloseIdleConnections()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.URL, nil)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	req.Header.Set("Accept", acceptHeader)
+	if target.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+target.BearerToken)
+	}
+	if target.Username != "" || target.Password != "" {
+		req.SetBasicAuth(target.Username, target.Password)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer func() {
+		// 读完响应体以便复用连接
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	result.StatusCode = resp.StatusCode
+	if resp.StatusCode != http.StatusOK {
+		result.Err = fmt.Errorf("metrics endpoint returned status %d", resp.StatusCode)
+		return result
+	}
+
+	exp, err := parseExposition(resp.Header, resp.Body)
+	if err != nil {
+		result.Err = err
+		result.InvalidFormat = true
+		return result
+	}
+	result.Healthy = true
+	result.Format = exp.Format
+	result.Samples = exp.Samples
+	result.Truncated = exp.Truncated
+	result.MetricFamilies = exp.Families
+	return result
+}
+
+// clientFor 返回检查target使用的http.Client，没有TLS配置时复用同一个client，shared为true
+func (p *HTTPProber) clientFor(target ProbeTarget) (client *http.Client, shared bool, err error) {
+	timeout := p.Timeout
+	if timeout == 0 {
+		timeout = probeTimeout
+	}
+	if len(target.CABundle) == 0 && len(target.ClientCert) == 0 && target.ServerName == "" && !target.InsecureSkipVerify {
+		p.once.Do(func() {
+			p.client = &http.Client{Timeout: timeout}
+		})
+		return p.client, true, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         target.ServerName,
+		InsecureSkipVerify: target.InsecureSkipVerify,
+	}
+	if len(target.CABundle) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(target.CABundle) {
+			return nil, false, fmt.Errorf("no valid certificate found in CA bundle")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(target.ClientCert) > 0 {
+		cert, err := tls.X509KeyPair(target.ClientCert, target.ClientKey)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Timeout: timeout, Transport: transport}, false, nil
+}
+
+// ProbeWorkerPool 在Reconcile之外用固定数量的worker异步执行检查，并缓存检查结果，
+// 避免Reconcile被慢速或不可达的端点阻塞
+type ProbeWorkerPool struct {
+	prober  Prober
+	workers int
+	ttl     time.Duration
+	queue   chan ProbeTarget
+
+	mu      sync.Mutex
+	results map[string]ProbeResult
+	pending map[string]bool
+}
+
+// NewProbeWorkerPool 创建ProbeWorkerPool，需要通过manager.Add启动后才会执行检查
+func NewProbeWorkerPool(prober Prober, workers int, ttl time.Duration) *ProbeWorkerPool {
+	return &ProbeWorkerPool{
+		prober:  prober,
+		workers: workers,
+		ttl:     ttl,
+		queue:   make(chan ProbeTarget, probeQueueSize),
+		results: make(map[string]ProbeResult),
+		pending: make(map[string]bool),
+	}
+}
+
+// NewDefaultProbeWorkerPool 使用默认的超时时间、worker数量和结果有效期创建ProbeWorkerPool，
+// 可以由多个Reconciler共用
+func NewDefaultProbeWorkerPool() *ProbeWorkerPool {
+	return NewProbeWorkerPool(&HTTPProber{Timeout: probeTimeout}, probeWorkers, probeResultTTL)
+}
+
+// Result 返回target最近一次的检查结果，从未检查过时返回false。
+// 没有结果或结果已过期时会把target放入检查队列，不会阻塞
+func (p *ProbeWorkerPool) Result(target ProbeTarget) (ProbeResult, bool) {
+	key := target.key()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	result, ok := p.results[key]
+	if ok && time.Since(result.CheckedAt) < p.ttl {
+		return result, true
+	}
+	if !p.pending[key] {
+		select {
+		case p.queue <- target:
+			p.pending[key] = true
+		default:
+			// 队列已满，等待下次Reconcile再放入
+		}
+	}
+	// 过期的结果在重新检查完成前继续使用，避免状态抖动
+	return result, ok
+}
+
+// Start 实现manager.Runnable，启动worker并定期清理长期未被查询的结果
+func (p *ProbeWorkerPool) Start(ctx context.Context) error {
+	for i := 0; i < p.workers; i++ {
+		go p.worker(ctx)
+	}
+
+	ticker := time.NewTicker(p.ttl)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			p.prune()
+		}
+	}
+}
+
+func (p *ProbeWorkerPool) worker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case target := <-p.queue:
+			result := p.prober.Probe(ctx, target)
+			observeProbe(target, result)
+			if result.Err != nil {
+				log.Log.WithValues("metricsEndpoint", target.URL).Info("Metrics endpoint is unhealthy", "error", result.Err.Error())
+			}
+			key := target.key()
+			p.mu.Lock()
+			p.results[key] = result
+			delete(p.pending, key)
+			p.mu.Unlock()
+		}
+	}
+}
+
+// prune 删除长时间没有被查询、已经过期的结果，例如已删除Service的端点
+func (p *ProbeWorkerPool) prune() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, result := range p.results {
+		if time.Since(result.CheckedAt) > 3*p.ttl && !p.pending[key] {
+			delete(p.results, key)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// stubProber 返回固定的检查结果并记录检查次数
+type stubProber struct {
+	healthy atomic.Bool
+	probes  atomic.Int32
+}
+
+func (p *stubProber) Probe(_ context.Context, _ ProbeTarget) ProbeResult {
+	p.probes.Add(1)
+	return ProbeResult{Healthy: p.healthy.Load(), CheckedAt: time.Now()}
+}
+
+var _ = Describe("metrics endpoint probes", func() {
+	It("probes targets asynchronously and caches the results", func() {
+		prober := &stubProber{}
+		prober.healthy.Store(true)
+		pool := NewProbeWorkerPool(prober, 2, 50*time.Millisecond)
+		ctx, cancel := context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+		go func() { _ = pool.Start(ctx) }()
+
+		target := ProbeTarget{URL: "http://10.0.0.1:8080/metrics", Namespace: "demo"}
+		_, ok := pool.Result(target)
+		Expect(ok).To(BeFalse())
+		Eventually(func() bool {
+			result, ok := pool.Result(target)
+			return ok && result.Healthy
+		}).Should(BeTrue())
+		Expect(prober.probes.Load()).To(BeEquivalentTo(1))
+
+		// 过期的结果在重新检查完成前继续返回
+		prober.healthy.Store(false)
+		time.Sleep(60 * time.Millisecond)
+		result, ok := pool.Result(target)
+		Expect(ok).To(BeTrue())
+		Expect(result.Healthy).To(BeTrue())
+		Eventually(func() bool {
+			result, _ := pool.Result(target)
+			return result.Healthy
+		}).Should(BeFalse())
+	})
+
+	It("caches targets with different credentials separately", func() {
+		target := ProbeTarget{URL: "https://10.0.0.1:8443/metrics", BearerToken: "a"}
+		other := target
+		other.BearerToken = "b"
+		Expect(target.key()).NotTo(Equal(other.key()))
+		other.BearerToken = "a"
+		Expect(target.key()).To(Equal(other.key()))
+	})
+
+	It("checks the status, credentials and format of the metrics endpoint", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Header.Get("Authorization") != "Bearer secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if req.URL.Path == "/broken" {
+				_, _ = w.Write([]byte("not metrics {"))
+				return
+			}
+			_, _ = w.Write([]byte("# TYPE up gauge\nup 1\n"))
+		}))
+		DeferCleanup(server.Close)
+		prober := &HTTPProber{Timeout: time.Second}
+
+		result := prober.Probe(context.Background(), ProbeTarget{URL: server.URL + "/metrics"})
+		Expect(result.Healthy).To(BeFalse())
+		Expect(result.StatusCode).To(Equal(http.StatusUnauthorized))
+
+		result = prober.Probe(context.Background(), ProbeTarget{URL: server.URL + "/metrics", BearerToken: "secret"})
+		Expect(result.Healthy).To(BeTrue())
+		Expect(result.Samples).To(Equal(1))
+		Expect(result.MetricFamilies).To(Equal([]string{"up"}))
+
+		result = prober.Probe(context.Background(), ProbeTarget{URL: server.URL + "/broken", BearerToken: "secret"})
+		Expect(result.Healthy).To(BeFalse())
+		Expect(result.InvalidFormat).To(BeTrue())
+	})
+})
@@ -0,0 +1,172 @@
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RelabelingTemplate 合并到生成的ServiceMonitor和PodMonitor每个Endpoint中的relabel配置。
+// relabelings和metricRelabelings的targetLabel、regex和replacement是Go模板，
+// 可以使用.Namespace、.Name、.App、.Kind和.Labels（Service或工作负载的标签），
+// 例如 replacement: '{{ index .Labels "team" }}'
+type RelabelingTemplate struct {
+	// Relabelings 追加到每个Endpoint的relabelings
+	Relabelings []monitoringv1.RelabelConfig `json:"relabelings,omitempty"`
+	// MetricRelabelings 追加到每个Endpoint的metricRelabelings，在DropMetrics和KeepMetrics之后执行
+	MetricRelabelings []monitoringv1.RelabelConfig `json:"metricRelabelings,omitempty"`
+	// TargetLabels 复制到target上的Service标签，PodMonitor中对应Pod的标签
+	TargetLabels []string `json:"targetLabels,omitempty"`
+	// DropMetrics 丢弃名称匹配任意一个正则表达式的metrics
+	DropMetrics []string `json:"dropMetrics,omitempty"`
+	// KeepMetrics 不为空时只保留名称匹配任意一个正则表达式的metrics
+	KeepMetrics []string `json:"keepMetrics,omitempty"`
+}
+
+// relabeling 为一个Service或工作负载渲染后的relabel配置
+type relabeling struct {
+	relabelings       []*monitoringv1.RelabelConfig
+	metricRelabelings []*monitoringv1.RelabelConfig
+	targetLabels      []string
+}
+
+// relabelingTemplates 返回适用于命名空间的relabel模板，集群级的模板在前
+func (o Options) relabelingTemplates(namespace string) []RelabelingTemplate {
+	templates := []RelabelingTemplate{o.Relabeling}
+	if t, ok := o.NamespaceRelabeling[namespace]; ok {
+		templates = append(templates, t)
+	}
+	return templates
+}
+
+// validateRelabeling 校验所有relabel模板中的Go模板和metrics名称正则表达式
+func (o Options) validateRelabeling() error {
+	namespaces := make([]string, 0, len(o.NamespaceRelabeling))
+	for namespace := range o.NamespaceRelabeling {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	validate := func(field string, t RelabelingTemplate) error {
+		for _, configs := range [][]monitoringv1.RelabelConfig{t.Relabelings, t.MetricRelabelings} {
+			for _, config := range configs {
+				for _, text := range []string{config.TargetLabel, config.Regex, config.Replacement} {
+					if _, err := template.New("relabeling").Parse(text); err != nil {
+						return fmt.Errorf("invalid %s: %v", field, err)
+					}
+				}
+			}
+		}
+		for _, expr := range append(append([]string{}, t.DropMetrics...), t.KeepMetrics...) {
+			if _, err := regexp.Compile(expr); err != nil {
+				return fmt.Errorf("invalid %s: %v", field, err)
+			}
+		}
+		return nil
+	}
+	if err := validate("relabeling", o.Relabeling); err != nil {
+		return err
+	}
+	for _, namespace := range namespaces {
+		if err := validate("namespaceRelabeling."+namespace, o.NamespaceRelabeling[namespace]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// relabeling 按obj所在命名空间合并集群级和命名空间级的relabel模板，并用obj渲染其中的Go模板
+func (o Options) relabeling(kind string, obj metav1.Object) (*relabeling, error) {
+	data := templateData(kind, obj)
+	result := &relabeling{}
+	for _, t := range o.relabelingTemplates(obj.GetNamespace()) {
+		relabelings, err := renderRelabelConfigs(t.Relabelings, data)
+		if err != nil {
+			return nil, err
+		}
+		result.relabelings = append(result.relabelings, relabelings...)
+
+		if len(t.DropMetrics) > 0 {
+			result.metricRelabelings = append(result.metricRelabelings, &monitoringv1.RelabelConfig{
+				SourceLabels: []monitoringv1.LabelName{"__name__"},
+				Regex:        strings.Join(t.DropMetrics, "|"),
+				Action:       "drop",
+			})
+		}
+		if len(t.KeepMetrics) > 0 {
+			result.metricRelabelings = append(result.metricRelabelings, &monitoringv1.RelabelConfig{
+				SourceLabels: []monitoringv1.LabelName{"__name__"},
+				Regex:        strings.Join(t.KeepMetrics, "|"),
+				Action:       "keep",
+			})
+		}
+		metricRelabelings, err := renderRelabelConfigs(t.MetricRelabelings, data)
+		if err != nil {
+			return nil, err
+		}
+		result.metricRelabelings = append(result.metricRelabelings, metricRelabelings...)
+
+		for _, label := range t.TargetLabels {
+			if !contains(result.targetLabels, label) {
+				result.targetLabels = append(result.targetLabels, label)
+			}
+		}
+	}
+	return result, nil
+}
+
+// renderRelabelConfigs 渲染relabel配置中的targetLabel、regex和replacement
+func renderRelabelConfigs(configs []monitoringv1.RelabelConfig, data interface{}) ([]*monitoringv1.RelabelConfig, error) {
+	rendered := make([]*monitoringv1.RelabelConfig, 0, len(configs))
+	for _, config := range configs {
+		config := *config.DeepCopy()
+		for _, field := range []*string{&config.TargetLabel, &config.Regex, &config.Replacement} {
+			text, err := renderTemplate(*field, data)
+			if err != nil {
+				return nil, fmt.Errorf("failed to render relabeling: %v", err)
+			}
+			*field = text
+		}
+		rendered = append(rendered, &config)
+	}
+	return rendered, nil
+}
+
+// renderTemplate 渲染relabel配置中的Go模板，不存在的标签渲染为空字符串
+func renderTemplate(text string, data interface{}) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	tmpl, err := template.New("relabeling").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// applyToEndpoints 把relabel配置写入ServiceMonitor的Endpoint
+func (r *relabeling) applyToEndpoints(endpoints []monitoringv1.Endpoint) {
+	for i := range endpoints {
+		endpoints[i].RelabelConfigs = r.relabelings
+		endpoints[i].MetricRelabelConfigs = r.metricRelabelings
+	}
+}
+
+// applyToPodMetricsEndpoints 把relabel配置写入PodMonitor的Endpoint
+func (r *relabeling) applyToPodMetricsEndpoints(endpoints []monitoringv1.PodMetricsEndpoint) {
+	for i := range endpoints {
+		endpoints[i].RelabelConfigs = r.relabelings
+		endpoints[i].MetricRelabelConfigs = r.metricRelabelings
+	}
+}
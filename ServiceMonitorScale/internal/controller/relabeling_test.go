@@ -0,0 +1,80 @@
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("relabeling templates", func() {
+	var (
+		opts    Options
+		service *corev1.Service
+	)
+
+	BeforeEach(func() {
+		opts = DefaultOptions()
+		opts.Relabeling = RelabelingTemplate{
+			DropMetrics:  []string{"go_gc_.*"},
+			TargetLabels: []string{"team"},
+			Relabelings: []monitoringv1.RelabelConfig{{
+				TargetLabel: "cost_center",
+				Replacement: `{{ index .Labels "cost-center" }}`,
+				Action:      "replace",
+			}},
+		}
+		opts.NamespaceRelabeling = map[string]RelabelingTemplate{
+			"demo": {KeepMetrics: []string{"http_.*", "up"}, TargetLabels: []string{"team", "tier"}},
+		}
+		service = &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "api",
+				Namespace: "demo",
+				Labels:    map[string]string{"app": "api", "cost-center": "cc-42"},
+			},
+			Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "http", Port: 8080}}},
+		}
+	})
+
+	It("merges cluster-wide and namespace templates into the ServiceMonitor", func() {
+		Expect(opts.Validate()).To(Succeed())
+		plan, err := opts.PlanService(service)
+		Expect(err).NotTo(HaveOccurred())
+
+		sm := plan.ServiceMonitor
+		Expect(sm.Spec.TargetLabels).To(Equal([]string{"team", "tier"}))
+		ep := sm.Spec.Endpoints[0]
+		Expect(ep.RelabelConfigs).To(HaveLen(2))
+		Expect(ep.RelabelConfigs[0].Action).To(Equal("keep"))
+		Expect(ep.RelabelConfigs[0].Regex).To(Equal("api"))
+		Expect(ep.RelabelConfigs[1].Replacement).To(Equal("cc-42"))
+		Expect(ep.MetricRelabelConfigs).To(HaveLen(2))
+		Expect(ep.MetricRelabelConfigs[0].Action).To(Equal("drop"))
+		Expect(ep.MetricRelabelConfigs[0].Regex).To(Equal("go_gc_.*"))
+		Expect(ep.MetricRelabelConfigs[1].Action).To(Equal("keep"))
+		Expect(ep.MetricRelabelConfigs[1].Regex).To(Equal("http_.*|up"))
+	})
+
+	It("only applies namespace templates to their namespace", func() {
+		service.Namespace = "other"
+		plan, err := opts.PlanService(service)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(plan.ServiceMonitor.Spec.TargetLabels).To(Equal([]string{"team"}))
+		Expect(plan.ServiceMonitor.Spec.Endpoints[0].MetricRelabelConfigs).To(HaveLen(1))
+	})
+
+	It("rejects invalid templates and regular expressions", func() {
+		opts.Relabeling.DropMetrics = []string{"go_("}
+		Expect(opts.Validate()).NotTo(Succeed())
+
+		opts.Relabeling.DropMetrics = nil
+		opts.NamespaceRelabeling["demo"] = RelabelingTemplate{
+			Relabelings: []monitoringv1.RelabelConfig{{Replacement: "{{ .Labels"}},
+		}
+		Expect(opts.Validate()).NotTo(Succeed())
+	})
+})
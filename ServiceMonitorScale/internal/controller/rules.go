@@ -0,0 +1,109 @@
+package controller
+
+import (
+	"fmt"
+	"regexp"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Service不生成ServiceMonitor的原因
+const (
+	skipReasonNamespaceNotWatched = "NamespaceNotWatched"
+	skipReasonScrapeDisabled      = "ScrapeDisabled"
+	skipReasonNotOptedIn          = "NotOptedIn"
+	skipReasonExternalName        = "ExternalName"
+	skipReasonNoPorts             = "NoPorts"
+	skipReasonExcludedType        = "ExcludedType"
+	skipReasonExcludedLabels      = "ExcludedLabels"
+	skipReasonExcludedName        = "ExcludedName"
+	skipReasonNoSelectableLabels  = "NoSelectableLabels"
+)
+
+// serviceRules 由Options编译得到的Service过滤规则
+type serviceRules struct {
+	optIn           bool
+	nonInvasive     bool
+	excludeTypes    []string
+	excludeSelector labels.Selector
+	excludeNames    []*regexp.Regexp
+}
+
+// compileRules 解析Options中的过滤规则
+func (o Options) compileRules() (*serviceRules, error) {
+	rules := &serviceRules{
+		optIn:        o.OptIn,
+		nonInvasive:  o.NonInvasive,
+		excludeTypes: o.ExcludeServiceTypes,
+	}
+	rules.excludeSelector = labels.Nothing()
+	if o.ExcludeSelector != "" {
+		selector, err := labels.Parse(o.ExcludeSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid excludeSelector: %v", err)
+		}
+		rules.excludeSelector = selector
+	}
+	for _, name := range o.ExcludeNames {
+		re, err := regexp.Compile(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid excludeNames %q: %v", name, err)
+		}
+		rules.excludeNames = append(rules.excludeNames, re)
+	}
+	return rules, nil
+}
+
+// workloadSkipReason 返回工作负载不需要生成PodMonitor的原因及说明，需要处理时返回空字符串。
+// 工作负载总是需要通过scrape注解显式开启。selector为空时PodMonitor会选中命名空间中的所有Pod，
+// 例如没有标签的独立Pod，这样的工作负载被跳过
+func (rules *serviceRules) workloadSkipReason(obj metav1.Object, selector *metav1.LabelSelector, cfg *scrapeConfig, ports []corev1.ContainerPort) (string, string) {
+	switch {
+	case !cfg.OptedIn:
+		return skipReasonNotOptedIn, fmt.Sprintf("%s annotation is not true", scrapeAnnotation)
+	case len(ports) == 0:
+		return skipReasonNoPorts, "Pod template has no TCP container ports to scrape"
+	case selector == nil || (len(selector.MatchLabels) == 0 && len(selector.MatchExpressions) == 0):
+		return skipReasonNoSelectableLabels, "Pods have no labels to select them by"
+	case rules.excludeSelector.Matches(labels.Set(obj.GetLabels())):
+		return skipReasonExcludedLabels, fmt.Sprintf("labels match exclude selector %s", rules.excludeSelector)
+	}
+	for _, re := range rules.excludeNames {
+		if re.MatchString(obj.GetName()) {
+			return skipReasonExcludedName, fmt.Sprintf("name matches exclude pattern %s", re)
+		}
+	}
+	return "", ""
+}
+
+// skipReason 返回Service不需要生成ServiceMonitor的原因及说明，需要处理时返回空字符串
+func (rules *serviceRules) skipReason(service *corev1.Service, cfg *scrapeConfig) (string, string) {
+	switch {
+	case !cfg.Enabled:
+		return skipReasonScrapeDisabled, fmt.Sprintf("%s annotation is false", scrapeAnnotation)
+	case rules.optIn && !cfg.OptedIn:
+		return skipReasonNotOptedIn, fmt.Sprintf("opt-in mode is enabled and %s annotation is not true", scrapeAnnotation)
+	case service.Spec.Type == corev1.ServiceTypeExternalName:
+		return skipReasonExternalName, "ExternalName Services have no endpoints to scrape"
+	case len(service.Spec.Ports) == 0:
+		return skipReasonNoPorts, "Service has no ports"
+	case len(cfg.selectedPorts(service)) == 0:
+		return skipReasonNoPorts, "Service has no TCP ports to scrape"
+	case contains(rules.excludeTypes, string(service.Spec.Type)):
+		return skipReasonExcludedType, fmt.Sprintf("Service type %s is excluded", service.Spec.Type)
+	case rules.excludeSelector.Matches(labels.Set(service.Labels)):
+		return skipReasonExcludedLabels, fmt.Sprintf("Service labels match exclude selector %s", rules.excludeSelector)
+	}
+	for _, re := range rules.excludeNames {
+		if re.MatchString(service.Name) {
+			return skipReasonExcludedName, fmt.Sprintf("Service name matches exclude pattern %s", re)
+		}
+	}
+	// 非侵入模式下ServiceMonitor通过Service已有的标签选择Service，没有标签的Service无法被准确选中
+	if rules.nonInvasive && len(service.Labels) == 0 {
+		return skipReasonNoSelectableLabels, "Service has no labels to select it by in non-invasive mode"
+	}
+	return "", ""
+}
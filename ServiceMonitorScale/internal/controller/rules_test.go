@@ -0,0 +1,94 @@
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("serviceRules", func() {
+	var service *corev1.Service
+
+	BeforeEach(func() {
+		service = &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "api",
+				Namespace: "demo",
+				Labels:    map[string]string{"app": "api"},
+			},
+			Spec: corev1.ServiceSpec{
+				Type:  corev1.ServiceTypeClusterIP,
+				Ports: []corev1.ServicePort{{Name: "http", Port: 8080}},
+			},
+		}
+	})
+
+	skipReason := func(opts Options) string {
+		rules, err := opts.compileRules()
+		Expect(err).NotTo(HaveOccurred())
+		cfg, errs := parseScrapeConfig(service, !opts.IgnoreLegacyAnnotations)
+		Expect(errs).To(BeEmpty())
+		reason, _ := rules.skipReason(service, cfg)
+		return reason
+	}
+
+	It("processes a plain ClusterIP Service", func() {
+		Expect(skipReason(DefaultOptions())).To(BeEmpty())
+	})
+
+	It("processes headless Services like any other Service", func() {
+		// 无头Service同样有EndpointSlice，Prometheus按Endpoint发现的target与普通Service相同
+		service.Spec.ClusterIP = corev1.ClusterIPNone
+		Expect(skipReason(DefaultOptions())).To(BeEmpty())
+
+		opts := DefaultOptions()
+		opts.ExcludeNames = []string{"-headless$"}
+		service.Name = "api-headless"
+		Expect(skipReason(opts)).To(Equal(skipReasonExcludedName))
+	})
+
+	It("honors the opt-out annotation", func() {
+		service.Annotations = map[string]string{scrapeAnnotation: "false"}
+		Expect(skipReason(DefaultOptions())).To(Equal(skipReasonScrapeDisabled))
+	})
+
+	It("requires the annotation in opt-in mode", func() {
+		opts := DefaultOptions()
+		opts.OptIn = true
+		Expect(skipReason(opts)).To(Equal(skipReasonNotOptedIn))
+
+		service.Annotations = map[string]string{scrapeAnnotation: "true"}
+		Expect(skipReason(opts)).To(BeEmpty())
+	})
+
+	It("skips ExternalName and port-less Services", func() {
+		service.Spec.Type = corev1.ServiceTypeExternalName
+		Expect(skipReason(DefaultOptions())).To(Equal(skipReasonExternalName))
+
+		service.Spec.Type = corev1.ServiceTypeClusterIP
+		service.Spec.Ports = []corev1.ServicePort{{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP}}
+		Expect(skipReason(DefaultOptions())).To(Equal(skipReasonNoPorts))
+	})
+
+	It("excludes by type, labels and name", func() {
+		opts := DefaultOptions()
+		opts.ExcludeServiceTypes = []string{string(corev1.ServiceTypeClusterIP)}
+		Expect(skipReason(opts)).To(Equal(skipReasonExcludedType))
+
+		opts = DefaultOptions()
+		opts.ExcludeSelector = "app in (api,web)"
+		Expect(skipReason(opts)).To(Equal(skipReasonExcludedLabels))
+
+		opts = DefaultOptions()
+		opts.ExcludeNames = []string{"^kube-", "^ap"}
+		Expect(skipReason(opts)).To(Equal(skipReasonExcludedName))
+	})
+
+	It("rejects invalid exclusion rules", func() {
+		opts := DefaultOptions()
+		opts.ExcludeNames = []string{"("}
+		Expect(opts.Validate()).NotTo(Succeed())
+	})
+})
@@ -3,34 +3,53 @@ package controller
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net/http"
-	"os"
-	"reflect"
 	"strings"
 	"time"
 
 	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
 
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 
 	"k8s.io/apimachinery/pkg/labels"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 )
 
+// fieldManager 控制器写入Service和ServiceMonitor时使用的field manager
+const fieldManager = "servicemonitorscale"
+
 // ServiceReconciler reconciles a Service object
 type ServiceReconciler struct {
 	client.Client
-	Scheme         *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	Probes   *ProbeWorkerPool
+	Options  Options
+	// DryRun 不为空时控制器不执行任何写操作，只把计划执行的修改记录到DryRun中
+	DryRun *DryRunReport
+	// Coverage 不为空时通过它提供Service的覆盖率报告
+	Coverage       *CoverageHandler
 	ServiceAccount string
+
+	namespaces *namespaceFilter
+	rules      *serviceRules
+	// apiReader 不经过缓存读取Service引用的Secret和ConfigMap，缓存中只有ServiceMonitor命名空间的Secret
+	apiReader client.Reader
 }
 
 func (r *ServiceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
@@ -40,246 +59,346 @@ func (r *ServiceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 
 	err := r.Get(ctx, req.NamespacedName, service)
 	if err != nil {
-		//TODO: 没找到对应的Service，需要删除已监听该Service的Monitor
-		log.Log.WithValues("Service", service.Name).Info("Service is deleted.")
+		if !apierrors.IsNotFound(err) {
+			return ctrl.Result{}, err
+		}
+		// 没找到对应的Service，删除由该Service生成的ServiceMonitor
+		log.Log.WithValues("Service", req.NamespacedName.String()).Info("Service is deleted.")
+		serviceStates.forget(req.NamespacedName)
+		forgetSampleLimit(req.NamespacedName)
+		if err := r.deleteServiceMonitors(ctx, req.NamespacedName); err != nil {
+			log.Log.Error(err, "Failed to delete ServiceMonitor of deleted Service")
+			return ctrl.Result{}, err
+		}
 		return ctrl.Result{}, nil
 	}
 
-	// 给Service添加固定的release label,使prometheus operator可以发现该service
-	if service.Labels == nil {
-		service.Labels = make(map[string]string)
+	// 命名空间不再被选中时，清理已生成的ServiceMonitor
+	watched, err := r.namespaces.watched(ctx, service.Namespace)
+	if err != nil {
+		return ctrl.Result{}, err
 	}
-	if _, ok := service.Labels["release"]; !ok {
-		service.Labels["release"] = "kube-prometheus-stack"
-		err := r.Update(ctx, service)
-		if err != nil {
-			log.Log.Error(err, "Failed to update Service with release label")
+	if !watched {
+		log.Log.WithValues("Service", req.NamespacedName.String(), "reason", skipReasonNamespaceNotWatched).Info("Namespace is not watched, skip")
+		serviceStates.forget(req.NamespacedName)
+		forgetSampleLimit(req.NamespacedName)
+		if err := r.deleteServiceMonitors(ctx, req.NamespacedName); err != nil {
 			return ctrl.Result{}, err
 		}
-		log.Log.Info("Label [release: kube-prometheus-stack] added successfully")
+		return ctrl.Result{}, nil
 	}
 
-	// 判断service的port端口名称是否未设置，如果是，那么设置为app标签的值，如果app标签也没有值，那么设置为service的名称
-	r.updateServicePortName(ctx, service)
+	// 解析Service上的拉取配置注解，非法注解以Event的形式报告
+	cfg, errs := parseScrapeConfig(service, !r.Options.IgnoreLegacyAnnotations)
+	for _, e := range errs {
+		r.Recorder.Event(service, corev1.EventTypeWarning, reasonInvalidAnnotation, e.Error())
+	}
+	// 按过滤规则跳过不需要监控的Service，并清理之前生成的ServiceMonitor
+	if reason, message := r.rules.skipReason(service, cfg); reason != "" {
+		log.Log.WithValues("Service", req.NamespacedName.String(), "reason", reason).Info("Skip Service: " + message)
+		if err := r.deleteServiceMonitors(ctx, req.NamespacedName); err != nil {
+			return ctrl.Result{}, err
+		}
+		r.Recorder.Eventf(service, corev1.EventTypeNormal, reasonSkipped, "%s: %s", reason, message)
+		serviceStates.set(req.NamespacedName, stateSkipped, reason)
+		forgetSampleLimit(req.NamespacedName)
+		return ctrl.Result{}, r.writeStatus(ctx, service, nil, metav1.Condition{
+			Status:  metav1.ConditionFalse,
+			Reason:  reason,
+			Message: message,
+		})
+	}
 
-	// 创建或更新ServiceMonitor
-	r.createOrUpdateServiceMonitor(ctx, service)
+	// 非侵入模式下不修改Service，否则只通过server-side apply写入控制器负责的发现标签和端口名称
+	if !r.Options.NonInvasive {
+		if err := r.applyServiceFields(ctx, service); err != nil {
+			log.Log.Error(err, "Failed to apply discovery labels and port names to Service")
+			// 字段已由其他field manager设置为不同的值，需要用户处理
+			if apierrors.IsConflict(err) {
+				r.Recorder.Eventf(service, corev1.EventTypeWarning, conflictReason(err), "Discovery labels or port name are managed by another field manager: %v", err)
+			}
+			return ctrl.Result{}, err
+		}
+		// 已被设置为其他值的发现标签不会被覆盖，ServiceMonitor只通过其余的标签选择Service
+		if conflicts := r.Options.labelConflicts(service); len(conflicts) > 0 {
+			r.Recorder.Eventf(service, corev1.EventTypeWarning, reasonLabelConflict, "Discovery labels %s have different values on the Service; they are not changed and not used to select the Service", strings.Join(conflicts, ","))
+		}
+	}
 
-	return ctrl.Result{}, nil
+	// 创建或更新ServiceMonitor，端点尚未就绪时稍后重新入队
+	return r.createOrUpdateServiceMonitor(ctx, service, cfg)
 }
 
-func (r *ServiceReconciler) updateServicePortName(ctx context.Context, service *corev1.Service) {
-	// 遍历当前service中是否配置了port name
-	appName := service.Labels["app"]
-	if appName == "" {
-		appName = service.Name
-	}
-	updatedPorts := make([]corev1.ServicePort, len(service.Spec.Ports))
-	for i, port := range service.Spec.Ports {
-		if port.Name == "" {
-			//未配置portName，需要设置为appName
-			updatedPorts[i] = corev1.ServicePort{
-				Name:       appName,
-				Port:       port.Port,
-				Protocol:   port.Protocol,
-				TargetPort: port.TargetPort,
-			}
-		} else {
-			updatedPorts[i] = port
-			appName = port.Name
+// applyServiceFields 通过server-side apply给Service添加发现标签，并给未命名的端口设置名称。
+// apply的内容只包含控制器负责的字段，由独立的field manager持有，不会覆盖其他工具管理的字段
+func (r *ServiceReconciler) applyServiceFields(ctx context.Context, service *corev1.Service) error {
+	fieldLabels, fieldPorts, needsApply := r.Options.serviceFields(service)
+	applyLabels := make(map[string]interface{}, len(fieldLabels))
+	for k, v := range fieldLabels {
+		applyLabels[k] = v
+	}
+	applyPorts := make([]interface{}, 0, len(fieldPorts))
+	for _, port := range fieldPorts {
+		applyPorts = append(applyPorts, map[string]interface{}{
+			"port":     int64(port.Port),
+			"protocol": string(port.Protocol),
+			"name":     port.Name,
+		})
+	}
+
+	if !needsApply {
+		if r.DryRun != nil {
+			r.DryRun.resolve("Service", client.ObjectKeyFromObject(service))
 		}
+		return nil
 	}
-	// 创建一个新的 Service 对象来应用更改
-	updatedService := service.DeepCopy()
-	updatedService.Spec.Ports = updatedPorts
 
-	// 应用补丁来更新 Service 的端口名称
-	patchBytes, err := json.Marshal(updatedService)
-	if err != nil {
-		log.Log.Error(err, "failed to marshal updated service")
+	patch := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Service",
+		"metadata": map[string]interface{}{
+			"name":      service.Name,
+			"namespace": service.Namespace,
+			"labels":    applyLabels,
+		},
+	}}
+	if len(applyPorts) > 0 {
+		patch.Object["spec"] = map[string]interface{}{"ports": applyPorts}
 	}
+	if err := r.Patch(ctx, patch, client.Apply, client.FieldOwner(fieldManager)); err != nil {
+		return err
+	}
+	log.Log.WithValues("Service", service.Namespace+"/"+service.Name, "labels", applyLabels, "ports", applyPorts).Info("Service discovery labels and port names applied")
+	if len(applyPorts) > 0 && r.DryRun == nil {
+		if err := r.releasePortOwnership(ctx, patch); err != nil {
+			return err
+		}
+	}
+	current := service.DeepCopy()
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(patch.Object, service); err != nil {
+		return err
+	}
+	if r.DryRun != nil {
+		r.DryRun.planServiceFields(current, service)
+	}
+	return nil
+}
 
-	patch := client.RawPatch(types.MergePatchType, patchBytes)
-	err = r.Patch(ctx, service, patch)
-	// 更新失败的处理
+// releasePortOwnership 在设置端口名称后从控制器的managedFields中删除spec.ports，放弃端口的所有权。
+// 否则控制器与创建Service的工具共同持有端口，之后的apply不包含端口时端口名称会被删除，
+// 其他工具修改端口时也会与控制器冲突。applied为apply返回的Service
+func (r *ServiceReconciler) releasePortOwnership(ctx context.Context, applied *unstructured.Unstructured) error {
+	managedFields := applied.GetManagedFields()
+	released := false
+	for i, entry := range managedFields {
+		if entry.Manager != fieldManager || entry.Operation != metav1.ManagedFieldsOperationApply || entry.FieldsV1 == nil {
+			continue
+		}
+		fields := map[string]interface{}{}
+		if err := json.Unmarshal(entry.FieldsV1.Raw, &fields); err != nil {
+			return err
+		}
+		if _, ok := fields["f:spec"]; !ok {
+			continue
+		}
+		delete(fields, "f:spec")
+		raw, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		managedFields[i].FieldsV1 = &metav1.FieldsV1{Raw: raw}
+		released = true
+	}
+	if !released {
+		return nil
+	}
+	// 带上resourceVersion，Service在此期间被修改时返回冲突并重试
+	data, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": applied.GetResourceVersion(),
+			"managedFields":   managedFields,
+		},
+	})
 	if err != nil {
-		log.Log.Error(err, "failed to update service")
+		return err
 	}
-	//更新成功
-	log.Log.WithValues("PortName", service.Name).Info("Service PortName update success")
-
+	service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: applied.GetNamespace(), Name: applied.GetName()}}
+	if err := r.Patch(ctx, service, client.RawPatch(types.MergePatchType, data)); err != nil {
+		return fmt.Errorf("failed to release ownership of the ports of Service %s/%s: %v", service.Namespace, service.Name, err)
+	}
+	return nil
 }
 
 // createOrUpdateServiceMonitor 根据Service的状态创建或更新ServiceMonitor
-func (r *ServiceReconciler) createOrUpdateServiceMonitor(ctx context.Context, service *corev1.Service) {
+func (r *ServiceReconciler) createOrUpdateServiceMonitor(ctx context.Context, service *corev1.Service, cfg *scrapeConfig) (ctrl.Result, error) {
 
-	// 检查Service是否提供了健康的/metrics端点
-	isHealthy, err := r.checkMetricsEndpoint(service)
+	// 读取TLS和鉴权注解引用的Secret和ConfigMap，引用不存在时等待用户创建
+	authData, err := r.resolveAuth(ctx, service, cfg.Auth)
 	if err != nil {
-		// 如果连接失败，停止监听并返回错误
-		log.Log.Info("Service Metrics is unhealthy, will not create ServiceMonitor")
-		return
+		if !apierrors.IsNotFound(err) && !errors.Is(err, errMissingAuthKey) {
+			return ctrl.Result{}, err
+		}
+		r.Recorder.Eventf(service, corev1.EventTypeWarning, reasonAuthUnavailable, "TLS or auth reference is not available: %v", err)
+		serviceStates.set(client.ObjectKeyFromObject(service), stateUnmonitored, reasonAuthUnavailable)
+		return ctrl.Result{RequeueAfter: probeResultTTL}, r.writeStatus(ctx, service, nil, metav1.Condition{
+			Status:  metav1.ConditionFalse,
+			Reason:  reasonAuthUnavailable,
+			Message: err.Error(),
+		})
 	}
 
-	if !isHealthy {
-		// 如果Service不健康，不创建或更新ServiceMonitor
+	// 检查Service是否提供了健康的/metrics端点
+	status, err := r.checkMetricsEndpoint(ctx, service, cfg, authData)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	healthyPorts := status.healthyPorts
+	result := ctrl.Result{RequeueAfter: status.requeueAfter}
+	if len(healthyPorts) == 0 {
+		// 如果Service没有任何健康的端口，删除之前生成的ServiceMonitor。
+		// 仍在等待检查结果时（例如滚动更新后出现新的后端）保留，避免监控抖动
 		log.Log.Info("Service Metrics is unhealthy, will not create ServiceMonitor")
-		return
-	}
-
-	// 检查当前的service是否已经有了ServiceMonitor
-	// 以下情况说明service有对应的ServiceMonitor
-	// serviceMonitor的标签选择器匹配了对应的service，比如：当前service的label为  app:test， 正好有一个ServiceMonitor的matchlabels也是 app:test，并且这个ServiceMonitor
-	// 监听的Endpoints中对应的portName也刚好是service的PortName，说明完全匹配
-	// 针对不完全匹配的情况，要做如下处理
-	// 1. ServiceMonitor的标签选择器与service不匹配，那么说明这个ServiceMonitor不负责该service，跳过。如果标签选择器匹配，但是endpoint中的portName匹配不上service的portName
-	// 则说明配置错误，这样无法监听到正确的服务，需要修改ServiceMonitor的这个字段。
-	// 2. 如果ServiceMonitor的名字与service名字不通，但是标签选择器与endpoint字段的portname全都能匹配到一个service，说明servicdMonitor的名字需要修改（或者不修改，因为service已经有监控，这个monitor有可能是手动配置的）
-
-	// 1. 列出default下的所有ServiceMonitor
-	smList := &monitoringv1.ServiceMonitorList{}
-	smMap := make(map[string]*monitoringv1.ServiceMonitor)
-	if err := r.List(context.TODO(), &monitoringv1.ServiceMonitorList{}, &client.ListOptions{Namespace: "default"}); err != nil {
-		log.Log.Error(err, "failed to list ServiceMonitors")
-		return
-	}
-	for _, sm := range smList.Items {
-		smMap[sm.Name] = sm.DeepCopy()
-	}
-
-	// 检查 Service 是否已经有相应的 ServiceMonitor
-	createNew := true
-	for _, ep := range service.Spec.Ports {
-		servicePortName := ep.Name
-
-		for _, sm := range smMap {
-			// 检查 ServiceMonitor 的标签选择器是否与 Service 的标签匹配
-			if r.selectorMatchesService(&sm.Spec.Selector, service.Labels) {
-
-				// 检查 ServiceMonitor 的端口是否与 Service 的端口匹配
-				for _, smEP := range sm.Spec.Endpoints {
-					if smEP.Port == servicePortName {
-						log.Log.WithValues("serviceMonitorName", sm.Name).Info("ServiceMonitor already exists for the service")
-						createNew = false
-						// 找到了，看是否要更新对应的ServiceMonitor资源
-						r.updateServiceMonitor(ctx, service, sm)
-						break
-					}
-
-				}
+		reason := status.reason()
+		if reason != reasonMetricsPending {
+			if err := r.deleteServiceMonitors(ctx, client.ObjectKeyFromObject(service)); err != nil {
+				return ctrl.Result{}, err
 			}
 		}
-	}
-	if createNew {
-		r.createServiceMonitor(ctx, service)
-
+		serviceStates.set(client.ObjectKeyFromObject(service), stateUnmonitored, reason)
+		if reason == reasonMetricsUnreachable {
+			r.Recorder.Eventf(service, corev1.EventTypeWarning, reasonMetricsUnreachable, "No healthy metrics endpoint, ServiceMonitor is not generated: %s", status.result())
+		}
+		return result, r.writeStatus(ctx, service, status.statusAnnotations(""), metav1.Condition{
+			Status:  metav1.ConditionFalse,
+			Reason:  reason,
+			Message: "No healthy metrics endpoint: " + status.result(),
+		})
 	}
 
-}
-
-func (r *ServiceReconciler) createServiceMonitor(ctx context.Context, service *corev1.Service) {
-	// 创建ServiceMonitor
-	// 获取app标签的值
-	appName := service.Labels["app"]
-	// 创建ServiceMonitor对象
-	interval := os.Getenv("Interval")
-	if interval == "" {
-		log.Log.Info("未配置metrics拉取时间，统一设置")
-		interval = "15s"
-	}
-	sm := &monitoringv1.ServiceMonitor{
-		TypeMeta: metav1.TypeMeta{
-			Kind:       "ServiceMonitor",
-			APIVersion: "monitoring.coreos.com/v1",
-		},
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      appName,
-			Namespace: "default",
-			Labels: map[string]string{
-				"app":     appName,
-				"release": "kube-prometheus-stack",
-			},
-		},
-		Spec: monitoringv1.ServiceMonitorSpec{
-			NamespaceSelector: monitoringv1.NamespaceSelector{
-				MatchNames: []string{service.Namespace},
-			},
-			Selector: metav1.LabelSelector{
-				MatchLabels: map[string]string{
-					"release": "kube-prometheus-stack",
-					"app":     appName,
-				},
-			},
-			Endpoints: []monitoringv1.Endpoint{
-				{
-					Port:     appName,
-					Interval: monitoringv1.Duration(interval),
-					Path:     "/metrics",
-				},
-			},
-		},
+	// 已被手动维护的ServiceMonitor覆盖的端口不再生成Endpoint，这些ServiceMonitor不会被修改
+	external, err := r.externalServiceMonitors(ctx, service)
+	if err != nil {
+		return ctrl.Result{}, err
 	}
-	existingSm := &monitoringv1.ServiceMonitor{}
-	existingSmNamespacedName := types.NamespacedName{
-		Namespace: sm.Namespace,
-		Name:      sm.Name,
+	var monitors []string
+	ports := healthyPorts
+	for _, sm := range external {
+		covered := coveredPorts(sm, service)
+		if len(covered) == 0 {
+			continue
+		}
+		log.Log.WithValues("Service", service.Namespace+"/"+service.Name, "ServiceMonitor", sm.Namespace+"/"+sm.Name, "ports", covered).V(1).Info("Ports are covered by a ServiceMonitor not generated by the controller")
+		monitors = append(monitors, sm.Namespace+"/"+sm.Name)
+		ports = withoutPorts(ports, covered)
 	}
 
-	if err := r.Get(ctx, existingSmNamespacedName, existingSm); err != nil {
-		log.Log.WithValues("ServiceMonitor", sm.Name).Info("Failed to get ServiceMonitor")
-		err := r.Create(ctx, sm)
+	conflict := false
+	if len(ports) == 0 {
+		// 所有健康的端口都已被覆盖，清理之前生成的ServiceMonitor，避免重复拉取
+		if err := r.deleteServiceMonitors(ctx, client.ObjectKeyFromObject(service)); err != nil {
+			return ctrl.Result{}, err
+		}
+	} else {
+		// ServiceMonitor引用的鉴权内容需要先复制到ServiceMonitor所在的命名空间
+		if err := r.applyAuthSecret(ctx, service, cfg.Auth, authData); err != nil {
+			return ctrl.Result{}, err
+		}
+		sm, err := r.createServiceMonitor(ctx, service, cfg, ports)
 		if err != nil {
-			log.Log.Error(err, "Create ServiceMonitor error")
+			return ctrl.Result{}, err
+		}
+		if sm == nil {
+			conflict = true
+		} else {
+			monitors = append(monitors, sm.Namespace+"/"+sm.Name)
+			if err := r.migrateServiceMonitors(ctx, service, sm); err != nil {
+				return ctrl.Result{}, err
+			}
+			if err := r.applyPrometheusRule(ctx, service, sm); err != nil {
+				return ctrl.Result{}, err
+			}
 		}
-		log.Log.WithValues("ServiceMonitor", sm.Name).Info("ServiceMonitor create successfully")
 	}
 
+	condition := metav1.Condition{
+		Status:  metav1.ConditionTrue,
+		Reason:  reasonMonitorReady,
+		Message: "Monitored by ServiceMonitor " + strings.Join(monitors, ","),
+	}
+	switch {
+	case conflict:
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = reasonMonitorConflict
+		condition.Message = "ServiceMonitor name is taken by a ServiceMonitor not generated for this Service"
+		serviceStates.set(client.ObjectKeyFromObject(service), stateUnmonitored, reasonMonitorConflict)
+	case len(ports) == 0:
+		condition.Reason = reasonMonitoredExternally
+		serviceStates.set(client.ObjectKeyFromObject(service), stateMonitored, "")
+	default:
+		serviceStates.set(client.ObjectKeyFromObject(service), stateMonitored, "")
+	}
+	return result, r.writeStatus(ctx, service, status.statusAnnotations(strings.Join(monitors, ",")), condition)
 }
 
-func (r *ServiceReconciler) updateServiceMonitor(ctx context.Context, service *corev1.Service, serviceMonitor *monitoringv1.ServiceMonitor) (bool, error) {
-
-	// 检查Labels是否需要更新
-	needsUpdate := false
+// createServiceMonitor 创建或更新由该Service生成的ServiceMonitor，同名的ServiceMonitor不属于该Service时返回nil
+func (r *ServiceReconciler) createServiceMonitor(ctx context.Context, service *corev1.Service, cfg *scrapeConfig, ports []corev1.ServicePort) (*monitoringv1.ServiceMonitor, error) {
+	sm, err := r.Options.desiredServiceMonitor(service, cfg, ports)
+	if err != nil {
+		return nil, err
+	}
 
-	// 检查Spec.Selector是否需要更新
-	if !reflect.DeepEqual(serviceMonitor.Spec.Selector, metav1.LabelSelector{
-		MatchLabels: map[string]string{
-			"release": "kube-prometheus-stack",
-			"app":     service.Labels["app"],
-		},
-	}) {
-		serviceMonitor.Spec.Selector = metav1.LabelSelector{
-			MatchLabels: map[string]string{
-				"release": "kube-prometheus-stack",
-				"app":     service.Labels["app"],
-			},
+	existingSm := &monitoringv1.ServiceMonitor{}
+	err = r.Get(ctx, client.ObjectKeyFromObject(sm), existingSm)
+	switch {
+	case apierrors.IsNotFound(err):
+	case err != nil:
+		return nil, err
+	default:
+		// 同名的ServiceMonitor不是由该Service生成的，不接管
+		if owner, ok := ownerOf(existingSm); !ok || owner != client.ObjectKeyFromObject(service) {
+			message := "is not generated by this controller"
+			if ok {
+				message = "is generated for Service " + owner.String()
+			}
+			log.Log.WithValues("ServiceMonitor", sm.Namespace+"/"+sm.Name).Info("ServiceMonitor exists and " + message + ", skip")
+			r.Recorder.Eventf(service, corev1.EventTypeWarning, reasonMonitorConflict, "ServiceMonitor %s/%s exists and %s; set nameTemplate to avoid the collision", sm.Namespace, sm.Name, message)
+			return nil, nil
 		}
-		needsUpdate = true
+		// Endpoint列表是原子类型，需要带上用户额外添加的Endpoint，否则会被apply覆盖
+		sm.Spec.Endpoints = mergeEndpoints(existingSm.Spec.Endpoints, sm.Spec.Endpoints, generatedEndpoints(existingSm))
 	}
+	if _, err := r.applyServiceMonitor(ctx, service, sm, existingSm); err != nil {
+		return nil, err
+	}
+	return sm, nil
+}
 
-	// 检查Spec.Endpoints是否需要更新
-	updatedEndpoint := monitoringv1.Endpoint{
-		Port:     service.Labels["app"],
-		Interval: monitoringv1.Duration(os.Getenv("Interval")),
-		Path:     "/metrics",
+// applyServiceMonitor 以控制器的field manager通过server-side apply写入ServiceMonitor，
+// 其他manager设置的、控制器不负责的字段会被保留。通过resourceVersion是否变化判断是否发生了修改，
+// 发生修改时在Service上记录Event。existing为apply前的ServiceMonitor，不存在时为空对象
+func (r *ServiceReconciler) applyServiceMonitor(ctx context.Context, service *corev1.Service, sm, existing *monitoringv1.ServiceMonitor) (bool, error) {
+	if err := r.Patch(ctx, sm, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership); err != nil {
+		return false, fmt.Errorf("failed to apply ServiceMonitor %s/%s: %v", sm.Namespace, sm.Name, err)
 	}
-	if len(serviceMonitor.Spec.Endpoints) != 1 || !reflect.DeepEqual(serviceMonitor.Spec.Endpoints[0], updatedEndpoint) {
-		serviceMonitor.Spec.Endpoints = []monitoringv1.Endpoint{updatedEndpoint}
-		needsUpdate = true
+	resourceVersion := existing.ResourceVersion
+	changed := sm.ResourceVersion != resourceVersion
+	// dry-run的apply不会修改resourceVersion，通过比较apply前后的内容判断
+	if r.DryRun != nil {
+		changed = r.DryRun.planServiceMonitor(service, existing, sm)
 	}
-
-	// 如果需要更新，则执行更新操作
-	if needsUpdate {
-		err := r.Update(ctx, serviceMonitor)
-		if err != nil {
-			return false, fmt.Errorf("failed to update ServiceMonitor: %v", err)
+	if changed {
+		log.Log.WithValues("ServiceMonitor", sm.Namespace+"/"+sm.Name, "created", resourceVersion == "").Info("ServiceMonitor applied")
+		if resourceVersion == "" {
+			serviceMonitorOperationsTotal.WithLabelValues(operationCreated).Inc()
+			r.Recorder.Eventf(service, corev1.EventTypeNormal, reasonMonitorCreated, "Created ServiceMonitor %s/%s", sm.Namespace, sm.Name)
+		} else {
+			serviceMonitorOperationsTotal.WithLabelValues(operationUpdated).Inc()
+			r.Recorder.Eventf(service, corev1.EventTypeNormal, reasonMonitorUpdated, "Updated ServiceMonitor %s/%s", sm.Namespace, sm.Name)
 		}
-		log.Log.Info("ServiceMonitor updated successfully")
-		return true, nil
+	} else {
+		log.Log.WithValues("ServiceMonitor", sm.Namespace+"/"+sm.Name).Info("ServiceMonitor does not need to be updated")
 	}
-
-	log.Log.Info("ServiceMonitor does not need to be updated")
-	return false, nil
+	return changed, nil
 }
 
 // selectorMatchesService 方法实现
@@ -292,89 +411,156 @@ func (r *ServiceReconciler) selectorMatchesService(selector *metav1.LabelSelecto
 	return selectorSet.Matches(labelSet)
 }
 
-// checkMetricsEndpoint 检查Service是否提供了健康的/metrics端点
-func (r *ServiceReconciler) checkMetricsEndpoint(service *corev1.Service) (bool, error) {
-	// 获取Service关联的所有端口
-	for _, port := range service.Spec.Ports {
-		// 此时port.Name一定存在
-		metricsPort := int(port.Port)
-		// 使用Service名称和端口号构建端点地址
-		serviceDNSName := fmt.Sprintf("%s.%s.svc", service.Name, service.Namespace)
-		metricsEndpoint := fmt.Sprintf("http://%s:%d%s", serviceDNSName, metricsPort, "/metrics")
-		log.Log.WithValues("service", service.Name, "metricsEndpoint", metricsEndpoint).Info("Checking metrics endpoint")
-
-		retryCount := 3
-		retryDelay := 2 * time.Second
-		httpClient := &http.Client{
-			Timeout: 10 * time.Second,
-		}
-		// 发送HTTP GET请求到/metrics端点
-		for i := 0; i < retryCount; i++ {
-			resp, err := httpClient.Get(metricsEndpoint)
-			if err == nil {
-				defer resp.Body.Close()
-				if resp.StatusCode == http.StatusOK {
-					return true, nil
-				}
-				log.Log.WithValues("service", service.Name, "statusCode", resp.StatusCode).Info("Metrics endpoint returned non-200 status")
+// checkMetricsEndpoint 通过EndpointSlice找到Service各端口就绪的后端，逐个查询异步检查结果，
+// 端口只要有一个后端健康、且没有后端暴露的sample数量超过sampleLimit即认为健康，返回各端口的检查结果。
+// 存在尚未检查或不健康的端口时，同时返回Service重新入队的间隔，以便端点恢复后补充监控。
+// authData为resolveAuth读取的鉴权内容
+func (r *ServiceReconciler) checkMetricsEndpoint(ctx context.Context, service *corev1.Service, cfg *scrapeConfig, authData map[string][]byte) (*probeStatus, error) {
+	endpoints, err := r.readyEndpoints(ctx, service)
+	if err != nil {
+		return nil, err
+	}
 
-				return false, nil // 返回nil错误，表示metrics端点不健康或不可访问，但不中断Reconcile过程
-			}
+	limits := r.Options.scrapeLimits(service.Namespace)
+	forgetSampleLimit(client.ObjectKeyFromObject(service))
+	status := &probeStatus{}
+	for _, port := range cfg.selectedPorts(service) {
+		addresses := endpoints[port.Name]
+		if len(addresses) == 0 {
+			// EndpointSlice变化时会重新触发Reconcile，不需要重新入队
+			log.Log.WithValues("service", service.Name, "port", port.Name).Info("No ready endpoints for port")
+			status.add(port.Name, portNoReadyEndpoints)
+			continue
+		}
 
-			// If error is due to timeout or connection refused, stop retrying
-			if strings.Contains(err.Error(), "timeout") || strings.Contains(err.Error(), "connection refused") {
-				log.Log.WithValues("service", service.Name).Info("Failed to reach metrics endpoint after retries")
-				return false, nil // 返回nil错误，表示metrics端点不健康或不可访问，但不中断Reconcile过程
+		healthy, pending, invalidFormat := false, false, false
+		// overLimitSamples 超过sampleLimit的后端中暴露的最多的sample数量
+		overLimit, overLimitTruncated, overLimitSamples := false, false, 0
+		for _, address := range addresses {
+			target := cfg.Auth.probeTarget(ProbeTarget{URL: metricsURL(address, cfg), Namespace: service.Namespace}, authData)
+			result, ok := r.Probes.Result(target)
+			if ok && result.CheckedAt.After(status.checkedAt) {
+				status.checkedAt = result.CheckedAt
+			}
+			switch {
+			case !ok:
+				log.Log.WithValues("service", service.Name, "metricsEndpoint", target.URL).Info("Metrics endpoint not checked yet")
+				pending = true
+			case result.Healthy && limits.exceedsSampleLimit(result):
+				log.Log.WithValues("service", service.Name, "metricsEndpoint", target.URL, "samples", result.Samples, "truncated", result.Truncated, "sampleLimit", *limits.SampleLimit).Info("Metrics endpoint exposes more samples than the sample limit")
+				overLimit = true
+				overLimitTruncated = overLimitTruncated || result.Truncated
+				if result.Samples > overLimitSamples {
+					overLimitSamples = result.Samples
+				}
+			case result.Healthy:
+				log.Log.WithValues("service", service.Name, "metricsEndpoint", target.URL, "format", result.Format, "samples", result.Samples, "metricFamilies", result.MetricFamilies).V(1).Info("Metrics endpoint is healthy")
+				healthy = true
+			case result.InvalidFormat:
+				r.Recorder.Eventf(service, corev1.EventTypeWarning, reasonInvalidMetricsFormat, "Port %s endpoint %s: %v", port.Name, address, result.Err)
+				invalidFormat = true
+			default:
+				log.Log.WithValues("service", service.Name, "metricsEndpoint", target.URL, "statusCode", result.StatusCode).Info("Metrics endpoint is unhealthy")
 			}
+		}
 
-			time.Sleep(retryDelay)
+		switch {
+		case overLimit:
+			// 超过限制的target每次拉取都会被Prometheus拒绝。Endpoint会拉取端口的所有后端，
+			// 即使其他后端健康也不生成Endpoint，之前生成的Endpoint随之删除
+			r.Recorder.Event(service, corev1.EventTypeWarning, reasonSampleLimitExceeded, limits.sampleLimitMessage(port.Name, overLimitSamples, overLimitTruncated))
+			sampleLimitExceeded.WithLabelValues(service.Namespace, service.Name, port.Name).Set(float64(overLimitSamples))
+			status.requeueAfter = shorterRequeue(status.requeueAfter, probeResultTTL)
+			status.add(port.Name, portSampleLimitExceeded)
+		case healthy:
+			status.healthyPorts = append(status.healthyPorts, port)
+			status.add(port.Name, portHealthy)
+		case pending:
+			status.requeueAfter = shorterRequeue(status.requeueAfter, probePendingRequeue)
+			status.add(port.Name, portPending)
+		case invalidFormat:
+			status.requeueAfter = shorterRequeue(status.requeueAfter, probeResultTTL)
+			status.add(port.Name, portInvalidFormat)
+		default:
+			status.requeueAfter = shorterRequeue(status.requeueAfter, probeResultTTL)
+			status.add(port.Name, portUnreachable)
 		}
-		return false, nil // 返回nil错误，表示metrics端点不健康或不可访问，但不中断Reconcile过程
+	}
+	return status, nil
+}
 
+// metricsURL 使用后端地址（ip:targetPort）构建metrics端点地址
+func metricsURL(address string, cfg *scrapeConfig) string {
+	return fmt.Sprintf("%s://%s%s", cfg.scheme(), address, cfg.Path)
+}
+
+// shorterRequeue 返回两个重新入队间隔中较短的一个，0表示不需要重新入队
+func shorterRequeue(a, b time.Duration) time.Duration {
+	if a == 0 || (b != 0 && b < a) {
+		return b
 	}
-	return false, nil
+	return a
 }
 
-// deleteServiceMonitor 删除关联的ServiceMonitor
-// func (r *ServiceReconciler) deleteServiceMonitor(ctx context.Context, namespace string) (ctrl.Result, error) {
-// 	// 定义一个空的ServiceMonitor对象，使用相同的命名空间和名称
-// 	sm := &monitoringv1.ServiceMonitor{
-// 		ObjectMeta: metav1.ObjectMeta{
-// 			Namespace: "default",
-// 			Name:      service.Name,
-// 		},
-// 	}
-//
-// 	// 删除ServiceMonitor
-// 	err := r.Delete(ctx, sm)
-// 	if err != nil {
-// 		if apierrors.IsNotFound(err) {
-// 			// ServiceMonitor已经不存在，无需进一步操作
-// 			return ctrl.Result{}, nil
-// 		}
-// 		// 处理其他错误
-// 		return ctrl.Result{}, err
-// 	}
-//
-// 	// 成功删除ServiceMonitor
-// 	return ctrl.Result{}, nil
-// }
-
-func serviceNamespacePredicate(namespaces []string) predicate.Predicate {
-	return predicate.Funcs{
-		CreateFunc: func(e event.CreateEvent) bool {
-			// 判断是否是目标命名空间的 Service
-			return contains(namespaces, e.Object.GetNamespace())
-		},
-		UpdateFunc: func(e event.UpdateEvent) bool {
-			// 判断是否是目标命名空间的 Service
-			return contains(namespaces, e.ObjectNew.GetNamespace())
-		},
-		DeleteFunc: func(e event.DeleteEvent) bool {
-			// 判断是否是目标命名空间的 Service
-			return contains(namespaces, e.Object.GetNamespace())
-		},
+// mergeEndpoints 用desired中的Endpoint替换existing中端口相同的Endpoint。generated为上次生成的Endpoint，
+// 其中不在desired中的Endpoint被删除，例如端口被删除、不再健康、不再被选中或已被手动维护的ServiceMonitor覆盖；
+// 其余Endpoint是用户添加的，保持原有顺序保留
+func mergeEndpoints(existing, desired []monitoringv1.Endpoint, generated map[string]bool) []monitoringv1.Endpoint {
+	desiredByPort := make(map[string]monitoringv1.Endpoint, len(desired))
+	for _, ep := range desired {
+		desiredByPort[endpointKey(ep)] = ep
+	}
+	merged := make([]monitoringv1.Endpoint, 0, len(existing)+len(desired))
+	for _, ep := range existing {
+		if d, ok := desiredByPort[endpointKey(ep)]; ok {
+			merged = append(merged, d)
+			delete(desiredByPort, endpointKey(ep))
+			continue
+		}
+		if generated == nil || generated[endpointKey(ep)] {
+			continue
+		}
+		merged = append(merged, ep)
+	}
+	for _, ep := range desired {
+		if _, ok := desiredByPort[endpointKey(ep)]; ok {
+			merged = append(merged, ep)
+		}
+	}
+	return merged
+}
+
+// endpointKey 返回Endpoint指向的端口，按端口名称或targetPort区分
+func endpointKey(ep monitoringv1.Endpoint) string {
+	if ep.Port != "" || ep.TargetPort == nil {
+		return ep.Port
+	}
+	return "targetPort/" + ep.TargetPort.String()
+}
+
+// serviceEndpointKeys 返回生成的Endpoint的endpointKey，写入generatedEndpointsAnnotation
+func serviceEndpointKeys(endpoints []monitoringv1.Endpoint) string {
+	keys := make([]string, 0, len(endpoints))
+	for _, ep := range endpoints {
+		keys = append(keys, endpointKey(ep))
+	}
+	return strings.Join(keys, ",")
+}
+
+// generatedEndpoints 返回generatedEndpointsAnnotation中记录的上次生成的Endpoint。
+// 早期版本生成的ServiceMonitor没有该注解，无法区分用户添加的Endpoint，返回nil表示所有Endpoint都是生成的
+func generatedEndpoints(obj metav1.Object) map[string]bool {
+	value, ok := obj.GetAnnotations()[generatedEndpointsAnnotation]
+	if !ok {
+		return nil
+	}
+	generated := map[string]bool{}
+	for _, key := range strings.Split(value, ",") {
+		if key != "" {
+			generated[key] = true
+		}
 	}
+	return generated
 }
 
 func contains(slice []string, value string) bool {
@@ -387,15 +573,66 @@ func contains(slice []string, value string) bool {
 }
 
 func (r *ServiceReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	targetNamespaces := os.Getenv("ServiceNamespaces")
-	if targetNamespaces == "" {
-		targetNamespaces = "demo"
+	if err := r.Options.Validate(); err != nil {
+		return err
+	}
+
+	// dry-run模式下所有写请求都以dryRun=All发送，由API server计算结果但不持久化，Event只记录日志
+	if r.DryRun != nil {
+		r.Client = client.NewDryRunClient(r.Client)
+		r.Recorder = dryRunRecorder{}
+		if err := metrics.Registry.Register(r.DryRun); err != nil {
+			return err
+		}
+	}
+
+	r.apiReader = mgr.GetAPIReader()
+	var err error
+	if r.namespaces, err = r.Options.namespaceFilter(r.Client); err != nil {
+		return err
+	}
+	if r.rules, err = r.Options.compileRules(); err != nil {
+		return err
+	}
+
+	if r.Coverage != nil {
+		r.Coverage.setSource(r.coverage)
+	}
+
+	// 在Reconcile之外异步检查metrics端点，外部传入的ProbeWorkerPool由调用方启动
+	if r.Probes == nil {
+		r.Probes = NewDefaultProbeWorkerPool()
+		if err := mgr.Add(r.Probes); err != nil {
+			return err
+		}
 	}
 
-	namespaces := strings.Split(targetNamespaces, ",")
+	// 按选择的命名空间和标签索引ServiceMonitor，用于找到覆盖Service的手动维护的ServiceMonitor
+	if err := indexServiceMonitors(context.Background(), mgr.GetFieldIndexer()); err != nil {
+		return err
+	}
+
+	// 启动时清理控制器停止期间产生的孤儿ServiceMonitor
+	if err := mgr.Add(manager.RunnableFunc(r.collectOrphanServiceMonitors)); err != nil {
+		return err
+	}
 
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.Service{}, builder.WithPredicates(serviceNamespacePredicate(namespaces))).
-		//Owns(&monitoringv1.ServiceMonitor{}).
-		Complete(r)
+	b := ctrl.NewControllerManagedBy(mgr).
+		For(&corev1.Service{}, builder.WithPredicates(r.namespaces.predicate())).
+		// 后端就绪状态变化时重新检查对应的Service
+		Watches(&discoveryv1.EndpointSlice{},
+			handler.EnqueueRequestsFromMapFunc(endpointSliceToService),
+			builder.WithPredicates(r.namespaces.predicate())).
+		// ServiceMonitor与Service不在同一命名空间，无法使用Owns，通过归属标签或标签选择器找到对应的Service
+		Watches(&monitoringv1.ServiceMonitor{},
+			handler.EnqueueRequestsFromMapFunc(r.serviceMonitorToServices)).
+		// 命名空间被选中或取消选中时，重新处理其中的所有Service
+		Watches(&corev1.Namespace{},
+			handler.EnqueueRequestsFromMapFunc(r.namespaceToServices),
+			builder.WithPredicates(predicate.LabelChangedPredicate{}))
+	// 没有开启告警时集群中可以没有PrometheusRule CRD，不能watch
+	if r.Options.Alerts.Enabled {
+		b = b.Watches(&monitoringv1.PrometheusRule{}, handler.EnqueueRequestsFromMapFunc(prometheusRuleToService))
+	}
+	return b.Complete(r)
 }
@@ -0,0 +1,260 @@
+package controller
+
+import (
+	"context"
+	"errors"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+var _ = Describe("generated ServiceMonitor endpoints", func() {
+	var (
+		ctx     context.Context
+		c       client.Client
+		r       *ServiceReconciler
+		service *corev1.Service
+		cfg     *scrapeConfig
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		scheme := runtime.NewScheme()
+		Expect(corev1.AddToScheme(scheme)).To(Succeed())
+		Expect(monitoringv1.AddToScheme(scheme)).To(Succeed())
+		c = withApply(fake.NewClientBuilder().WithScheme(scheme)).Build()
+		r = &ServiceReconciler{Client: c, Options: DefaultOptions(), Recorder: record.NewFakeRecorder(10)}
+		service = &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "demo", Labels: map[string]string{"app": "api"}},
+			Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{
+				{Name: "http", Port: 8080},
+				{Name: "admin", Port: 9090},
+			}},
+		}
+		cfg, _ = parseScrapeConfig(service, false)
+	})
+
+	get := func(sm *monitoringv1.ServiceMonitor) *monitoringv1.ServiceMonitor {
+		current := &monitoringv1.ServiceMonitor{}
+		Expect(c.Get(ctx, client.ObjectKeyFromObject(sm), current)).To(Succeed())
+		return current
+	}
+	ports := func(sm *monitoringv1.ServiceMonitor) []string {
+		var names []string
+		for _, ep := range sm.Spec.Endpoints {
+			names = append(names, ep.Port)
+		}
+		return names
+	}
+
+	It("prunes endpoints of removed ports and keeps endpoints added by users", func() {
+		sm, err := r.createServiceMonitor(ctx, service, cfg, service.Spec.Ports)
+		Expect(err).NotTo(HaveOccurred())
+		current := get(sm)
+		Expect(ports(current)).To(Equal([]string{"http", "admin"}))
+		Expect(current.Annotations[generatedEndpointsAnnotation]).To(Equal("http,admin"))
+
+		current.Spec.Endpoints = append(current.Spec.Endpoints, monitoringv1.Endpoint{Port: "debug"})
+		Expect(c.Update(ctx, current)).To(Succeed())
+
+		service.Spec.Ports = service.Spec.Ports[:1]
+		sm, err = r.createServiceMonitor(ctx, service, cfg, service.Spec.Ports)
+		Expect(err).NotTo(HaveOccurred())
+		current = get(sm)
+		Expect(ports(current)).To(Equal([]string{"http", "debug"}))
+		Expect(current.Annotations[generatedEndpointsAnnotation]).To(Equal("http"))
+	})
+
+	It("replaces all endpoints of monitors generated without the annotation", func() {
+		sm, err := r.createServiceMonitor(ctx, service, cfg, service.Spec.Ports)
+		Expect(err).NotTo(HaveOccurred())
+		current := get(sm)
+		delete(current.Annotations, generatedEndpointsAnnotation)
+		Expect(c.Update(ctx, current)).To(Succeed())
+
+		sm, err = r.createServiceMonitor(ctx, service, cfg, service.Spec.Ports[1:])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ports(get(sm))).To(Equal([]string{"admin"}))
+	})
+})
+
+var _ = Describe("Service fields", func() {
+	var (
+		ctx     context.Context
+		c       client.Client
+		r       *ServiceReconciler
+		service *corev1.Service
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		service = &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "demo", Labels: map[string]string{"app": "api"}},
+			Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 8080}}},
+		}
+		scheme := runtime.NewScheme()
+		Expect(corev1.AddToScheme(scheme)).To(Succeed())
+		c = withApply(fake.NewClientBuilder().WithScheme(scheme)).WithObjects(service.DeepCopy()).Build()
+		r = &ServiceReconciler{Client: c, Options: DefaultOptions(), Recorder: record.NewFakeRecorder(10)}
+	})
+
+	It("only applies the port of a Service that has no port name", func() {
+		fieldLabels, fieldPorts, needsApply := r.Options.serviceFields(service)
+		Expect(needsApply).To(BeTrue())
+		Expect(fieldLabels).To(Equal(map[string]string{"release": "kube-prometheus-stack"}))
+		Expect(fieldPorts).To(Equal([]corev1.ServicePort{{Name: "api", Port: 8080, Protocol: corev1.ProtocolTCP}}))
+
+		Expect(r.applyServiceFields(ctx, service)).To(Succeed())
+		current := &corev1.Service{}
+		Expect(c.Get(ctx, client.ObjectKeyFromObject(service), current)).To(Succeed())
+		Expect(current.Labels).To(HaveKeyWithValue("release", "kube-prometheus-stack"))
+		Expect(current.Spec.Ports[0].Name).To(Equal("api"))
+
+		_, fieldPorts, needsApply = r.Options.serviceFields(current)
+		Expect(needsApply).To(BeFalse())
+		Expect(fieldPorts).To(BeEmpty())
+	})
+
+	It("does not name the port after an invalid app label", func() {
+		service.Labels["app"] = "Billing.API"
+		Expect(c.Update(ctx, service.DeepCopy())).To(Succeed())
+		_, fieldPorts, _ := r.Options.serviceFields(service)
+		Expect(fieldPorts).To(BeEmpty())
+
+		Expect(r.applyServiceFields(ctx, service)).To(Succeed())
+		current := &corev1.Service{}
+		Expect(c.Get(ctx, client.ObjectKeyFromObject(service), current)).To(Succeed())
+		Expect(current.Labels).To(HaveKeyWithValue("release", "kube-prometheus-stack"))
+		Expect(current.Spec.Ports[0].Name).To(BeEmpty())
+	})
+
+	It("leaves a discovery label with another value alone", func() {
+		service.Labels["release"] = "my-helm-release"
+		Expect(c.Update(ctx, service.DeepCopy())).To(Succeed())
+		fieldLabels, _, _ := r.Options.serviceFields(service)
+		Expect(fieldLabels).To(BeEmpty())
+		Expect(r.Options.labelConflicts(service)).To(Equal([]string{"release"}))
+
+		Expect(r.applyServiceFields(ctx, service)).To(Succeed())
+		current := &corev1.Service{}
+		Expect(c.Get(ctx, client.ObjectKeyFromObject(service), current)).To(Succeed())
+		Expect(current.Labels).To(HaveKeyWithValue("release", "my-helm-release"))
+		Expect(r.Options.monitorSelector(current)).To(Equal(map[string]string{"app": "api"}))
+	})
+
+	It("releases the ports after naming them and keeps the labels", func() {
+		current := &corev1.Service{}
+		Expect(c.Get(ctx, client.ObjectKeyFromObject(service), current)).To(Succeed())
+		current.ManagedFields = []metav1.ManagedFieldsEntry{
+			{Manager: "kubectl", Operation: metav1.ManagedFieldsOperationApply, FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:spec":{"f:ports":{}}}`)}},
+			{Manager: fieldManager, Operation: metav1.ManagedFieldsOperationApply, FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:metadata":{"f:labels":{"f:release":{}}},"f:spec":{"f:ports":{}}}`)}},
+		}
+		Expect(c.Update(ctx, current)).To(Succeed())
+		applied := &unstructured.Unstructured{}
+		applied.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Service"))
+		Expect(c.Get(ctx, client.ObjectKeyFromObject(service), applied)).To(Succeed())
+
+		Expect(r.releasePortOwnership(ctx, applied)).To(Succeed())
+		Expect(c.Get(ctx, client.ObjectKeyFromObject(service), current)).To(Succeed())
+		Expect(current.ManagedFields).To(HaveLen(2))
+		Expect(string(current.ManagedFields[0].FieldsV1.Raw)).To(Equal(`{"f:spec":{"f:ports":{}}}`))
+		Expect(string(current.ManagedFields[1].FieldsV1.Raw)).To(Equal(`{"f:metadata":{"f:labels":{"f:release":{}}}}`))
+	})
+
+	It("only scrapes the Service itself when other Services share its labels", func() {
+		r.Options.NonInvasive = true
+		service.Spec.Ports[0].Name = "http"
+		cfg, _ := parseScrapeConfig(service, false)
+		sm, err := r.Options.desiredServiceMonitor(service, cfg, service.Spec.Ports)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sm.Spec.Selector.MatchLabels).To(Equal(map[string]string{"app": "api"}))
+		Expect(sm.Spec.Endpoints[0].RelabelConfigs[0]).To(Equal(&monitoringv1.RelabelConfig{
+			SourceLabels: []monitoringv1.LabelName{"__meta_kubernetes_service_name"},
+			Regex:        "api",
+			Action:       "keep",
+		}))
+	})
+})
+
+var _ = Describe("field managers", func() {
+	// appliedBy 记录每次apply的对象类型、子资源和field manager
+	type appliedBy struct {
+		kind, subResource, manager string
+		force                      bool
+	}
+
+	It("applies ServiceMonitors and Service status under separate field managers", func() {
+		var applies []appliedBy
+		recordApply := func(obj client.Object, subResource string, patch client.Patch, opts []client.PatchOption) {
+			Expect(patch.Type()).To(Equal(types.ApplyPatchType))
+			po := &client.PatchOptions{}
+			po.ApplyOptions(opts)
+			kind := obj.GetObjectKind().GroupVersionKind().Kind
+			applies = append(applies, appliedBy{kind: kind, subResource: subResource, manager: po.FieldManager, force: po.Force != nil && *po.Force})
+		}
+		scheme := runtime.NewScheme()
+		Expect(corev1.AddToScheme(scheme)).To(Succeed())
+		Expect(monitoringv1.AddToScheme(scheme)).To(Succeed())
+		c := fake.NewClientBuilder().WithScheme(scheme).WithInterceptorFuncs(interceptor.Funcs{
+			Patch: func(_ context.Context, _ client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+				recordApply(obj, "", patch, opts)
+				return nil
+			},
+			SubResourcePatch: func(_ context.Context, _ client.Client, subResource string, obj client.Object, patch client.Patch, opts ...client.SubResourcePatchOption) error {
+				po := &client.SubResourcePatchOptions{}
+				po.ApplyOptions(opts)
+				recordApply(obj, subResource, patch, []client.PatchOption{&po.PatchOptions})
+				return nil
+			},
+		}).Build()
+		r := &ServiceReconciler{Client: c, Options: DefaultOptions(), Recorder: record.NewFakeRecorder(10)}
+		service := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "demo", Labels: map[string]string{"app": "api"}},
+			Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "http", Port: 8080}}},
+		}
+		cfg, _ := parseScrapeConfig(service, false)
+
+		_, err := r.createServiceMonitor(context.Background(), service, cfg, service.Spec.Ports)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.writeStatus(context.Background(), service, map[string]string{lastProbeResultAnnotation: "http=Healthy"}, metav1.Condition{
+			Status: metav1.ConditionTrue,
+			Reason: reasonMonitorReady,
+		})).To(Succeed())
+
+		Expect(applies).To(Equal([]appliedBy{
+			{kind: monitoringv1.ServiceMonitorsKind, manager: fieldManager, force: true},
+			{kind: "Service", manager: statusFieldManager, force: true},
+			{kind: "Service", subResource: "status", manager: statusFieldManager, force: true},
+		}))
+	})
+
+	It("returns apply errors so the Service is retried", func() {
+		scheme := runtime.NewScheme()
+		Expect(monitoringv1.AddToScheme(scheme)).To(Succeed())
+		c := fake.NewClientBuilder().WithScheme(scheme).WithInterceptorFuncs(interceptor.Funcs{
+			Patch: func(context.Context, client.WithWatch, client.Object, client.Patch, ...client.PatchOption) error {
+				return errors.New("connection refused")
+			},
+		}).Build()
+		r := &ServiceReconciler{Client: c, Options: DefaultOptions(), Recorder: record.NewFakeRecorder(10)}
+		service := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "demo", Labels: map[string]string{"app": "api"}},
+			Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "http", Port: 8080}}},
+		}
+		cfg, _ := parseScrapeConfig(service, false)
+		_, err := r.createServiceMonitor(context.Background(), service, cfg, service.Spec.Ports)
+		Expect(err).To(MatchError(ContainSubstring("connection refused")))
+	})
+})
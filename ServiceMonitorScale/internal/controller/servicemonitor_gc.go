@@ -0,0 +1,243 @@
+package controller
+
+import (
+	"context"
+	"reflect"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// ServiceMonitor与Service通常不在同一个命名空间，无法使用OwnerReference，
+// 因此通过以下标签记录ServiceMonitor由哪个Service生成
+const (
+	managedByLabel      = "app.kubernetes.io/managed-by"
+	managedByValue      = "servicemonitorscale"
+	ownerNameLabel      = "servicemonitorscale.tal.com/service-name"
+	ownerNamespaceLabel = "servicemonitorscale.tal.com/service-namespace"
+)
+
+// generatedEndpointsAnnotation 记录控制器在ServiceMonitor或PodMonitor中生成的Endpoint（按endpointKey，逗号分隔）。
+// Endpoint列表是原子类型，更新时需要保留用户额外添加的Endpoint，同时删除不再需要的生成的Endpoint
+const generatedEndpointsAnnotation = "servicemonitorscale.tal.com/generated-endpoints"
+
+// ownerLabels 返回标识ServiceMonitor归属于该Service的标签
+func ownerLabels(service types.NamespacedName) map[string]string {
+	return map[string]string{
+		managedByLabel:      managedByValue,
+		ownerNameLabel:      service.Name,
+		ownerNamespaceLabel: service.Namespace,
+	}
+}
+
+// ownerOf 返回生成该ServiceMonitor或鉴权Secret的Service，不是本控制器生成的返回false
+func ownerOf(obj metav1.Object) (types.NamespacedName, bool) {
+	objLabels := obj.GetLabels()
+	if objLabels[managedByLabel] != managedByValue {
+		return types.NamespacedName{}, false
+	}
+	owner := types.NamespacedName{
+		Namespace: objLabels[ownerNamespaceLabel],
+		Name:      objLabels[ownerNameLabel],
+	}
+	if owner.Name == "" || owner.Namespace == "" {
+		return types.NamespacedName{}, false
+	}
+	return owner, true
+}
+
+// deleteServiceMonitors 删除由指定Service生成的所有ServiceMonitor及其鉴权Secret和PrometheusRule
+func (r *ServiceReconciler) deleteServiceMonitors(ctx context.Context, service types.NamespacedName) error {
+	smList := &monitoringv1.ServiceMonitorList{}
+	if err := r.List(ctx, smList, client.MatchingLabels(ownerLabels(service))); err != nil {
+		return err
+	}
+	for _, sm := range smList.Items {
+		if err := r.Delete(ctx, sm); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		if r.DryRun != nil {
+			r.DryRun.planDelete(monitoringv1.ServiceMonitorsKind, client.ObjectKeyFromObject(sm), service.String())
+			continue
+		}
+		serviceMonitorOperationsTotal.WithLabelValues(operationDeleted).Inc()
+		log.Log.WithValues("Service", service.String(), "ServiceMonitor", sm.Namespace+"/"+sm.Name).Info("ServiceMonitor deleted")
+	}
+	if err := r.deletePrometheusRules(ctx, service, ""); err != nil {
+		return err
+	}
+	return r.deleteAuthSecrets(ctx, service)
+}
+
+// collectOrphanServiceMonitors 清理Service已经不存在或所在命名空间不再被选中的ServiceMonitor、鉴权Secret和PrometheusRule，
+// 用于处理控制器停止期间被删除的Service和取消选中的命名空间。在manager启动、成为leader后执行一次
+func (r *ServiceReconciler) collectOrphanServiceMonitors(ctx context.Context) error {
+	smList := &monitoringv1.ServiceMonitorList{}
+	if err := r.List(ctx, smList, client.MatchingLabels{managedByLabel: managedByValue}); err != nil {
+		// 返回错误会导致manager退出，这里只记录日志
+		log.Log.Error(err, "failed to list ServiceMonitors for garbage collection")
+		return nil
+	}
+	for _, sm := range smList.Items {
+		owner, ok := ownerOf(sm)
+		if !ok {
+			continue
+		}
+		if !r.serviceGone(ctx, owner) {
+			continue
+		}
+		if err := r.Delete(ctx, sm); err != nil && !apierrors.IsNotFound(err) {
+			log.Log.Error(err, "failed to delete orphan ServiceMonitor", "ServiceMonitor", sm.Namespace+"/"+sm.Name)
+			continue
+		}
+		if r.DryRun != nil {
+			r.DryRun.planDelete(monitoringv1.ServiceMonitorsKind, client.ObjectKeyFromObject(sm), owner.String())
+			continue
+		}
+		serviceMonitorOperationsTotal.WithLabelValues(operationDeleted).Inc()
+		log.Log.WithValues("Service", owner.String(), "ServiceMonitor", sm.Namespace+"/"+sm.Name).Info("Orphan ServiceMonitor deleted")
+	}
+	r.collectLegacyServiceMonitors(ctx)
+
+	secrets := &corev1.SecretList{}
+	if err := r.List(ctx, secrets, client.InNamespace(r.Options.MonitorNamespace), client.MatchingLabels{managedByLabel: managedByValue}); err != nil {
+		log.Log.Error(err, "failed to list auth Secrets for garbage collection")
+		return nil
+	}
+	for i := range secrets.Items {
+		owner, ok := ownerOf(&secrets.Items[i])
+		if !ok {
+			continue
+		}
+		if !r.serviceGone(ctx, owner) {
+			continue
+		}
+		if err := r.deleteAuthSecrets(ctx, owner); err != nil {
+			log.Log.Error(err, "failed to delete orphan auth Secret", "Service", owner.String())
+		}
+	}
+	r.collectOrphanPrometheusRules(ctx)
+	return nil
+}
+
+// serviceGone 判断owner生成的监控对象是否应该删除：Service不存在，或所在命名空间不再被选中。
+// 读取失败时记录日志并返回false，不删除任何对象
+func (r *ServiceReconciler) serviceGone(ctx context.Context, owner types.NamespacedName) bool {
+	err := r.Get(ctx, owner, &corev1.Service{})
+	if apierrors.IsNotFound(err) {
+		return true
+	}
+	if err != nil {
+		log.Log.Error(err, "failed to get Service", "Service", owner.String())
+		return false
+	}
+	return r.namespaces.unwatched(ctx, owner.Namespace)
+}
+
+// migrateServiceMonitors 在sm生成后删除该Service之前以其他名称或在其他命名空间生成的ServiceMonitor，
+// 用于修改名称模板或monitorNamespace后迁移到新的名称。
+// 早期版本生成的ServiceMonitor没有归属标签，以app标签命名，只选择该Service的命名空间和app标签，
+// 符合这些特征的ServiceMonitor同样被视为该Service生成的并删除
+func (r *ServiceReconciler) migrateServiceMonitors(ctx context.Context, service *corev1.Service, sm *monitoringv1.ServiceMonitor) error {
+	owner := client.ObjectKeyFromObject(service)
+	smList := &monitoringv1.ServiceMonitorList{}
+	if err := r.List(ctx, smList, client.MatchingLabels(ownerLabels(owner))); err != nil {
+		return err
+	}
+	stale := make([]*monitoringv1.ServiceMonitor, 0, len(smList.Items))
+	for _, existing := range smList.Items {
+		if existing.Namespace != sm.Namespace || existing.Name != sm.Name {
+			stale = append(stale, existing)
+		}
+	}
+
+	if app := service.Labels["app"]; app != "" && app != sm.Name {
+		legacy := &monitoringv1.ServiceMonitor{}
+		err := r.Get(ctx, types.NamespacedName{Namespace: r.Options.MonitorNamespace, Name: app}, legacy)
+		switch {
+		case apierrors.IsNotFound(err):
+		case err != nil:
+			return err
+		case isLegacyServiceMonitor(legacy, service):
+			stale = append(stale, legacy)
+		}
+	}
+
+	for _, existing := range stale {
+		if err := r.Delete(ctx, existing); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		if r.DryRun != nil {
+			r.DryRun.planDelete(monitoringv1.ServiceMonitorsKind, client.ObjectKeyFromObject(existing), owner.String())
+			continue
+		}
+		serviceMonitorOperationsTotal.WithLabelValues(operationDeleted).Inc()
+		log.Log.WithValues("Service", owner.String(), "ServiceMonitor", existing.Namespace+"/"+existing.Name).Info("ServiceMonitor migrated to " + sm.Namespace + "/" + sm.Name)
+		r.Recorder.Eventf(service, corev1.EventTypeNormal, reasonMonitorMigrated, "Replaced ServiceMonitor %s/%s with %s/%s", existing.Namespace, existing.Name, sm.Namespace, sm.Name)
+	}
+	return nil
+}
+
+// collectLegacyServiceMonitors 清理早期版本生成、对应的Service已经不存在的ServiceMonitor。
+// 这些ServiceMonitor没有归属标签，只能按生成时的特征识别：位于monitorNamespace，以app标签命名，
+// 只带有app和release标签，只选择一个命名空间中带这两个标签的Service，且唯一的endpoint拉取以app命名的端口。
+// 该命名空间中仍有带该app标签的Service时保留，由该Service的Reconcile负责迁移
+func (r *ServiceReconciler) collectLegacyServiceMonitors(ctx context.Context) {
+	smList := &monitoringv1.ServiceMonitorList{}
+	if err := r.List(ctx, smList, client.InNamespace(r.Options.MonitorNamespace)); err != nil {
+		log.Log.Error(err, "failed to list ServiceMonitors for garbage collection")
+		return
+	}
+	for _, sm := range smList.Items {
+		namespace, app, ok := legacyOwnerOf(sm)
+		if !ok || len(sm.Spec.Endpoints) != 1 || sm.Spec.Endpoints[0].Port != app {
+			continue
+		}
+		services := &corev1.ServiceList{}
+		if err := r.List(ctx, services, client.InNamespace(namespace), client.MatchingLabels{"app": app}); err != nil {
+			log.Log.Error(err, "failed to list Services", "Namespace", namespace)
+			continue
+		}
+		if len(services.Items) > 0 {
+			continue
+		}
+		if err := r.Delete(ctx, sm); err != nil && !apierrors.IsNotFound(err) {
+			log.Log.Error(err, "failed to delete orphan ServiceMonitor", "ServiceMonitor", sm.Namespace+"/"+sm.Name)
+			continue
+		}
+		if r.DryRun != nil {
+			r.DryRun.planDelete(monitoringv1.ServiceMonitorsKind, client.ObjectKeyFromObject(sm), namespace+"/"+app)
+			continue
+		}
+		serviceMonitorOperationsTotal.WithLabelValues(operationDeleted).Inc()
+		log.Log.WithValues("Namespace", namespace, "App", app, "ServiceMonitor", sm.Namespace+"/"+sm.Name).Info("Orphan legacy ServiceMonitor deleted")
+	}
+}
+
+// legacyRelease 早期版本写入ServiceMonitor标签和selector的release标签的值
+const legacyRelease = "kube-prometheus-stack"
+
+// legacyOwnerOf 按早期版本生成的特征返回ServiceMonitor选择的命名空间和app标签，不符合时返回false。
+// 早期版本总是只设置app和release两个标签，selector也只包含这两个标签，带有其他标签的视为手动维护
+func legacyOwnerOf(sm *monitoringv1.ServiceMonitor) (string, string, bool) {
+	app := sm.Labels["app"]
+	legacyLabels := map[string]string{"app": app, "release": legacyRelease}
+	if app == "" || sm.Name != app || !reflect.DeepEqual(sm.Labels, legacyLabels) ||
+		!reflect.DeepEqual(sm.Spec.Selector.MatchLabels, legacyLabels) || len(sm.Spec.Selector.MatchExpressions) != 0 ||
+		len(sm.Spec.NamespaceSelector.MatchNames) != 1 {
+		return "", "", false
+	}
+	return sm.Spec.NamespaceSelector.MatchNames[0], app, true
+}
+
+// isLegacyServiceMonitor 判断没有归属标签的ServiceMonitor是否是早期版本为该Service生成的
+func isLegacyServiceMonitor(sm *monitoringv1.ServiceMonitor, service *corev1.Service) bool {
+	namespace, app, ok := legacyOwnerOf(sm)
+	return ok && namespace == service.Namespace && app == service.Labels["app"]
+}
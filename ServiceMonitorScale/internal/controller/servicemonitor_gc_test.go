@@ -0,0 +1,88 @@
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("orphan ServiceMonitor garbage collection", func() {
+	generated := func(name string, owner types.NamespacedName) *monitoringv1.ServiceMonitor {
+		return &monitoringv1.ServiceMonitor{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "monitoring", Labels: ownerLabels(owner)}}
+	}
+	legacy := func(app string) *monitoringv1.ServiceMonitor {
+		return &monitoringv1.ServiceMonitor{
+			ObjectMeta: metav1.ObjectMeta{Name: app, Namespace: "monitoring", Labels: map[string]string{"app": app, "release": "kube-prometheus-stack"}},
+			Spec: monitoringv1.ServiceMonitorSpec{
+				NamespaceSelector: monitoringv1.NamespaceSelector{MatchNames: []string{"demo"}},
+				Selector:          metav1.LabelSelector{MatchLabels: map[string]string{"app": app, "release": "kube-prometheus-stack"}},
+				Endpoints:         []monitoringv1.Endpoint{{Port: app, Path: "/metrics"}},
+			},
+		}
+	}
+
+	It("deletes monitors whose Service no longer exists or is in an unwatched Namespace, including legacy unlabeled monitors", func() {
+		scheme := runtime.NewScheme()
+		Expect(corev1.AddToScheme(scheme)).To(Succeed())
+		Expect(monitoringv1.AddToScheme(scheme)).To(Succeed())
+		handWritten := legacy("custom")
+		handWritten.Spec.Endpoints = []monitoringv1.Endpoint{{Port: "metrics"}}
+		// 与早期版本形状相同、但带有其他标签或没有release标签的ServiceMonitor是手动维护的
+		labeled := legacy("team")
+		labeled.Labels["team"] = "payments"
+		unreleased := legacy("batch")
+		delete(unreleased.Labels, "release")
+		delete(unreleased.Spec.Selector.MatchLabels, "release")
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "demo", Labels: map[string]string{"servicemonitorscale.tal.com/enabled": "true"}}},
+			// 控制器停止期间去掉了选择标签的命名空间
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "retired"}},
+			&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "demo", Labels: map[string]string{"app": "api"}}},
+			&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "retired", Labels: map[string]string{"app": "web"}}},
+			generated("demo-api", types.NamespacedName{Namespace: "demo", Name: "api"}),
+			generated("retired-web", types.NamespacedName{Namespace: "retired", Name: "web"}),
+			generated("demo-gone", types.NamespacedName{Namespace: "demo", Name: "gone"}),
+			legacy("api"),
+			legacy("old"),
+			handWritten,
+			labeled,
+			unreleased,
+		).Build()
+		opts := DefaultOptions()
+		opts.MonitorNamespace = "monitoring"
+		filter, err := opts.namespaceFilter(c)
+		Expect(err).NotTo(HaveOccurred())
+		r := &ServiceReconciler{Client: c, Options: opts, Recorder: record.NewFakeRecorder(10), namespaces: filter}
+
+		Expect(r.collectOrphanServiceMonitors(context.Background())).To(Succeed())
+
+		exists := func(name string) bool {
+			err := c.Get(context.Background(), client.ObjectKey{Namespace: "monitoring", Name: name}, &monitoringv1.ServiceMonitor{})
+			if apierrors.IsNotFound(err) {
+				return false
+			}
+			Expect(err).NotTo(HaveOccurred())
+			return true
+		}
+		Expect(exists("demo-api")).To(BeTrue())
+		Expect(exists("demo-gone")).To(BeFalse())
+		Expect(exists("retired-web")).To(BeFalse())
+		Expect(exists("api")).To(BeTrue())
+		Expect(exists("old")).To(BeFalse())
+		Expect(exists("custom")).To(BeTrue())
+		Expect(exists("team")).To(BeTrue())
+		Expect(exists("batch")).To(BeTrue())
+	})
+})
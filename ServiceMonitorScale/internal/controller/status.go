@@ -0,0 +1,204 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// 控制器写回Service的状态注解，非侵入模式下不写入
+//
+//	servicemonitorscale.tal.com/last-probe-time:   得到当前检查结果的检查时间（RFC3339），检查结果变化时更新
+//	servicemonitorscale.tal.com/last-probe-result: 各端口的检查结果，如 http=Healthy,admin=Unreachable
+//	servicemonitorscale.tal.com/service-monitor:   生成的ServiceMonitor（namespace/name）
+const (
+	lastProbeTimeAnnotation   = annotationPrefix + "last-probe-time"
+	lastProbeResultAnnotation = annotationPrefix + "last-probe-result"
+	serviceMonitorAnnotation  = annotationPrefix + "service-monitor"
+)
+
+// monitoredCondition 写入Service status.conditions的条件类型，表示Service是否已被ServiceMonitor监控
+const monitoredCondition = annotationPrefix + "Monitored"
+
+// statusFieldManager 写入状态注解和条件使用的field manager。与写入发现标签的apply分开，
+// 避免两次apply的内容互相删除对方的字段
+const statusFieldManager = fieldManager + "-status"
+
+// Service上Event和条件的原因
+const (
+	reasonMonitorCreated       = "MonitorCreated"
+	reasonMonitorUpdated       = "MonitorUpdated"
+	reasonMonitorReady         = "MonitorReady"
+	reasonMonitorConflict      = "MonitorConflict"
+	reasonMonitorMigrated      = "MonitorMigrated"
+	reasonMonitoredExternally  = "MonitoredExternally"
+	reasonMetricsUnreachable   = "MetricsUnreachable"
+	reasonMetricsPending       = "MetricsPending"
+	reasonNoReadyEndpoints     = "NoReadyEndpoints"
+	reasonInvalidAnnotation    = "InvalidAnnotation"
+	reasonInvalidMetricsFormat = "InvalidMetricsFormat"
+	reasonPortNameConflict     = "PortNameConflict"
+	reasonLabelConflict        = "LabelConflict"
+	reasonSkipped              = "Skipped"
+	reasonAuthUnavailable      = "AuthUnavailable"
+	reasonSampleLimitExceeded  = "SampleLimitExceeded"
+)
+
+// 端口的检查结果
+const (
+	portHealthy          = "Healthy"
+	portPending          = "Pending"
+	portUnreachable      = "Unreachable"
+	portInvalidFormat    = "InvalidFormat"
+	portNoReadyEndpoints = "NoReadyEndpoints"
+	// portSampleLimitExceeded 端点健康，但暴露的sample数量超过sampleLimit
+	portSampleLimitExceeded = "SampleLimitExceeded"
+)
+
+// probeStatus 一次Reconcile中Service各端口metrics端点的检查结果
+type probeStatus struct {
+	healthyPorts []corev1.ServicePort
+	// requeueAfter 存在尚未检查或不健康的端口时Service重新入队的间隔
+	requeueAfter time.Duration
+	// checkedAt 参与判断的检查结果中最近的检查时间，没有任何检查结果时为零值
+	checkedAt time.Time
+	// ports 端口名称及其检查结果，按端口顺序排列
+	ports []string
+	// results 各检查结果出现的次数
+	results map[string]int
+}
+
+func (s *probeStatus) add(port, result string) {
+	if s.results == nil {
+		s.results = make(map[string]int)
+	}
+	s.ports = append(s.ports, port+"="+result)
+	s.results[result]++
+}
+
+// result 返回各端口检查结果的摘要
+func (s *probeStatus) result() string {
+	return strings.Join(s.ports, ",")
+}
+
+// reason 返回没有健康端口时的原因：存在超过sampleLimit的端口时为SampleLimitExceeded，
+// 其次是存在不健康的端点时为MetricsUnreachable，再次是仍在等待检查结果，否则是所有端口都没有就绪的后端
+func (s *probeStatus) reason() string {
+	switch {
+	case s.results[portSampleLimitExceeded] > 0:
+		return reasonSampleLimitExceeded
+	case s.results[portUnreachable] > 0 || s.results[portInvalidFormat] > 0:
+		return reasonMetricsUnreachable
+	case s.results[portPending] > 0:
+		return reasonMetricsPending
+	default:
+		return reasonNoReadyEndpoints
+	}
+}
+
+// statusAnnotations 返回需要写回Service的状态注解，monitor为空表示没有生成ServiceMonitor
+func (s *probeStatus) statusAnnotations(monitor string) map[string]string {
+	annotations := map[string]string{
+		lastProbeResultAnnotation: s.result(),
+	}
+	if !s.checkedAt.IsZero() {
+		annotations[lastProbeTimeAnnotation] = s.checkedAt.UTC().Format(time.RFC3339)
+	}
+	if monitor != "" {
+		annotations[serviceMonitorAnnotation] = monitor
+	}
+	return annotations
+}
+
+// writeStatus 通过server-side apply把状态注解和Monitored条件写回Service，内容没有变化时不发送请求。
+// annotations为空时移除之前写入的状态注解。非侵入模式和dry-run模式下不修改Service
+func (r *ServiceReconciler) writeStatus(ctx context.Context, service *corev1.Service, annotations map[string]string, condition metav1.Condition) error {
+	if r.Options.NonInvasive || r.DryRun != nil {
+		return nil
+	}
+
+	if statusAnnotationsChanged(service.Annotations, annotations) {
+		applyAnnotations := make(map[string]interface{}, len(annotations))
+		for k, v := range annotations {
+			applyAnnotations[k] = v
+		}
+		patch := serviceApplyPatch(service)
+		if len(applyAnnotations) > 0 {
+			patch.Object["metadata"].(map[string]interface{})["annotations"] = applyAnnotations
+		}
+		if err := r.Patch(ctx, patch, client.Apply, client.FieldOwner(statusFieldManager), client.ForceOwnership); err != nil {
+			return fmt.Errorf("failed to apply status annotations to Service %s/%s: %v", service.Namespace, service.Name, err)
+		}
+	}
+
+	// 状态没有变化时保留原有的lastTransitionTime
+	condition.Type = monitoredCondition
+	condition.ObservedGeneration = service.Generation
+	condition.LastTransitionTime = metav1.Now()
+	if existing := meta.FindStatusCondition(service.Status.Conditions, monitoredCondition); existing != nil {
+		if existing.Status == condition.Status && existing.Reason == condition.Reason &&
+			existing.Message == condition.Message && existing.ObservedGeneration == condition.ObservedGeneration {
+			return nil
+		}
+		if existing.Status == condition.Status {
+			condition.LastTransitionTime = existing.LastTransitionTime
+		}
+	}
+	patch := serviceApplyPatch(service)
+	patch.Object["status"] = map[string]interface{}{
+		"conditions": []interface{}{map[string]interface{}{
+			"type":               condition.Type,
+			"status":             string(condition.Status),
+			"observedGeneration": condition.ObservedGeneration,
+			"lastTransitionTime": condition.LastTransitionTime.UTC().Format(time.RFC3339),
+			"reason":             condition.Reason,
+			"message":            condition.Message,
+		}},
+	}
+	if err := r.Status().Patch(ctx, patch, client.Apply, client.FieldOwner(statusFieldManager), client.ForceOwnership); err != nil {
+		return fmt.Errorf("failed to apply %s condition to Service %s/%s: %v", monitoredCondition, service.Namespace, service.Name, err)
+	}
+	log.Log.WithValues("Service", service.Namespace+"/"+service.Name, "status", condition.Status, "reason", condition.Reason).V(1).Info("Service status written")
+	return nil
+}
+
+// statusAnnotationsChanged 判断Service上的状态注解是否与期望的一致。
+// 检查时间每次检查都会变化，只随检查结果或ServiceMonitor的变化一起写入，避免每次Reconcile都修改Service
+func statusAnnotationsChanged(current, desired map[string]string) bool {
+	for _, key := range []string{lastProbeResultAnnotation, serviceMonitorAnnotation} {
+		value, ok := current[key]
+		desiredValue, desiredOK := desired[key]
+		if ok != desiredOK || value != desiredValue {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceApplyPatch 返回只包含Service标识的apply内容
+func serviceApplyPatch(service *corev1.Service) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Service",
+		"metadata": map[string]interface{}{
+			"name":      service.Name,
+			"namespace": service.Namespace,
+		},
+	}}
+}
+
+// conflictReason 区分server-side apply冲突发生在端口名称还是标签上
+func conflictReason(err error) string {
+	if strings.Contains(err.Error(), ".spec.ports") {
+		return reasonPortNameConflict
+	}
+	return reasonLabelConflict
+}
@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+var _ = Describe("probeStatus", func() {
+	It("summarizes the result of every port", func() {
+		status := &probeStatus{checkedAt: time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)}
+		status.add("http", portHealthy)
+		status.add("admin", portUnreachable)
+
+		Expect(status.statusAnnotations("monitoring/api")).To(Equal(map[string]string{
+			lastProbeTimeAnnotation:   "2024-05-01T08:00:00Z",
+			lastProbeResultAnnotation: "http=Healthy,admin=Unreachable",
+			serviceMonitorAnnotation:  "monitoring/api",
+		}))
+	})
+
+	It("prefers unreachable endpoints over pending probes as the reason", func() {
+		status := &probeStatus{}
+		status.add("http", portNoReadyEndpoints)
+		Expect(status.reason()).To(Equal(reasonNoReadyEndpoints))
+		status.add("admin", portPending)
+		Expect(status.reason()).To(Equal(reasonMetricsPending))
+		status.add("debug", portInvalidFormat)
+		Expect(status.reason()).To(Equal(reasonMetricsUnreachable))
+	})
+
+	It("detects changed status annotations", func() {
+		desired := map[string]string{lastProbeResultAnnotation: "http=Healthy"}
+		Expect(statusAnnotationsChanged(map[string]string{"other": "x", lastProbeResultAnnotation: "http=Healthy"}, desired)).To(BeFalse())
+		Expect(statusAnnotationsChanged(map[string]string{lastProbeResultAnnotation: "http=Pending"}, desired)).To(BeTrue())
+		Expect(statusAnnotationsChanged(map[string]string{serviceMonitorAnnotation: "monitoring/api"}, nil)).To(BeTrue())
+		Expect(statusAnnotationsChanged(nil, nil)).To(BeFalse())
+	})
+
+	It("does not rewrite the probe time while the result stays the same", func() {
+		current := map[string]string{lastProbeTimeAnnotation: "2024-05-01T08:00:00Z", lastProbeResultAnnotation: "http=Healthy"}
+		desired := map[string]string{lastProbeTimeAnnotation: "2024-05-01T08:01:00Z", lastProbeResultAnnotation: "http=Healthy"}
+		Expect(statusAnnotationsChanged(current, desired)).To(BeFalse())
+		desired[lastProbeResultAnnotation] = "http=Unreachable"
+		Expect(statusAnnotationsChanged(current, desired)).To(BeTrue())
+	})
+
+	It("does not write the Service when only the probe time changed", func() {
+		patches := 0
+		scheme := runtime.NewScheme()
+		Expect(corev1.AddToScheme(scheme)).To(Succeed())
+		c := fake.NewClientBuilder().WithScheme(scheme).WithInterceptorFuncs(interceptor.Funcs{
+			Patch: func(context.Context, client.WithWatch, client.Object, client.Patch, ...client.PatchOption) error {
+				patches++
+				return nil
+			},
+			SubResourcePatch: func(context.Context, client.Client, string, client.Object, client.Patch, ...client.SubResourcePatchOption) error {
+				patches++
+				return nil
+			},
+		}).Build()
+		r := &ServiceReconciler{Client: c, Options: DefaultOptions()}
+		condition := metav1.Condition{Status: metav1.ConditionTrue, Reason: reasonMonitorReady, Message: "Monitored by ServiceMonitor default/demo-api"}
+		service := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "demo", Annotations: map[string]string{
+				lastProbeTimeAnnotation:   "2024-05-01T08:00:00Z",
+				lastProbeResultAnnotation: "http=Healthy",
+				serviceMonitorAnnotation:  "default/demo-api",
+			}},
+		}
+		existing := condition
+		existing.Type = monitoredCondition
+		service.Status.Conditions = []metav1.Condition{existing}
+
+		status := &probeStatus{checkedAt: time.Date(2024, 5, 1, 8, 1, 0, 0, time.UTC)}
+		status.add("http", portHealthy)
+		Expect(r.writeStatus(context.Background(), service, status.statusAnnotations("default/demo-api"), condition)).To(Succeed())
+		Expect(patches).To(BeZero())
+	})
+})
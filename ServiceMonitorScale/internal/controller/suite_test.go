@@ -0,0 +1,78 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+// Run controller unit tests using the Ginkgo runner.
+func TestController(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Controller Suite")
+}
+
+// withApply 让fake client支持server-side apply：fake client不支持Apply，这里以JSON merge patch近似，
+// 对象不存在时创建。map按key合并、列表整体替换，与控制器apply的原子列表一致，但不记录managedFields
+func withApply(builder *fake.ClientBuilder) *fake.ClientBuilder {
+	applyPatch := func(obj client.Object) (client.Patch, error) {
+		obj.SetResourceVersion("")
+		obj.SetManagedFields(nil)
+		data, err := json.Marshal(obj)
+		if err != nil {
+			return nil, err
+		}
+		return client.RawPatch(types.MergePatchType, data), nil
+	}
+	return builder.WithInterceptorFuncs(interceptor.Funcs{
+		Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+			if patch.Type() != types.ApplyPatchType {
+				return c.Patch(ctx, obj, patch, opts...)
+			}
+			merge, err := applyPatch(obj)
+			if err != nil {
+				return err
+			}
+			err = c.Patch(ctx, obj, merge)
+			if !apierrors.IsNotFound(err) {
+				return err
+			}
+			return c.Create(ctx, obj)
+		},
+		SubResourcePatch: func(ctx context.Context, c client.Client, subResource string, obj client.Object, patch client.Patch, opts ...client.SubResourcePatchOption) error {
+			if patch.Type() != types.ApplyPatchType {
+				return c.SubResource(subResource).Patch(ctx, obj, patch, opts...)
+			}
+			merge, err := applyPatch(obj)
+			if err != nil {
+				return err
+			}
+			return c.SubResource(subResource).Patch(ctx, obj, merge)
+		},
+	})
+}
@@ -0,0 +1,143 @@
+package controller
+
+import (
+	"context"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// workloadKind 描述一种可以生成PodMonitor的工作负载
+type workloadKind struct {
+	kind      string
+	newObject func() client.Object
+	newList   func() client.ObjectList
+	// podTemplate 返回工作负载选择Pod的标签选择器和Pod模板，工作负载不需要单独生成PodMonitor时返回false
+	podTemplate func(obj client.Object) (*metav1.LabelSelector, *corev1.PodTemplateSpec, bool)
+}
+
+// workloadKinds 支持生成PodMonitor的工作负载
+var workloadKinds = []workloadKind{
+	{
+		kind:      "Deployment",
+		newObject: func() client.Object { return &appsv1.Deployment{} },
+		newList:   func() client.ObjectList { return &appsv1.DeploymentList{} },
+		podTemplate: func(obj client.Object) (*metav1.LabelSelector, *corev1.PodTemplateSpec, bool) {
+			d := obj.(*appsv1.Deployment)
+			return d.Spec.Selector, &d.Spec.Template, true
+		},
+	},
+	{
+		kind:      "StatefulSet",
+		newObject: func() client.Object { return &appsv1.StatefulSet{} },
+		newList:   func() client.ObjectList { return &appsv1.StatefulSetList{} },
+		podTemplate: func(obj client.Object) (*metav1.LabelSelector, *corev1.PodTemplateSpec, bool) {
+			s := obj.(*appsv1.StatefulSet)
+			return s.Spec.Selector, &s.Spec.Template, true
+		},
+	},
+	{
+		kind:      "DaemonSet",
+		newObject: func() client.Object { return &appsv1.DaemonSet{} },
+		newList:   func() client.ObjectList { return &appsv1.DaemonSetList{} },
+		podTemplate: func(obj client.Object) (*metav1.LabelSelector, *corev1.PodTemplateSpec, bool) {
+			d := obj.(*appsv1.DaemonSet)
+			return d.Spec.Selector, &d.Spec.Template, true
+		},
+	},
+	{
+		// 不属于Deployment、StatefulSet和DaemonSet的Pod，例如独立的Pod和Job创建的Pod
+		kind:      "Pod",
+		newObject: func() client.Object { return &corev1.Pod{} },
+		newList:   func() client.ObjectList { return &corev1.PodList{} },
+		podTemplate: func(obj client.Object) (*metav1.LabelSelector, *corev1.PodTemplateSpec, bool) {
+			pod := obj.(*corev1.Pod)
+			if owner := metav1.GetControllerOf(pod); owner != nil {
+				switch owner.Kind {
+				case "ReplicaSet", "StatefulSet", "DaemonSet":
+					return nil, nil, false
+				}
+			}
+			return &metav1.LabelSelector{MatchLabels: pod.Labels},
+				&corev1.PodTemplateSpec{ObjectMeta: pod.ObjectMeta, Spec: pod.Spec}, true
+		},
+	},
+}
+
+// containerPorts 返回Pod模板中所有容器的TCP端口
+func containerPorts(template *corev1.PodTemplateSpec) []corev1.ContainerPort {
+	var ports []corev1.ContainerPort
+	for _, container := range template.Spec.Containers {
+		for _, port := range container.Ports {
+			if port.Protocol == "" || port.Protocol == corev1.ProtocolTCP {
+				ports = append(ports, port)
+			}
+		}
+	}
+	return ports
+}
+
+// selectedContainerPorts 返回需要检查的容器端口，未通过注解指定时为所有TCP端口
+func (c *scrapeConfig) selectedContainerPorts(template *corev1.PodTemplateSpec) []corev1.ContainerPort {
+	var ports []corev1.ContainerPort
+	for _, port := range containerPorts(template) {
+		if len(c.Ports) == 0 || contains(c.Ports, port.Name) {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// scrapeAnnotatedPredicate 只处理带有scrape注解的工作负载。更新时旧对象或新对象带有注解即放行，
+// 以便移除注解后清理已生成的PodMonitor
+func scrapeAnnotatedPredicate() predicate.Predicate {
+	annotated := func(obj client.Object) bool {
+		_, ok := obj.GetAnnotations()[scrapeAnnotation]
+		return ok
+	}
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return annotated(e.Object)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return annotated(e.ObjectOld) || annotated(e.ObjectNew)
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return annotated(e.Object)
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			return annotated(e.Object)
+		},
+	}
+}
+
+// namespaceToWorkloads 命名空间创建或标签变化时，将其中带有scrape注解的工作负载加入队列
+func (r *PodMonitorReconciler) namespaceToWorkloads(kind workloadKind) func(context.Context, client.Object) []reconcile.Request {
+	return func(ctx context.Context, obj client.Object) []reconcile.Request {
+		list := kind.newList()
+		if err := r.List(ctx, list, client.InNamespace(obj.GetName())); err != nil {
+			log.Log.Error(err, "failed to list workloads", "kind", kind.kind, "namespace", obj.GetName())
+			return nil
+		}
+		var requests []reconcile.Request
+		_ = meta.EachListItem(list, func(item runtime.Object) error {
+			workload := item.(client.Object)
+			if _, ok := workload.GetAnnotations()[scrapeAnnotation]; ok {
+				requests = append(requests, reconcile.Request{
+					NamespacedName: types.NamespacedName{Namespace: workload.GetNamespace(), Name: workload.GetName()},
+				})
+			}
+			return nil
+		})
+		return requests
+	}
+}